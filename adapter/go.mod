@@ -8,3 +8,5 @@ require (
 )
 
 require golang.org/x/text v0.26.0 // indirect
+
+replace github.com/cuteLittleDevil/go-jt808/shared => ../shared
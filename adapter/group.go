@@ -11,7 +11,7 @@ import (
 )
 
 type group struct {
-	conn         *net.TCPConn
+	conn         net.Conn
 	timeoutRetry time.Duration
 	clients      sync.Map
 	writeMsgChan chan []byte
@@ -19,7 +19,7 @@ type group struct {
 	stopOnce     sync.Once
 }
 
-func newGroup(conn *net.TCPConn, timeoutRetry time.Duration, terminals []Terminal) *group {
+func newGroup(conn net.Conn, timeoutRetry time.Duration, terminals []Terminal) *group {
 	g := &group{
 		conn:         conn,
 		timeoutRetry: timeoutRetry,
@@ -1,6 +1,7 @@
 package adapter
 
 import (
+	"crypto/tls"
 	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 	"time"
 )
@@ -19,6 +20,10 @@ type Options struct {
 	TimeoutRetry time.Duration
 	Terminals    []Terminal
 	AllowCommand []consts.JT808CommandType
+	// TLSConfig TLS配置 默认nil 不使用TLS
+	TLSConfig *tls.Config
+	// ProxyProtocol 解析 PROXY protocol 头部 默认nil 不解析
+	ProxyProtocol *ProxyProtocol
 }
 
 func newOptions(opts []Option) *Options {
@@ -74,3 +79,19 @@ func WithTimeoutRetry(timeout time.Duration) Option {
 		o.TimeoutRetry = timeout
 	}}
 }
+
+// WithTLSConfig 使用TLS接收终端连接, 默认不使用.
+// 需要校验客户端证书的情况设置 config.ClientAuth 和 config.ClientCAs.
+func WithTLSConfig(config *tls.Config) Option {
+	return Option{F: func(o *Options) {
+		o.TLSConfig = config
+	}}
+}
+
+// WithProxyProtocol 解析负载均衡发送的 PROXY protocol(v1/v2) 头部, 默认不解析.
+// 同时使用TLS的情况 头部在TLS握手之前.
+func WithProxyProtocol(proxy ProxyProtocol) Option {
+	return Option{F: func(o *Options) {
+		o.ProxyProtocol = &proxy
+	}}
+}
@@ -1,8 +1,11 @@
 package adapter
 
 import (
+	"crypto/tls"
 	"log/slog"
 	"net"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/proxyproto"
 )
 
 type Adapter struct {
@@ -32,18 +35,36 @@ func (a *Adapter) Run() {
 			slog.Any("err", err))
 		return
 	}
-
 	for {
-		c, err := in.AcceptTCP()
+		c, err := in.Accept()
 		if err != nil {
 			slog.Warn("accept fail",
 				slog.Any("err", err))
 			continue
 		}
 
-		g := newGroup(c, a.opts.TimeoutRetry, a.createTerminals())
-		go g.run()
+		go a.serve(c)
+	}
+}
+
+// serve 按顺序处理 PROXY 头部和TLS 然后开始转发.
+func (a *Adapter) serve(c net.Conn) {
+	if a.opts.ProxyProtocol != nil {
+		proxy, err := proxyproto.ReadHeader(c, *a.opts.ProxyProtocol)
+		if err != nil {
+			slog.Warn("proxy protocol",
+				slog.String("address", c.RemoteAddr().String()),
+				slog.Any("err", err))
+			_ = c.Close()
+			return
+		}
+		c = proxy
+	}
+	if a.opts.TLSConfig != nil {
+		c = tls.Server(c, a.opts.TLSConfig)
 	}
+	g := newGroup(c, a.opts.TimeoutRetry, a.createTerminals())
+	g.run()
 }
 
 func (a *Adapter) createTerminals() []Terminal {
@@ -0,0 +1,224 @@
+package adapter
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// heartbeatPacket 手机号 12345678901 的心跳.
+var heartbeatPacket, _ = hex.DecodeString("7e0002000001234567890100008a7e")
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// startTarget 模拟808服务 记录收到的数据并原样回复.
+func startTarget(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	received := make(chan []byte, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					received <- bytes.Clone(buf[:n])
+					_, _ = conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func startTestAdapter(t *testing.T, opts ...Option) (string, <-chan []byte) {
+	t.Helper()
+	target, received := startTarget(t)
+	addr := freeAddr(t)
+	all := append([]Option{
+		WithHostPorts(addr),
+		WithTerminals(Terminal{Mode: Leader, TargetAddr: target}),
+	}, opts...)
+	go New(all...).Run()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return addr, received
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("adapter %s not started", addr)
+	return "", nil
+}
+
+func newTestTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "adapter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, pool
+}
+
+func waitData(t *testing.T, ch <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait data timeout")
+	}
+	return nil
+}
+
+// readEcho 读取808服务经过转发的回复.
+func readEcho(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	return buf[:n]
+}
+
+func waitClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestAdapter_tls(t *testing.T) {
+	config, pool := newTestTLSConfig(t)
+	addr, received := startTestAdapter(t, WithTLSConfig(config))
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	// 808服务收到的是解密后的报文 回复经过TLS返回终端
+	if got := waitData(t, received); !bytes.Equal(got, heartbeatPacket) {
+		t.Fatalf("target received = %x, want %x", got, heartbeatPacket)
+	}
+	if got := readEcho(t, conn); !bytes.Equal(got, heartbeatPacket) {
+		t.Fatalf("reply = %x, want %x", got, heartbeatPacket)
+	}
+
+	// 没有TLS握手的连接不会转发
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer plain.Close()
+	if _, err := plain.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	waitClosed(t, plain)
+	select {
+	case got := <-received:
+		t.Fatalf("target received plaintext = %x", got)
+	default:
+	}
+}
+
+func TestAdapter_proxyProtocol(t *testing.T) {
+	addr, received := startTestAdapter(t,
+		WithProxyProtocol(ProxyProtocol{Timeout: time.Second, Required: true}),
+	)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	data := append([]byte("PROXY TCP4 192.0.2.10 192.0.2.20 40000 18080\r\n"), heartbeatPacket...)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	// 头部不会转发到808服务
+	if got := waitData(t, received); !bytes.Equal(got, heartbeatPacket) {
+		t.Fatalf("target received = %x, want %x", got, heartbeatPacket)
+	}
+	if got := readEcho(t, conn); !bytes.Equal(got, heartbeatPacket) {
+		t.Fatalf("reply = %x, want %x", got, heartbeatPacket)
+	}
+
+	// 必须有头部 没有的连接直接关闭
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer plain.Close()
+	if _, err := plain.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	waitClosed(t, plain)
+	select {
+	case got := <-received:
+		t.Fatalf("target received without header = %x", got)
+	default:
+	}
+}
@@ -1,6 +1,7 @@
 package attachment
 
 import (
+	"crypto/x509"
 	"errors"
 	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 	"io"
@@ -12,6 +13,8 @@ type connection struct {
 	activeSafetyType consts.ActiveSafetyType
 	dataHandleFunc   func() DataHandler
 	fileEventer      FileEventer
+	// certificateKeyFunc 从TLS客户端证书获取终端手机号 nil表示不校验
+	certificateKeyFunc func(cert *x509.Certificate) string
 }
 
 func newConnection(conn net.Conn, activeSafetyType consts.ActiveSafetyType,
@@ -31,6 +34,7 @@ func newConnection(conn net.Conn, activeSafetyType consts.ActiveSafetyType,
 
 func (c *connection) run() {
 	var (
+		verified = false
 		curData  = make([]byte, 100*1024)
 		progress = &PackageProgress{
 			ProgressStage: ProgressStageInit,
@@ -83,6 +87,13 @@ func (c *connection) run() {
 			progress.historyData = append(progress.historyData, curData[:n]...)
 			for err := range progress.iter() {
 				if err == nil {
+					if phone := progress.ExtensionFields.TerminalPhoneNo; !verified && phone != "" {
+						if err := c.verifyCertificateKey(phone); err != nil {
+							progress.ExtensionFields.Err = err
+							return
+						}
+						verified = true
+					}
 					if progress.hasJT808Reply() {
 						data, err := progress.handle.ReplyData()
 						progress.ExtensionFields.RecentPlatformData = data
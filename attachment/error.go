@@ -1,10 +1,18 @@
 package attachment
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/proxyproto"
+)
 
 var (
 	ErrUnknownCommand      = errors.New("unknown command")
 	ErrDataInconsistency   = errors.New("data inconsistency")
 	ErrInsufficientDataLen = errors.New("insufficient data len")
-	_errNotStreamData      = errors.New("not stream data")
+	// ErrCertificateKeyMismatch 终端手机号和TLS客户端证书不一致 见 WithCertificateKeyFunc.
+	ErrCertificateKeyMismatch = errors.New("certificate key mismatch")
+	// ErrProxyHeaderInvalid PROXY protocol 头部错误或者缺失 见 WithProxyProtocol.
+	ErrProxyHeaderInvalid = proxyproto.ErrHeaderInvalid
+	_errNotStreamData     = errors.New("not stream data")
 )
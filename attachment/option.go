@@ -1,6 +1,10 @@
 package attachment
 
-import "github.com/cuteLittleDevil/go-jt808/shared/consts"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
 
 type Option struct {
 	F func(o *Options)
@@ -18,6 +22,12 @@ type Options struct {
 	FileEventerFunc  func() FileEventer
 	ActiveSafetyType consts.ActiveSafetyType
 	DataHandleFunc   func() DataHandler
+	// TLSConfig TLS配置 默认nil 不使用TLS
+	TLSConfig *tls.Config
+	// CertificateKeyFunc 从TLS客户端证书获取终端手机号 默认nil 不校验
+	CertificateKeyFunc func(cert *x509.Certificate) string
+	// ProxyProtocol 解析 PROXY protocol 头部 默认nil 不解析
+	ProxyProtocol *ProxyProtocol
 }
 
 func newOptions(opts []Option) *Options {
@@ -69,3 +79,28 @@ func WithDataHandleFunc(handleFunc func() DataHandler) Option {
 		o.DataHandleFunc = handleFunc
 	}}
 }
+
+// WithTLSConfig 使用TLS接收终端连接, 默认不使用.
+// 需要校验客户端证书的情况设置 config.ClientAuth 和 config.ClientCAs.
+func WithTLSConfig(config *tls.Config) Option {
+	return Option{F: func(o *Options) {
+		o.TLSConfig = config
+	}}
+}
+
+// WithCertificateKeyFunc 设置从TLS客户端证书获取终端手机号的方式, 需要和 WithTLSConfig 一起使用.
+// 解析到终端手机号后和证书对应的不一致(或者没有客户端证书)的情况断开连接, 错误为 ErrCertificateKeyMismatch.
+// 没有设置 WithTLSConfig 的情况 所有连接都会断开.
+func WithCertificateKeyFunc(keyFunc func(cert *x509.Certificate) string) Option {
+	return Option{F: func(o *Options) {
+		o.CertificateKeyFunc = keyFunc
+	}}
+}
+
+// WithProxyProtocol 解析负载均衡发送的 PROXY protocol(v1/v2) 头部, 默认不解析.
+// 同时使用TLS的情况 头部在TLS握手之前.
+func WithProxyProtocol(proxy ProxyProtocol) Option {
+	return Option{F: func(o *Options) {
+		o.ProxyProtocol = &proxy
+	}}
+}
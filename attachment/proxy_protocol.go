@@ -0,0 +1,7 @@
+package attachment
+
+import "github.com/cuteLittleDevil/go-jt808/shared/proxyproto"
+
+// ProxyProtocol 解析负载均衡(HAProxy、LVS等)在连接开头发送的 PROXY protocol 头部, 见 WithProxyProtocol.
+// 支持 v1(文本) 和 v2(二进制), 解析后终端的地址为头部中的源地址.
+type ProxyProtocol = proxyproto.Config
@@ -1,8 +1,11 @@
 package attachment
 
 import (
+	"crypto/tls"
 	"log/slog"
 	"net"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/proxyproto"
 )
 
 type GoJT808 struct {
@@ -25,7 +28,6 @@ func (g *GoJT808) Run() {
 			slog.Any("err", err))
 		return
 	}
-
 	for {
 		c, err := in.Accept()
 		if err != nil {
@@ -33,7 +35,27 @@ func (g *GoJT808) Run() {
 				slog.Any("err", err))
 			continue
 		}
-		conn := newConnection(c, g.opts.ActiveSafetyType, g.opts.DataHandleFunc, g.opts.FileEventerFunc())
-		go conn.run()
+		go g.serve(c)
+	}
+}
+
+// serve 按顺序处理 PROXY 头部和TLS 然后开始处理连接.
+func (g *GoJT808) serve(c net.Conn) {
+	if g.opts.ProxyProtocol != nil {
+		proxy, err := proxyproto.ReadHeader(c, *g.opts.ProxyProtocol)
+		if err != nil {
+			slog.Warn("proxy protocol",
+				slog.String("address", c.RemoteAddr().String()),
+				slog.Any("err", err))
+			_ = c.Close()
+			return
+		}
+		c = proxy
+	}
+	if g.opts.TLSConfig != nil {
+		c = tls.Server(c, g.opts.TLSConfig)
 	}
+	conn := newConnection(c, g.opts.ActiveSafetyType, g.opts.DataHandleFunc, g.opts.FileEventerFunc())
+	conn.certificateKeyFunc = g.opts.CertificateKeyFunc
+	conn.run()
 }
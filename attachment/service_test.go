@@ -0,0 +1,270 @@
+package attachment
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) serverConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	return &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+}
+
+// progressRecord 记录连接结束时的进度.
+type progressRecord struct {
+	stage ProgressStage
+	phone string
+	addr  string
+	err   error
+}
+
+type recordingFileEvent struct {
+	quit chan progressRecord
+	// probe 探测服务启动的连接 它的结束不记录
+	probe string
+}
+
+func (r *recordingFileEvent) OnEvent(progress *PackageProgress) {
+	switch progress.ProgressStage {
+	case ProgressStageSuccessQuit, ProgressStageFailQuit, ProgressStageUnexpectedExit:
+		r.quit <- progressRecord{
+			stage: progress.ProgressStage,
+			phone: progress.ExtensionFields.TerminalPhoneNo,
+			addr:  progress.ExtensionFields.Debug.RemoteAddr,
+			err:   progress.ExtensionFields.Err,
+		}
+	}
+}
+
+func startTestServer(t *testing.T, opts ...Option) (string, *recordingFileEvent) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	events := &recordingFileEvent{quit: make(chan progressRecord, 4)}
+	all := append([]Option{
+		WithHostPorts(addr),
+		WithFileEventerFunc(func() FileEventer { return events }),
+	}, opts...)
+	go New(all...).Run()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			events.probe = conn.LocalAddr().String()
+			_ = conn.Close()
+			return addr, events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server %s not started", addr)
+	return "", nil
+}
+
+func read1210(t *testing.T) []byte {
+	t.Helper()
+	b, err := os.ReadFile("./testdata/su_biao/7e1210.log")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	data, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	return data
+}
+
+func waitQuit(t *testing.T, events *recordingFileEvent) progressRecord {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case v := <-events.quit:
+			if v.addr != events.probe {
+				return v
+			}
+		case <-timeout:
+			t.Fatal("connection not quit")
+		}
+	}
+}
+
+// readReply 读取平台对0x1210的回复.
+func readReply(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	return buf[:n]
+}
+
+func TestGoJT808_tlsCertificateKey(t *testing.T) {
+	const phone = "1001" // 7e1210.log 中的手机号
+	ca := newTestCA(t)
+	tests := []struct {
+		name       string
+		commonName string
+		wantErr    error
+	}{
+		{name: "证书和手机号一致", commonName: phone, wantErr: nil},
+		{name: "证书和手机号不一致", commonName: "99999999999", wantErr: ErrCertificateKeyMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, events := startTestServer(t,
+				WithTLSConfig(ca.serverConfig(t)),
+				WithCertificateKeyFunc(CertificateCommonName),
+			)
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				Certificates: []tls.Certificate{ca.issue(t, tt.commonName, x509.ExtKeyUsageClientAuth)},
+				RootCAs:      ca.pool,
+			})
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			if _, err := conn.Write(read1210(t)); err != nil {
+				t.Fatalf("Write 0x1210 error = %v", err)
+			}
+			if tt.wantErr == nil {
+				if reply := readReply(t, conn); len(reply) == 0 || reply[0] != 0x7e {
+					t.Fatalf("reply = %x", reply)
+				}
+				_ = conn.Close()
+			}
+			got := waitQuit(t, events)
+			if !errors.Is(got.err, tt.wantErr) || got.phone != phone {
+				t.Fatalf("quit = %+v, want err %v phone %s", got, tt.wantErr, phone)
+			}
+		})
+	}
+}
+
+func TestGoJT808_certificateKeyRejectPlaintext(t *testing.T) {
+	// 没有TLS 无法校验证书 解析到手机号后断开
+	addr, events := startTestServer(t, WithCertificateKeyFunc(CertificateCommonName))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(read1210(t)); err != nil {
+		t.Fatalf("Write 0x1210 error = %v", err)
+	}
+	if got := waitQuit(t, events); !errors.Is(got.err, ErrCertificateKeyMismatch) {
+		t.Fatalf("quit err = %v, want %v", got.err, ErrCertificateKeyMismatch)
+	}
+}
+
+func TestGoJT808_proxyProtocol(t *testing.T) {
+	addr, events := startTestServer(t,
+		WithProxyProtocol(ProxyProtocol{Timeout: time.Second, Required: true}),
+	)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	data := append([]byte("PROXY TCP4 192.0.2.10 192.0.2.20 40000 10808\r\n"), read1210(t)...)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	if reply := readReply(t, conn); len(reply) == 0 || reply[0] != 0x7e {
+		t.Fatalf("reply = %x", reply)
+	}
+	_ = conn.Close()
+	// 终端地址为头部中的源地址
+	if got := waitQuit(t, events); got.addr != "192.0.2.10:40000" || got.err != nil {
+		t.Fatalf("quit = %+v, want addr 192.0.2.10:40000", got)
+	}
+
+	// 没有头部的连接直接关闭
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(read1210(t)); err != nil {
+		t.Fatalf("Write 0x1210 error = %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1024)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() err = %v, want connection closed", err)
+	}
+}
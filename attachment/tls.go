@@ -0,0 +1,33 @@
+package attachment
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// CertificateCommonName 使用客户端证书的 CommonName 作为终端手机号, 见 WithCertificateKeyFunc.
+func CertificateCommonName(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// verifyCertificateKey 校验客户端证书和终端手机号是否一致.
+// 未设置 CertificateKeyFunc 的情况不校验, 设置了的情况不是TLS的连接(没有设置 TLSConfig)拒绝.
+func (c *connection) verifyCertificateKey(phone string) error {
+	if c.certificateKeyFunc == nil {
+		return nil
+	}
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return errors.Join(ErrCertificateKeyMismatch, fmt.Errorf("phone[%s] not tls connection", phone))
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.Join(ErrCertificateKeyMismatch, fmt.Errorf("phone[%s] no client certificate", phone))
+	}
+	if certKey := c.certificateKeyFunc(certs[0]); certKey != phone {
+		return errors.Join(ErrCertificateKeyMismatch, fmt.Errorf("phone[%s] certificate key[%s]", phone, certKey))
+	}
+	return nil
+}
@@ -7,4 +7,10 @@ var (
 	ErrHeaderLength2Short      = errors.New("header length too short")
 	ErrBodyLengthInconsistency = errors.New("body length inconsistency")
 	ErrCheckCode               = errors.New("check code fail")
+	// ErrEncryptMethodUnsupported 消息体的加密方式不支持 目前只支持RSA
+	ErrEncryptMethodUnsupported = errors.New("encrypt method unsupported")
+	// ErrDecryptFail 消息体解密失败
+	ErrDecryptFail = errors.New("decrypt fail")
+	// ErrRSAPublicKey RSA公钥不合法 n需要是1024位 e为大于1的奇数
+	ErrRSAPublicKey = errors.New("invalid rsa public key")
 )
@@ -6,3 +6,5 @@ require (
 	github.com/cuteLittleDevil/go-jt808/shared v1.6.0
 	golang.org/x/text v0.21.0
 )
+
+replace github.com/cuteLittleDevil/go-jt808/shared => ../shared
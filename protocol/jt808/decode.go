@@ -0,0 +1,125 @@
+package jt808
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cuteLittleDevil/go-jt808/protocol"
+	"github.com/cuteLittleDevil/go-jt808/protocol/utils"
+)
+
+type (
+	// DecodeOptions 解码选项, 零值为严格模式 和 JTMessage.Decode 相同.
+	// 用于兼容部分设备不规范的报文, 见 LenientDecodeOptions.
+	DecodeOptions struct {
+		// IgnoreCheckCode 忽略校验码错误
+		IgnoreCheckCode bool
+		// AllowTrailingBytes 允许消息体和校验码之间有多余的数据 按消息头的长度截取消息体
+		AllowTrailingBytes bool
+		// AllowBodyLengthMismatch 允许实际的消息体长度和消息头不一致 使用实际的消息体
+		// 同时设置 AllowTrailingBytes 的情况 实际更长的按消息头的长度截取
+		AllowBodyLengthMismatch bool
+	}
+
+	// DecodeError 解码失败的详情, 可以使用 errors.Is 判断具体的错误 如 protocol.ErrCheckCode.
+	DecodeError struct {
+		// Err 具体的错误 protocol.ErrUnqualifiedData 等
+		Err error
+		// Offset 出错的位置
+		// ErrUnqualifiedData 为 Frame 中的下标, 其他为反转义后的数据中的下标(不包含开头的0x7e)
+		Offset int
+		// Expected 期望的值
+		// 校验码错误为计算的校验码, 长度错误为需要的长度, 转义错误为0x7e(首尾)或者0(0x7d后面的)
+		Expected int
+		// Actual 实际的值 校验码、长度或者出错位置的字节
+		Actual int
+		// Frame 原始的报文 包含首尾的0x7e
+		Frame []byte
+	}
+)
+
+// StrictDecodeOptions 严格模式 校验码和消息体长度都需要正确.
+func StrictDecodeOptions() DecodeOptions {
+	return DecodeOptions{}
+}
+
+// LenientDecodeOptions 宽松模式 忽略校验码错误 允许多余的数据和消息体长度不一致.
+func LenientDecodeOptions() DecodeOptions {
+	return DecodeOptions{
+		IgnoreCheckCode:         true,
+		AllowTrailingBytes:      true,
+		AllowBodyLengthMismatch: true,
+	}
+}
+
+// Decode 使用该选项解码, 失败的情况返回 *DecodeError.
+func (o DecodeOptions) Decode(j *JTMessage, data []byte) error {
+	_, err := o.DecodeInto(j, nil, data)
+	return err
+}
+
+// DecodeInto 使用该选项解码, buf 的用法见 JTMessage.DecodeInto.
+func (o DecodeOptions) DecodeInto(j *JTMessage, buf []byte, data []byte) ([]byte, error) {
+	escapeData, buf, err := appendUnescape(buf, data)
+	if err == nil {
+		err = o.decode(j, escapeData)
+	}
+	if err != nil {
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			decodeErr.Frame = bytes.Clone(data)
+		}
+	}
+	return buf, err
+}
+
+func (o DecodeOptions) decode(j *JTMessage, escapeData []byte) error {
+	end := len(escapeData) - 1 // 校验码的位置
+	if code := utils.CreateVerifyCode(escapeData[:end]); code != escapeData[end] && !o.IgnoreCheckCode {
+		return &DecodeError{
+			Err:      protocol.ErrCheckCode,
+			Offset:   end,
+			Expected: int(code),
+			Actual:   int(escapeData[end]),
+		}
+	}
+	if err := j.Header.decode(escapeData); err != nil {
+		return err
+	}
+	start := j.Header.headEnd
+	bodyEnd := start + int(j.Header.Property.BodyDayaLen)
+	switch {
+	case bodyEnd == end:
+	case bodyEnd < end && o.AllowTrailingBytes:
+	case start <= end && o.AllowBodyLengthMismatch:
+		bodyEnd = end
+	default:
+		return &DecodeError{
+			Err:      protocol.ErrBodyLengthInconsistency,
+			Offset:   start,
+			Expected: int(j.Header.Property.BodyDayaLen),
+			Actual:   end - start,
+		}
+	}
+	j.Body = escapeData[start:bodyEnd]
+	j.VerifyCode = escapeData[end]
+	return nil
+}
+
+func newHeaderLengthError(expected, actual int) *DecodeError {
+	return &DecodeError{
+		Err:      protocol.ErrHeaderLength2Short,
+		Offset:   actual,
+		Expected: expected,
+		Actual:   actual,
+	}
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s offset [%d] expected [%d] actual [%d] frame [%x]",
+		e.Err, e.Offset, e.Expected, e.Actual, e.Frame)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,151 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/cuteLittleDevil/go-jt808/protocol"
+	"testing"
+)
+
+func TestDecodeOptions_Decode(t *testing.T) {
+	type want struct {
+		body    string
+		err     error
+		details DecodeError
+	}
+	tests := []struct {
+		name string
+		opts DecodeOptions
+		args string
+		want want
+	}{
+		{
+			name: "严格模式 校验码错误",
+			opts: StrictDecodeOptions(),
+			args: "7e0002000001234567890100008b7e",
+			want: want{
+				err:     protocol.ErrCheckCode,
+				details: DecodeError{Offset: 12, Expected: 0x8a, Actual: 0x8b},
+			},
+		},
+		{
+			name: "宽松模式 忽略校验码错误",
+			opts: LenientDecodeOptions(),
+			args: "7e0002000001234567890100008b7e",
+			want: want{body: ""},
+		},
+		{
+			name: "严格模式 多余的数据",
+			opts: StrictDecodeOptions(),
+			args: "7e0002000001234567890100000102897e",
+			want: want{
+				err:     protocol.ErrBodyLengthInconsistency,
+				details: DecodeError{Offset: 12, Expected: 0, Actual: 2},
+			},
+		},
+		{
+			name: "允许多余的数据 按消息头的长度截取",
+			opts: DecodeOptions{AllowTrailingBytes: true},
+			args: "7e0002000001234567890100000102897e",
+			want: want{body: ""},
+		},
+		{
+			name: "允许长度不一致 使用实际的消息体",
+			opts: DecodeOptions{AllowBodyLengthMismatch: true},
+			args: "7e0002000001234567890100000102897e",
+			want: want{body: "0102"},
+		},
+		{
+			name: "允许多余的数据 消息体不够的情况",
+			opts: DecodeOptions{AllowTrailingBytes: true},
+			args: "7e000200020123456789010000887e",
+			want: want{
+				err:     protocol.ErrBodyLengthInconsistency,
+				details: DecodeError{Offset: 12, Expected: 2, Actual: 0},
+			},
+		},
+		{
+			name: "宽松模式 消息体不够的情况",
+			opts: LenientDecodeOptions(),
+			args: "7e000200020123456789010000887e",
+			want: want{body: ""},
+		},
+		{
+			name: "消息头不够",
+			opts: LenientDecodeOptions(),
+			args: "7e000200000123207e",
+			want: want{
+				err:     protocol.ErrHeaderLength2Short,
+				details: DecodeError{Offset: 7, Expected: 12, Actual: 7},
+			},
+		},
+		{
+			name: "转义错误",
+			opts: LenientDecodeOptions(),
+			args: "7e02007d037e",
+			want: want{
+				err:     protocol.ErrUnqualifiedData,
+				details: DecodeError{Offset: 4, Expected: 0, Actual: 0x03},
+			},
+		},
+		{
+			name: "结尾不是0x7e",
+			opts: LenientDecodeOptions(),
+			args: "7e02007d01",
+			want: want{
+				err:     protocol.ErrUnqualifiedData,
+				details: DecodeError{Offset: 4, Expected: 0x7e, Actual: 0x01},
+			},
+		},
+		{
+			name: "开头不是0x7e",
+			opts: LenientDecodeOptions(),
+			args: "0102007e",
+			want: want{
+				err:     protocol.ErrUnqualifiedData,
+				details: DecodeError{Offset: 0, Expected: 0x7e, Actual: 0x01},
+			},
+		},
+		{
+			name: "长度不够",
+			opts: LenientDecodeOptions(),
+			args: "7e7e",
+			want: want{
+				err:     protocol.ErrUnqualifiedData,
+				details: DecodeError{Offset: 2, Expected: 3, Actual: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.args)
+			jtMsg := NewJTMessage()
+			err := tt.opts.Decode(jtMsg, data)
+			if tt.want.err == nil {
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if got := hex.EncodeToString(jtMsg.Body); got != tt.want.body {
+					t.Errorf("Decode() body = %s, want %s", got, tt.want.body)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want.err) {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.want.err)
+			}
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("Decode() error = %T, want *DecodeError", err)
+			}
+			if decodeErr.Offset != tt.want.details.Offset ||
+				decodeErr.Expected != tt.want.details.Expected ||
+				decodeErr.Actual != tt.want.details.Actual {
+				t.Errorf("Decode() error = %v, want %+v", decodeErr, tt.want.details)
+			}
+			if !bytes.Equal(decodeErr.Frame, data) {
+				t.Errorf("Frame = %x, want %x", decodeErr.Frame, data)
+			}
+		})
+	}
+}
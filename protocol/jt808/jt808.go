@@ -1,16 +1,20 @@
 package jt808
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
-	"github.com/cuteLittleDevil/go-jt808/protocol"
 	"github.com/cuteLittleDevil/go-jt808/protocol/utils"
 	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 	"strings"
 )
 
-// maxBodyLength 平台下发给设备单个包 body最大长度.
-const maxBodyLength = 1000
+const (
+	// DefaultMaxBodyLength 平台下发给设备单个包 body默认最大长度.
+	DefaultMaxBodyLength = 1000
+	// MaxBodyLengthLimit 消息体长度占10bit 单个包 body最大长度为1023.
+	MaxBodyLengthLimit = 0x3FF
+)
 
 type (
 	Header struct {
@@ -36,11 +40,22 @@ type (
 		PlatformSerialNumber uint16 `json:"platformSerialNumber,omitempty"`
 		// ReplyID 平台回复的消息ID
 		ReplyID uint16 `json:"replyID,omitempty"`
+		// MaxBodyLength 平台下发时单个包 body最大长度 超过的分包
+		// 不在 1-1023 范围内的情况使用默认的 DefaultMaxBodyLength
+		MaxBodyLength int `json:"maxBodyLength,omitempty"`
 
 		// headEnd 请求头结束位置
 		headEnd int
 		// bcdTerminalPhoneNo 设备上传的bcd编码的手机号
 		bcdTerminalPhoneNo []byte
+		// phoneCache 上一次解码的手机号 复用 JTMessage 时避免重复分配
+		phoneCache phoneCache
+	}
+
+	phoneCache struct {
+		bcd   [10]byte
+		n     int
+		phone string
 	}
 
 	BodyProperty struct {
@@ -85,37 +100,32 @@ func NewJTMessage() *JTMessage {
 	}
 }
 
+// Decode 严格模式解码, 失败的情况返回 *DecodeError, 其他模式见 DecodeOptions.
 func (j *JTMessage) Decode(data []byte) error {
-	escapeData, err := unescape(data)
-	if err != nil {
-		return err
-	}
-	if code := utils.CreateVerifyCode(escapeData); code != 0 {
-		return protocol.ErrCheckCode
-	}
-	if err := j.Header.decode(escapeData); err != nil {
-		return err
-	}
-	start := j.Header.headEnd
-	end := start + int(j.Header.Property.BodyDayaLen)
-	if end+1 != len(escapeData) {
-		return protocol.ErrBodyLengthInconsistency
-	}
-	j.Body = escapeData[start:end]
-	j.VerifyCode = escapeData[end]
-	return nil
+	_, err := j.DecodeInto(nil, data)
+	return err
+}
+
+// DecodeInto 和 Decode 相同, 需要反转义的情况 把反转义后的数据追加到 buf 后面.
+// 返回追加后的 buf 可以用于下一次解码, 没有需要反转义的情况不使用 buf.
+//
+// 零拷贝约定：
+//   - Body 是 data 或 buf 的视图，不会复制字节
+//   - 复用 buf（如 buf[:0]）或修改 data 之前须处理完，长期持有需要调用方自行 copy
+func (j *JTMessage) DecodeInto(buf []byte, data []byte) ([]byte, error) {
+	return StrictDecodeOptions().DecodeInto(j, buf, data)
 }
 
 func (h *Header) decode(data []byte) error {
 	if len(data) < 4 {
-		return protocol.ErrHeaderLength2Short
+		return newHeaderLengthError(4, len(data))
 	}
 	h.ID = binary.BigEndian.Uint16(data[0:2])
 	h.Property.decode(data[2:4])
 	var (
 		start    = 4
 		phoneLen = 6
-		version  = consts.JT808Protocol2013 // 默认2013版本
+		version  = consts.JT808Protocol2013 // 默认2013版本 2011版本的固定头相同 见 ApplyProtocolVersion
 	)
 	if h.Property.Version == 1 {
 		start = 5
@@ -123,16 +133,18 @@ func (h *Header) decode(data []byte) error {
 		version = consts.JT808Protocol2019
 	}
 	if len(data) < start+phoneLen+2 {
-		return protocol.ErrHeaderLength2Short
+		return newHeaderLengthError(start+phoneLen+2, len(data))
 	}
 	h.ProtocolVersion = version
-	h.bcdTerminalPhoneNo = data[start : start+phoneLen]
-	h.TerminalPhoneNo = utils.Bcd2Dec(h.bcdTerminalPhoneNo)
+	h.TerminalPhoneNo = h.phoneCache.decode(data[start : start+phoneLen])
+	// 不引用 data 平台异步回复时 data 可能已经被下一次读取复用了
+	h.bcdTerminalPhoneNo = h.phoneCache.bcd[:h.phoneCache.n]
 	h.SerialNumber = binary.BigEndian.Uint16(data[start+phoneLen : start+phoneLen+2])
 	end := start + phoneLen + 2
+	h.SubPackageSum, h.SubPackageNo = 0, 0
 	if h.Property.isSubPackage {
 		if len(data) < start+phoneLen+6 {
-			return protocol.ErrHeaderLength2Short
+			return newHeaderLengthError(start+phoneLen+6, len(data))
 		}
 		h.SubPackageSum = binary.BigEndian.Uint16(data[start+phoneLen+2 : start+phoneLen+4])
 		h.SubPackageNo = binary.BigEndian.Uint16(data[start+phoneLen+4 : start+phoneLen+6])
@@ -142,16 +154,27 @@ func (h *Header) decode(data []byte) error {
 	return nil
 }
 
+// Clone 返回 Header 的副本, 修改副本(如平台的流水号和回复的消息ID)不影响原来的.
+func (h *Header) Clone() *Header {
+	c := *h
+	if h.Property != nil {
+		property := *h.Property
+		c.Property = &property
+	}
+	c.bcdTerminalPhoneNo = bytes.Clone(h.bcdTerminalPhoneNo)
+	return &c
+}
+
 // Encode 已废弃。
 //
 // Deprecated: 该方法仅为兼容旧版本而保留，会把所有分包拼接成一个大 []byte 返回.
 // 请改用 EncodePackets 方法，分包情况它会返回多个独立的协议包，推荐使用.
 func (h *Header) Encode(body []byte) []byte {
-	if len(body) <= maxBodyLength {
+	if len(body) <= h.maxBodyLength() {
 		return h.createPackage(body, 0, 0)
 	} else {
 		packets := h.splitIntoPackets(body)
-		result := make([]byte, 0, len(packets)*maxBodyLength)
+		result := make([]byte, 0, len(packets)*h.maxBodyLength())
 		for _, b := range packets {
 			result = append(result, b...)
 		}
@@ -161,13 +184,38 @@ func (h *Header) Encode(body []byte) []byte {
 
 // EncodePackets 推荐的编码方法，返回分包的结果.
 func (h *Header) EncodePackets(body []byte) [][]byte {
-	if len(body) <= maxBodyLength {
+	if len(body) <= h.maxBodyLength() {
 		return [][]byte{h.createPackage(body, 0, 0)}
 	}
 	return h.splitIntoPackets(body)
 }
 
+// AppendEncode 把编码后的报文追加到 dst 后面 返回追加后的 dst.
+// 不分包的情况 dst 容量足够时不分配内存, 分包的情况多个报文首尾相连.
+func (h *Header) AppendEncode(dst []byte, body []byte) []byte {
+	maxBodyLength := h.maxBodyLength()
+	if len(body) <= maxBodyLength {
+		return h.appendPackage(dst, body, 0, 0)
+	}
+	sum := (len(body) + maxBodyLength - 1) / maxBodyLength
+	for i := 0; i < sum; i++ {
+		start := i * maxBodyLength
+		end := min(start+maxBodyLength, len(body))
+		dst = h.appendPackage(dst, body[start:end], uint16(i+1), uint16(sum))
+	}
+	return dst
+}
+
+// maxBodyLength 单个包 body最大长度 见 MaxBodyLength.
+func (h *Header) maxBodyLength() int {
+	if h.MaxBodyLength <= 0 || h.MaxBodyLength > MaxBodyLengthLimit {
+		return DefaultMaxBodyLength
+	}
+	return h.MaxBodyLength
+}
+
 func (h *Header) splitIntoPackets(body []byte) [][]byte {
+	maxBodyLength := h.maxBodyLength()
 	bodyLen := len(body)
 	fullGroups := bodyLen / maxBodyLength
 	remaining := bodyLen % maxBodyLength
@@ -189,18 +237,23 @@ func (h *Header) splitIntoPackets(body []byte) [][]byte {
 }
 
 func (h *Header) createPackage(body []byte, num, sum uint16) []byte {
-	data := make([]byte, 4, len(body)+25) // 2019版最大固定部分是21 考虑到转义部分 设置25
+	data := make([]byte, 0, len(body)+25) // 2019版最大固定部分是21 考虑到转义部分 设置25
+	return h.appendPackage(data, body, num, sum)
+}
+
+func (h *Header) appendPackage(data []byte, body []byte, num, sum uint16) []byte {
+	begin := len(data)
 	id := h.ReplyID
 	if id == 0 {
 		id = h.ID
 	}
-	binary.BigEndian.PutUint16(data[:2], id)   // 写消息ID
-	h.Property.BodyDayaLen = uint16(len(body)) // 消息的长度改为回复的body长度
-	h.Property.PacketFragmented = 0            // 不分包
+	data = binary.BigEndian.AppendUint16(data, id) // 写消息ID
+	h.Property.BodyDayaLen = uint16(len(body))     // 消息的长度改为回复的body长度
+	h.Property.PacketFragmented = 0                // 不分包
 	if sum > 0 {
 		h.Property.PacketFragmented = 1 // 分包
 	}
-	binary.BigEndian.PutUint16(data[2:4], h.Property.encode()) // 写消息属性
+	data = binary.BigEndian.AppendUint16(data, h.Property.encode()) // 写消息属性
 	if h.ProtocolVersion == consts.JT808Protocol2019 {
 		// 2019版本的标识
 		data = append(data, 0x01)
@@ -213,10 +266,19 @@ func (h *Header) createPackage(body []byte, num, sum uint16) []byte {
 	} else {
 		data = binary.BigEndian.AppendUint16(data, h.PlatformSerialNumber) // 写流水号 平台回复的流水号
 	}
-	data = append(data, body...)         // 写消息体
-	code := utils.CreateVerifyCode(data) // 校验码
+	data = append(data, body...)                 // 写消息体
+	code := utils.CreateVerifyCode(data[begin:]) // 校验码
 	data = append(data, code)
-	return escape(data) // 转义
+	return escapeTail(data, begin) // 转义
+}
+
+// decode 手机号和上一次相同的情况 直接返回上一次的结果.
+func (c *phoneCache) decode(bcd []byte) string {
+	if c.n != len(bcd) || !bytes.Equal(c.bcd[:c.n], bcd) {
+		c.n = copy(c.bcd[:], bcd)
+		c.phone = utils.Bcd2Dec(bcd)
+	}
+	return c.phone
 }
 
 func (p *BodyProperty) decode(data []byte) {
@@ -226,9 +288,7 @@ func (p *BodyProperty) decode(data []byte) {
 	p.bit14 = byte((attribute >> 14) & 0b1) // 第14位 协议版本 0-2013 1-2019
 	p.Version = p.bit14
 	p.PacketFragmented = byte((attribute >> 13) & 0b1) // 第13位 分包
-	if p.PacketFragmented == 1 {
-		p.isSubPackage = true
-	}
+	p.isSubPackage = p.PacketFragmented == 1
 	p.EncryptMethod = uint8((attribute & 0x400) >> 10) // 第10-12位 加密方式 0-不加密 1-RSA
 	p.BodyDayaLen = attribute & 0x3FF                  // 最低10位 消息体长度 3=011 F=1111
 }
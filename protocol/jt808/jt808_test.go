@@ -303,3 +303,258 @@ func TestString(t *testing.T) {
 		})
 	}
 }
+
+func TestHeader_ApplyProtocolVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    string
+		version consts.ProtocolVersionType
+		ok      bool
+		want    consts.ProtocolVersionType
+	}{
+		{
+			name:    "2013版本指定为2011版本",
+			args:    "7e0002000001234567890100008a7e",
+			version: consts.JT808Protocol2011,
+			ok:      true,
+			want:    consts.JT808Protocol2011,
+		},
+		{
+			name:    "未指定的终端",
+			args:    "7e0002000001234567890100008a7e",
+			version: consts.JT808Protocol2011,
+			want:    consts.JT808Protocol2013,
+		},
+		{
+			name:    "不支持的版本",
+			args:    "7e0002000001234567890100008a7e",
+			version: consts.ProtocolVersionType(9),
+			ok:      true,
+			want:    consts.JT808Protocol2013,
+		},
+		{
+			name:    "2019版本不修改",
+			args:    "7e000240000100000000017299841738ffff027e",
+			version: consts.JT808Protocol2011,
+			ok:      true,
+			want:    consts.JT808Protocol2019,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.args)
+			jtMsg := NewJTMessage()
+			if err := jtMsg.Decode(data); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			jtMsg.Header.ApplyProtocolVersion(func(phone string) (consts.ProtocolVersionType, bool) {
+				if phone != jtMsg.Header.TerminalPhoneNo {
+					t.Errorf("phone = %s, want %s", phone, jtMsg.Header.TerminalPhoneNo)
+				}
+				return tt.version, tt.ok
+			})
+			if jtMsg.Header.ProtocolVersion != tt.want {
+				t.Errorf("ProtocolVersion = %s, want %s", jtMsg.Header.ProtocolVersion, tt.want)
+			}
+		})
+	}
+}
+
+func TestJTMessage_DecodeInto(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr error
+	}{
+		{
+			name: "不需要反转义的 不使用buf",
+			args: []string{"7e0002000001234567890100008a7e"},
+		},
+		{
+			name: "多个需要反转义的 追加到同一个buf",
+			args: []string{
+				"7e0200401c01000000000172998417380000000004000000080007203b7d0202633df7013800030063200707192359c17e",
+				"7E0801200500123456789002DE001A00022808000102537E",
+				"7e0200401c01000000000172998417380000000004000000080007203b7d0202633df7013800030063200707192359c17e",
+			},
+		},
+		{
+			name:    "错误的数据",
+			args:    []string{"7e02007d037e"},
+			wantErr: protocol.ErrUnqualifiedData,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				buf   []byte
+				jtMsg = NewJTMessage()
+				bodys [][]byte
+			)
+			for _, arg := range tt.args {
+				data, _ := hex.DecodeString(arg)
+				var err error
+				buf, err = jtMsg.DecodeInto(buf, data)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DecodeInto() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				want := NewJTMessage()
+				_ = want.Decode(data)
+				if !reflect.DeepEqual(jtMsg.Body, want.Body) || jtMsg.Header.String() != want.Header.String() ||
+					jtMsg.Header.SubPackageSum != want.Header.SubPackageSum {
+					t.Fatalf("DecodeInto() = %s\n want %s", jtMsg.Header, want.Header)
+				}
+				bodys = append(bodys, jtMsg.Body)
+			}
+			// 追加的情况 之前的body不会被覆盖
+			for i, arg := range tt.args {
+				data, _ := hex.DecodeString(arg)
+				want := NewJTMessage()
+				_ = want.Decode(data)
+				if !bytes.Equal(bodys[i], want.Body) {
+					t.Errorf("body[%d] = %x\n want %x", i, bodys[i], want.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestHeader_AppendEncode(t *testing.T) {
+	jtMsg := NewJTMessage()
+	data, _ := hex.DecodeString("7e0002400001000000000172998417380000027e")
+	_ = jtMsg.Decode(data)
+	for _, bodyLen := range []int{0, 100, 2500} {
+		body := bytes.Repeat([]byte{0x7e, 0x7d, 0x01}, bodyLen/3)
+		want := bytes.Join(jtMsg.Header.EncodePackets(body), nil)
+		prefix := []byte{0x01, 0x02}
+		got := jtMsg.Header.AppendEncode(prefix, body)
+		if !bytes.Equal(got[:2], prefix) || !bytes.Equal(got[2:], want) {
+			t.Errorf("AppendEncode(%d) = %x\n want %x", bodyLen, got, want)
+		}
+	}
+}
+
+func TestHeader_phoneNotAliasData(t *testing.T) {
+	jtMsg := NewJTMessage()
+	data, _ := hex.DecodeString("7e0002000001234567890100008a7e")
+	_ = jtMsg.Decode(data)
+	want := jtMsg.Header.EncodePackets(nil)[0]
+	// 读取缓冲区被下一次读取复用 平台回复的手机号不变
+	clear(data)
+	if got := jtMsg.Header.EncodePackets(nil)[0]; !bytes.Equal(got, want) {
+		t.Errorf("EncodePackets() = %x\n want %x", got, want)
+	}
+}
+
+func TestHeader_Clone(t *testing.T) {
+	jtMsg := NewJTMessage()
+	data, _ := hex.DecodeString("7e0002000001234567890100008a7e")
+	_ = jtMsg.Decode(data)
+	want := jtMsg.Header.EncodePackets(nil)[0]
+
+	c := jtMsg.Header.Clone()
+	c.PlatformSerialNumber = 10
+	c.ReplyID = 0x8001
+	c.Property.EncryptMethod = 1
+	if got := jtMsg.Header.EncodePackets(nil)[0]; !bytes.Equal(got, want) {
+		t.Errorf("EncodePackets() = %x\n want %x", got, want)
+	}
+	if c.TerminalPhoneNo != jtMsg.Header.TerminalPhoneNo || c.Property == jtMsg.Header.Property {
+		t.Errorf("Clone() = %s", c)
+	}
+}
+
+// TestDecodeInto_allocs 不分包的情况 复用 JTMessage 和 buf 不分配内存.
+func TestDecodeInto_allocs(t *testing.T) {
+	data, _ := hex.DecodeString("7e0200401c01000000000172998417380000000004000000080007203b7d0202633df7013800030063200707192359c17e")
+	jtMsg := NewJTMessage()
+	buf := make([]byte, 0, len(data))
+	dst := make([]byte, 0, 2*len(data))
+	if n := testing.AllocsPerRun(100, func() {
+		buf, _ = jtMsg.DecodeInto(buf[:0], data)
+		dst = jtMsg.Header.AppendEncode(dst[:0], jtMsg.Body)
+	}); n != 0 {
+		t.Errorf("AllocsPerRun() = %v, want 0", n)
+	}
+}
+
+func BenchmarkJTMessage_DecodeInto(b *testing.B) {
+	data, _ := hex.DecodeString("7e0200401c01000000000172998417380000000004000000080007203b7d0202633df7013800030063200707192359c17e")
+	jtMsg := AcquireJTMessage()
+	defer ReleaseJTMessage(jtMsg)
+	buf := make([]byte, 0, len(data))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = jtMsg.DecodeInto(buf[:0], data)
+	}
+}
+
+func BenchmarkJTMessage_Decode(b *testing.B) {
+	data, _ := hex.DecodeString("7e0200401c01000000000172998417380000000004000000080007203b7d0202633df7013800030063200707192359c17e")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = NewJTMessage().Decode(data)
+	}
+}
+
+func BenchmarkHeader_AppendEncode(b *testing.B) {
+	data, _ := hex.DecodeString("7e0200401c01000000000172998417380000000004000000080007203b7d0202633df7013800030063200707192359c17e")
+	jtMsg := NewJTMessage()
+	_ = jtMsg.Decode(data)
+	body := append([]byte(nil), jtMsg.Body...)
+	dst := make([]byte, 0, 2*len(data))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = jtMsg.Header.AppendEncode(dst[:0], body)
+	}
+}
+
+func TestHeader_MaxBodyLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxBodyLength int
+		want          []int
+	}{
+		{name: "默认1000", maxBodyLength: 0, want: []int{1000, 1000, 46}},
+		{name: "512", maxBodyLength: 512, want: []int{512, 512, 512, 510}},
+		{name: "最大1023", maxBodyLength: 1023, want: []int{1023, 1023}},
+		{name: "超过1023使用默认的", maxBodyLength: 2000, want: []int{1000, 1000, 46}},
+	}
+	data, _ := hex.DecodeString("7e0002400001000000000172998417380000027e")
+	body := bytes.Repeat([]byte{0x01, 0x7e}, 1023)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jtMsg := NewJTMessage()
+			_ = jtMsg.Decode(data)
+			jtMsg.Header.MaxBodyLength = tt.maxBodyLength
+			packets := jtMsg.Header.EncodePackets(body)
+			if len(packets) != len(tt.want) {
+				t.Fatalf("EncodePackets() = %d packets, want %d", len(packets), len(tt.want))
+			}
+			reconstructed := make([]byte, 0, len(body))
+			for i, packet := range packets {
+				msg := NewJTMessage()
+				if err := msg.Decode(packet); err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if len(msg.Body) != tt.want[i] || int(msg.Header.SubPackageSum) != len(tt.want) {
+					t.Errorf("packet[%d] body = %d sum = %d, want %d %d",
+						i, len(msg.Body), msg.Header.SubPackageSum, tt.want[i], len(tt.want))
+				}
+				reconstructed = append(reconstructed, msg.Body...)
+			}
+			if !bytes.Equal(reconstructed, body) {
+				t.Errorf("body = %x\n want %x", reconstructed, body)
+			}
+			if got := jtMsg.Header.AppendEncode(nil, body); !bytes.Equal(got, bytes.Join(packets, nil)) {
+				t.Errorf("AppendEncode() = %x\n want %x", got, bytes.Join(packets, nil))
+			}
+		})
+	}
+}
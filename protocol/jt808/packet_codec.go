@@ -3,72 +3,121 @@ package jt808
 import (
 	"bytes"
 	"github.com/cuteLittleDevil/go-jt808/protocol"
+	"slices"
 )
 
 func unescape(data []byte) ([]byte, error) {
+	escapeData, _, err := appendUnescape(nil, data)
+	return escapeData, err
+}
+
+// appendUnescape 反转义 没有需要反转义的情况直接返回 data 的视图.
+// 否则把反转义的结果追加到 dst 后面 返回追加后的 dst 可以继续复用.
+func appendUnescape(dst []byte, data []byte) (escapeData []byte, _ []byte, err error) {
 	const (
 		beforeEscape = 0x7d
 		afterRecover = 0x7e
 	)
 	if !(len(data) > 2 && data[0] == afterRecover && data[len(data)-1] == afterRecover) {
-		return nil, protocol.ErrUnqualifiedData
+		return nil, dst, newUnqualifiedError(data)
 	}
 	// 快速路径 没有需要转义的
-	if !bytes.ContainsRune(data, beforeEscape) {
-		return data[1 : len(data)-1], nil
+	if bytes.IndexByte(data, beforeEscape) == -1 {
+		return data[1 : len(data)-1], dst, nil
 	}
 
-	buf := new(bytes.Buffer)
+	if dst == nil {
+		dst = make([]byte, 0, len(data)-2)
+	}
+	start := len(dst)
 	index := 1
 	for i := 1; i < len(data)-1; i++ {
 		if v := data[i]; v == beforeEscape {
 			i++
 			switch data[i] {
 			case 0x01:
-				buf.Write(data[index : i-1])
-				buf.WriteByte(beforeEscape)
+				dst = append(dst, data[index:i-1]...)
+				dst = append(dst, beforeEscape)
 			case 0x02:
-				buf.Write(data[index : i-1])
-				buf.WriteByte(afterRecover)
+				dst = append(dst, data[index:i-1]...)
+				dst = append(dst, afterRecover)
 			default:
 				// 兼容一下设备校验码不转义的情况
 				if i == len(data)-1 {
-					buf.Write(data[index : len(data)-1])
-					return buf.Bytes(), nil
+					dst = append(dst, data[index:len(data)-1]...)
+					return dst[start:], dst, nil
+				}
+				return nil, dst[:start], &DecodeError{
+					Err:    protocol.ErrUnqualifiedData,
+					Offset: i,
+					Actual: int(data[i]),
 				}
-				return nil, protocol.ErrUnqualifiedData
 			}
 			index = i + 1
 		}
 	}
 	if index != len(data)-1 {
-		buf.Write(data[index : len(data)-1])
+		dst = append(dst, data[index:len(data)-1]...)
+	}
+	return dst[start:], dst, nil
+}
+
+// newUnqualifiedError 长度不够 或者首尾不是0x7e的情况.
+func newUnqualifiedError(data []byte) *DecodeError {
+	const sign = 0x7e
+	err := &DecodeError{
+		Err:      protocol.ErrUnqualifiedData,
+		Expected: sign,
 	}
-	return buf.Bytes(), nil
+	switch {
+	case len(data) <= 2:
+		err.Offset = len(data)
+		err.Expected = 3
+		err.Actual = len(data)
+	case data[0] != sign:
+		err.Actual = int(data[0])
+	default:
+		err.Offset = len(data) - 1
+		err.Actual = int(data[len(data)-1])
+	}
+	return err
 }
 
 func escape(data []byte) []byte {
+	dst := make([]byte, 0, len(data)+4)
+	return escapeTail(append(dst, data...), 0)
+}
+
+// escapeTail 原地转义 dst[start:] 并加上首尾的 0x7e.
+// 先统计需要转义的数量 扩容后从后往前写 不需要额外的内存.
+func escapeTail(dst []byte, start int) []byte {
 	const (
 		flag0x7d = 0x7d // 转义标志 0x7d -> 0x7d 0x01
 		flag0x7e = 0x7e // 转义标志 0x7e -> 0x7d 0x02
 	)
-	buf := new(bytes.Buffer)
-	buf.WriteByte(flag0x7e)
-	index := 0
-	for i := 0; i < len(data); i++ {
-		switch data[i] {
+	n := len(dst) - start
+	count := 0
+	for _, v := range dst[start:] {
+		if v == flag0x7d || v == flag0x7e {
+			count++
+		}
+	}
+	dst = slices.Grow(dst, count+2)[:len(dst)+count+2]
+	w := len(dst) - 1
+	dst[w] = flag0x7e
+	for r := start + n - 1; r >= start; r-- {
+		switch v := dst[r]; v {
 		case flag0x7e:
-			buf.Write(data[index:i])
-			buf.Write([]byte{0x7d, 0x02})
-			index = i + 1
+			dst[w-1], dst[w-2] = 0x02, 0x7d
+			w -= 2
 		case flag0x7d:
-			buf.Write(data[index:i])
-			buf.Write([]byte{0x7d, 0x01})
-			index = i + 1
+			dst[w-1], dst[w-2] = 0x01, 0x7d
+			w -= 2
 		default:
+			dst[w-1] = v
+			w--
 		}
 	}
-	buf.Write(data[index:])
-	buf.WriteByte(flag0x7e)
-	return buf.Bytes()
+	dst[start] = flag0x7e
+	return dst
 }
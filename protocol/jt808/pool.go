@@ -0,0 +1,41 @@
+package jt808
+
+import "sync"
+
+var jtMessagePool = sync.Pool{
+	New: func() any {
+		return NewJTMessage()
+	},
+}
+
+// AcquireJTMessage 从池中获取一个 JTMessage, 用完后调用 ReleaseJTMessage 放回.
+//
+// 使用示例：
+//
+//	jtMsg := jt808.AcquireJTMessage()
+//	defer jt808.ReleaseJTMessage(jtMsg)
+//	buf, err = jtMsg.DecodeInto(buf[:0], frame)
+func AcquireJTMessage() *JTMessage {
+	return jtMessagePool.Get().(*JTMessage)
+}
+
+// ReleaseJTMessage 把 JTMessage 放回池中, 之后不能再使用 j 和它的 Header Body.
+func ReleaseJTMessage(j *JTMessage) {
+	if j == nil || j.Header == nil || j.Header.Property == nil {
+		return
+	}
+	j.Reset()
+	jtMessagePool.Put(j)
+}
+
+// Reset 清空消息内容 保留已经分配的 Header 和 BodyProperty.
+func (j *JTMessage) Reset() {
+	property := j.Header.Property
+	*property = BodyProperty{}
+	*j.Header = Header{
+		Property:   property,
+		phoneCache: j.Header.phoneCache,
+	}
+	j.VerifyCode = 0
+	j.Body = nil
+}
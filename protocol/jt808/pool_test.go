@@ -0,0 +1,31 @@
+package jt808
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestAcquireJTMessage(t *testing.T) {
+	subData, _ := hex.DecodeString("7E0801200500123456789002DE001A00022808000102537E")
+	data, _ := hex.DecodeString("7e0002000001234567890100008a7e")
+
+	jtMsg := AcquireJTMessage()
+	if err := jtMsg.Decode(subData); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	jtMsg.Header.ReplyID = 0x8001
+	ReleaseJTMessage(jtMsg)
+	ReleaseJTMessage(nil)
+
+	jtMsg = AcquireJTMessage()
+	defer ReleaseJTMessage(jtMsg)
+	if jtMsg.Header.ReplyID != 0 || jtMsg.Header.SubPackageSum != 0 || jtMsg.Body != nil {
+		t.Fatalf("Reset() header = %+v body = %x", jtMsg.Header, jtMsg.Body)
+	}
+	if err := jtMsg.Decode(data); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if jtMsg.Header.TerminalPhoneNo != "12345678901" || jtMsg.Header.Property.isSubPackage {
+		t.Errorf("Decode() header = %s", jtMsg.Header)
+	}
+}
@@ -0,0 +1,106 @@
+package jt808
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/cuteLittleDevil/go-jt808/protocol"
+)
+
+const (
+	// EncryptMethodRSA 消息体属性中的加密方式 第10位为1表示RSA加密.
+	EncryptMethodRSA = 1
+	// RSAKeyBits JT808 使用1024位的RSA 公钥{e,n}中的n为128个字节.
+	RSAKeyBits = 1024
+)
+
+// CheckRSAPublicKey 校验RSA公钥 n需要是1024位 e为大于1的奇数, 不合法的返回 protocol.ErrRSAPublicKey.
+func CheckRSAPublicKey(pub *rsa.PublicKey) error {
+	switch {
+	case pub == nil || pub.N == nil:
+		return errors.Join(protocol.ErrRSAPublicKey, errors.New("public key is nil"))
+	case pub.N.BitLen() != RSAKeyBits:
+		return errors.Join(protocol.ErrRSAPublicKey,
+			fmt.Errorf("n bits [%d] want [%d]", pub.N.BitLen(), RSAKeyBits))
+	case pub.E < 3 || pub.E&1 == 0 || pub.E > 1<<31-1:
+		return errors.Join(protocol.ErrRSAPublicKey, fmt.Errorf("e [%d]", pub.E))
+	}
+	return nil
+}
+
+// EncryptBody 使用对方的RSA公钥加密消息体 公钥需要通过 CheckRSAPublicKey 的校验.
+// 按照公钥长度分块(PKCS#1 v1.5 每块最多 公钥长度-11 字节) 每块加密后为公钥长度 依次拼接.
+func EncryptBody(pub *rsa.PublicKey, body []byte) ([]byte, error) {
+	if err := CheckRSAPublicKey(pub); err != nil {
+		return nil, err
+	}
+	chunk := pub.Size() - 11
+	data := make([]byte, 0, (len(body)/chunk+1)*pub.Size())
+	for start := 0; start < len(body); start += chunk {
+		end := min(start+chunk, len(body))
+		block, err := rsa.EncryptPKCS1v15(rand.Reader, pub, body[start:end])
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, block...)
+	}
+	return data, nil
+}
+
+// DecryptBody 使用自己的RSA私钥解密消息体 消息体长度需要是公钥长度的整数倍.
+func DecryptBody(priv *rsa.PrivateKey, body []byte) ([]byte, error) {
+	size := priv.Size()
+	if len(body)%size != 0 {
+		return nil, errors.Join(protocol.ErrDecryptFail, protocol.ErrBodyLengthInconsistency)
+	}
+	data := make([]byte, 0, len(body))
+	for start := 0; start < len(body); start += size {
+		block, err := rsa.DecryptPKCS1v15(nil, priv, body[start:start+size])
+		if err != nil {
+			return nil, errors.Join(protocol.ErrDecryptFail, err)
+		}
+		data = append(data, block...)
+	}
+	return data, nil
+}
+
+// Decrypt 消息体是RSA加密的情况 使用私钥解密 并清除加密标识, 未加密的情况不处理.
+// 解密后 Header.Property.BodyDayaLen 仍然是加密后的长度.
+func (j *JTMessage) Decrypt(priv *rsa.PrivateKey) error {
+	switch j.Header.Property.EncryptMethod {
+	case 0:
+		return nil
+	case EncryptMethodRSA:
+	default:
+		return protocol.ErrEncryptMethodUnsupported
+	}
+	if priv == nil {
+		return errors.Join(protocol.ErrDecryptFail, errors.New("rsa private key is nil"))
+	}
+	body, err := DecryptBody(priv, j.Body)
+	if err != nil {
+		return err
+	}
+	j.Body = body
+	j.Header.Property.EncryptMethod = 0
+	return nil
+}
+
+// EncodeEncryptedPackets 使用对方的RSA公钥加密消息体后编码 返回分包的结果.
+// pub 为nil的情况不加密 和 EncodePackets 相同.
+func (h *Header) EncodeEncryptedPackets(pub *rsa.PublicKey, body []byte) ([][]byte, error) {
+	if pub == nil {
+		return h.EncodePackets(body), nil
+	}
+	data, err := EncryptBody(pub, body)
+	if err != nil {
+		return nil, err
+	}
+	method := h.Property.EncryptMethod
+	h.Property.EncryptMethod = EncryptMethodRSA
+	defer func() {
+		h.Property.EncryptMethod = method
+	}()
+	return h.EncodePackets(data), nil
+}
@@ -0,0 +1,119 @@
+package jt808
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"github.com/cuteLittleDevil/go-jt808/protocol"
+	"math/big"
+	"testing"
+)
+
+func TestEncryptBody(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	for _, size := range []int{0, 1, 117, 118, 1000} {
+		body := bytes.Repeat([]byte{0x7e}, size)
+		data, err := EncryptBody(&priv.PublicKey, body)
+		if err != nil {
+			t.Fatalf("EncryptBody() error = %v", err)
+		}
+		if want := (size + 116) / 117 * 128; len(data) != want {
+			t.Errorf("EncryptBody() len = %d, want %d", len(data), want)
+		}
+		got, err := DecryptBody(priv, data)
+		if err != nil {
+			t.Fatalf("DecryptBody() error = %v", err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("DecryptBody() got = %x, want %x", got, body)
+		}
+	}
+	if _, err := DecryptBody(priv, []byte{0x01}); !errors.Is(err, protocol.ErrDecryptFail) {
+		t.Errorf("DecryptBody() err = %v, want %v", err, protocol.ErrDecryptFail)
+	}
+	if _, err := DecryptBody(priv, make([]byte, 128)); !errors.Is(err, protocol.ErrDecryptFail) {
+		t.Errorf("DecryptBody() err = %v, want %v", err, protocol.ErrDecryptFail)
+	}
+}
+
+func TestJTMessage_Decrypt(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	header := &Header{
+		ID:                 0x0200,
+		Property:           &BodyProperty{},
+		bcdTerminalPhoneNo: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0x01},
+	}
+	body := []byte{0x7e, 0x7d, 0x01, 0x02, 0x03}
+	packets, err := header.EncodeEncryptedPackets(&priv.PublicKey, body)
+	if err != nil {
+		t.Fatalf("EncodeEncryptedPackets() error = %v", err)
+	}
+	if len(packets) != 1 || header.Property.EncryptMethod != 0 {
+		t.Fatalf("EncodeEncryptedPackets() packets = %d, EncryptMethod = %d", len(packets), header.Property.EncryptMethod)
+	}
+
+	jtMsg := NewJTMessage()
+	if err := jtMsg.Decode(packets[0]); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if jtMsg.Header.Property.EncryptMethod != EncryptMethodRSA {
+		t.Fatalf("EncryptMethod = %d, want %d", jtMsg.Header.Property.EncryptMethod, EncryptMethodRSA)
+	}
+	if err := jtMsg.Decrypt(nil); !errors.Is(err, protocol.ErrDecryptFail) {
+		t.Fatalf("Decrypt(nil) err = %v, want %v", err, protocol.ErrDecryptFail)
+	}
+	if err := jtMsg.Decrypt(priv); err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if !bytes.Equal(jtMsg.Body, body) || jtMsg.Header.Property.EncryptMethod != 0 {
+		t.Fatalf("Decrypt() body = %x EncryptMethod = %d", jtMsg.Body, jtMsg.Header.Property.EncryptMethod)
+	}
+	// 未加密的情况不处理
+	if err := jtMsg.Decrypt(priv); err != nil || !bytes.Equal(jtMsg.Body, body) {
+		t.Fatalf("Decrypt() error = %v body = %x", err, jtMsg.Body)
+	}
+
+	// 没有公钥的情况不加密
+	plain, err := header.EncodeEncryptedPackets(nil, body)
+	if err != nil || !bytes.Equal(plain[0], header.EncodePackets(body)[0]) {
+		t.Fatalf("EncodeEncryptedPackets(nil) = %x, err = %v", plain, err)
+	}
+}
+
+func TestEncryptBody_invalidKey(t *testing.T) {
+	modulus := func(size int) *big.Int {
+		n := make([]byte, size)
+		n[0], n[size-1] = 0x80, 0x01
+		return new(big.Int).SetBytes(n)
+	}
+	big2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		pub  *rsa.PublicKey
+	}{
+		{name: "nil", pub: nil},
+		{name: "n为nil", pub: &rsa.PublicKey{E: 65537}},
+		{name: "n 10字节", pub: &rsa.PublicKey{N: modulus(10), E: 65537}},
+		{name: "n 11字节", pub: &rsa.PublicKey{N: modulus(11), E: 65537}},
+		{name: "2048位", pub: &big2048.PublicKey},
+		{name: "e 为偶数", pub: &rsa.PublicKey{N: modulus(128), E: 4}},
+		{name: "e 为1", pub: &rsa.PublicKey{N: modulus(128), E: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := EncryptBody(tt.pub, []byte{0x01}); !errors.Is(err, protocol.ErrRSAPublicKey) {
+				t.Errorf("EncryptBody() err = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package jt808
+
+import "github.com/cuteLittleDevil/go-jt808/shared/consts"
+
+// ProtocolVersionFunc 根据终端手机号返回协议版本, ok为false时使用报文解析的版本.
+// 2011和2013版本的固定头相同 无法从报文中区分, 已知是2011版本的终端需要单独配置.
+type ProtocolVersionFunc func(terminalPhoneNo string) (version consts.ProtocolVersionType, ok bool)
+
+// ApplyProtocolVersion 固定头不是2019版本的情况 使用 f 返回的版本(2011或2013).
+// 2019版本的固定头格式不同 不会被修改.
+//
+// 使用示例：
+//
+//	jtMsg := jt808.NewJTMessage()
+//	_ = jtMsg.Decode(data)
+//	jtMsg.Header.ApplyProtocolVersion(func(phone string) (consts.ProtocolVersionType, bool) {
+//		_, ok := old2011Terminals[phone]
+//		return consts.JT808Protocol2011, ok
+//	})
+func (h *Header) ApplyProtocolVersion(f ProtocolVersionFunc) {
+	if f == nil || h.ProtocolVersion == consts.JT808Protocol2019 {
+		return
+	}
+	version, ok := f(h.TerminalPhoneNo)
+	if !ok {
+		return
+	}
+	switch version {
+	case consts.JT808Protocol2011, consts.JT808Protocol2013:
+		h.ProtocolVersion = version
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+	"strings"
+)
+
+type P0x8A00 struct {
+	BaseHandle
+	// E 平台RSA公钥{e,n}中的e
+	E uint32 `json:"e"`
+	// N 平台RSA公钥{e,n}中的n 128个字节
+	N []byte `json:"n"`
+}
+
+// NewP0x8A00 根据平台的RSA公钥创建 公钥长度需要是1024位.
+func NewP0x8A00(pub *rsa.PublicKey) (*P0x8A00, error) {
+	e, n, err := fromRSAPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &P0x8A00{E: e, N: n}, nil
+}
+
+func (p *P0x8A00) Protocol() consts.JT808CommandType {
+	return consts.P8A00PlatformRSAPublicKey
+}
+
+func (p *P0x8A00) ReplyProtocol() consts.JT808CommandType {
+	return consts.T0001GeneralRespond
+}
+
+func (p *P0x8A00) Parse(jtMsg *jt808.JTMessage) error {
+	e, n, err := parseRSAPublicKey(jtMsg.Body)
+	if err != nil {
+		return err
+	}
+	p.E, p.N = e, n
+	return nil
+}
+
+func (p *P0x8A00) Encode() []byte {
+	return encodeRSAPublicKey(p.E, p.N)
+}
+
+// PublicKey 返回平台的RSA公钥 终端上传的消息体使用该公钥加密, 不合法的返回 protocol.ErrRSAPublicKey.
+func (p *P0x8A00) PublicKey() (*rsa.PublicKey, error) {
+	return toRSAPublicKey(p.E, p.N)
+}
+
+func (p *P0x8A00) HasReply() bool {
+	return false
+}
+
+func (p *P0x8A00) String() string {
+	return strings.Join([]string{
+		"数据体对象:{",
+		fmt.Sprintf("\t%s:[%x]", p.Protocol(), p.Encode()),
+		fmt.Sprintf("\t[%08x] 平台RSA公钥e:[%d]", p.E, p.E),
+		fmt.Sprintf("\t[%x] 平台RSA公钥n", p.N),
+		"}",
+	}, "\n")
+}
@@ -1,6 +1,8 @@
 package model
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 	"math"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -21,7 +24,8 @@ func TestParse(t *testing.T) {
 	type args struct {
 		msg string
 		Handler
-		bodyLens []int // 用于覆盖率100测试 强制替换了解析正确的body
+		bodyLens []int                      // 用于覆盖率100测试 强制替换了解析正确的body
+		version  consts.ProtocolVersionType // 指定的协议版本 2011版本的固定头和2013版本相同
 	}
 	tests := []struct {
 		name   string
@@ -89,6 +93,18 @@ func TestParse(t *testing.T) {
 				Version:         consts.JT808Protocol2013,
 			},
 		},
+		{
+			name: "T0x0102 注册-鉴权 2011版本",
+			args: args{
+				msg:     "7e0102000b01234567890100003137323939383431373338b57e",
+				Handler: &T0x0102{},
+				version: consts.JT808Protocol2011,
+			},
+			fields: &T0x0102{
+				AuthCode: "17299841738",
+				Version:  consts.JT808Protocol2011,
+			},
+		},
 		{
 			name: "T0x0102 注册-鉴权 2019版本",
 			args: args{
@@ -122,6 +138,63 @@ func TestParse(t *testing.T) {
 				Version:            consts.JT808Protocol2011,
 			},
 		},
+		{
+			name: "T0x0100 终端注册 2011版本 车辆VIN",
+			args: args{
+				msg:      "7e0100002a0123456789010000001f007363640000007777772e3830382e37363534333231004c53564155323138304e32313833323934907e",
+				Handler:  &T0x0100{},
+				bodyLens: []int{24},
+			},
+			fields: &T0x0100{
+				ProvinceID:         31,
+				CityID:             115,
+				ManufacturerID:     "cd",
+				TerminalModel:      "www.808.",
+				TerminalID:         "7654321",
+				PlateColor:         0,
+				LicensePlateNumber: "LSVAU2180N2183294",
+				Version:            consts.JT808Protocol2011,
+			},
+		},
+		{
+			name: "T0x0100 终端注册 指定2011版本",
+			args: args{
+				msg:      "7e010000200123456789010000001f007363640000007777772e3830382e3736353433323101b2e24131323334a17e",
+				Handler:  &T0x0100{},
+				bodyLens: []int{24},
+				version:  consts.JT808Protocol2011,
+			},
+			fields: &T0x0100{
+				ProvinceID:         31,
+				CityID:             115,
+				ManufacturerID:     "cd",
+				TerminalModel:      "www.808.",
+				TerminalID:         "7654321",
+				PlateColor:         1,
+				LicensePlateNumber: "测A1234",
+				Version:            consts.JT808Protocol2011,
+			},
+		},
+		{
+			// 车牌后补0x00 超过36个字节并且第36个字节是合法的车牌颜色 默认会判断为2013版本 需要指定版本
+			name: "T0x0100 终端注册 指定2011版本 车牌补0x00",
+			args: args{
+				msg:      "7e0100002c0123456789010000001f007363640000007777772e3830382e3736353433323101b2e24131323334000000000000000000000000ad7e",
+				Handler:  &T0x0100{},
+				bodyLens: []int{24},
+				version:  consts.JT808Protocol2011,
+			},
+			fields: &T0x0100{
+				ProvinceID:         31,
+				CityID:             115,
+				ManufacturerID:     "cd",
+				TerminalModel:      "www.808.",
+				TerminalID:         "7654321",
+				PlateColor:         1,
+				LicensePlateNumber: "测A1234" + strings.Repeat("\x00", 12),
+				Version:            consts.JT808Protocol2011,
+			},
+		},
 		{
 			name: "T0x0100 终端注册 2013版本",
 			args: args{
@@ -140,6 +213,24 @@ func TestParse(t *testing.T) {
 				Version:            consts.JT808Protocol2013,
 			},
 		},
+		{
+			name: "T0x0100 终端注册 2013版本 终端ID包含非字母数字",
+			args: args{
+				msg:      "7e0100002c0123456789010000001f007363640000007777772e3830380000000000000000000000000037362d3534333201b2e241313233349f7e",
+				Handler:  &T0x0100{},
+				bodyLens: []int{36},
+			},
+			fields: &T0x0100{
+				ProvinceID:         31,
+				CityID:             115,
+				ManufacturerID:     "cd",
+				TerminalModel:      "www.808",
+				TerminalID:         "76-5432",
+				PlateColor:         1,
+				LicensePlateNumber: "测A1234",
+				Version:            consts.JT808Protocol2013,
+			},
+		},
 		{
 			name: "T0x0100 终端注册 2019版本",
 			args: args{
@@ -183,7 +274,7 @@ func TestParse(t *testing.T) {
 			args: args{
 				msg:      "7e0704003f0123456789010000000200001c000004000000080007203b7d0202633df7013800030063241001235959001c000004000000080007203b7d0202633df7013800030063241001235959b67e",
 				Handler:  &T0x0704{},
-				bodyLens: []int{30, 60, 68},
+				bodyLens: []int{30, 60, 63},
 			},
 			fields: &T0x0704{
 				Num:          2,
@@ -858,6 +949,22 @@ func TestParse(t *testing.T) {
 				MultimediaPackage: []byte{13, 123, 13, 123, 123},
 			},
 		},
+		{
+			name: "T0x0801 终端-多媒体数据上传 2011版本",
+			args: args{
+				msg:      "7e0801000b0123456789017fff0000007b00000102010203727e",
+				Handler:  &T0x0801{},
+				bodyLens: []int{1},
+				version:  consts.JT808Protocol2011,
+			},
+			fields: &T0x0801{
+				MultimediaID:      123,
+				ChannelID:         2,
+				EventItemEncode:   1,
+				MultimediaPackage: []byte{1, 2, 3},
+				Version:           consts.JT808Protocol2011,
+			},
+		},
 		{
 			name: "P0x8800 平台-多媒体上传应答",
 			args: args{
@@ -1178,6 +1285,30 @@ func TestParse(t *testing.T) {
 				TrackValidity: 600,
 			},
 		},
+		{
+			name: "T0x0A00 终端-RSA公钥",
+			args: args{
+				msg:      "7e0a000084012345678901000000010001808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebfc0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedfe0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff067e",
+				Handler:  &T0x0A00{},
+				bodyLens: []int{4},
+			},
+			fields: &T0x0A00{
+				E: 65537,
+				N: testRSAModulus(),
+			},
+		},
+		{
+			name: "P0x8A00 平台-RSA公钥",
+			args: args{
+				msg:      "7e8a000084012345678901000000010001808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebfc0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedfe0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff867e",
+				Handler:  &P0x8A00{},
+				bodyLens: []int{4},
+			},
+			fields: &P0x8A00{
+				E: 65537,
+				N: testRSAModulus(),
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1187,6 +1318,9 @@ func TestParse(t *testing.T) {
 				t.Errorf("Decode() error = %v", err)
 				return
 			}
+			jtMsg.Header.ApplyProtocolVersion(func(_ string) (consts.ProtocolVersionType, bool) {
+				return tt.args.version, tt.args.version != 0
+			})
 			if err := tt.args.Parse(jtMsg); err != nil {
 				t.Errorf("Parse() error = %v", err)
 				return
@@ -1217,6 +1351,15 @@ func TestParse(t *testing.T) {
 	}
 }
 
+// testRSAModulus 测试使用的RSA公钥n 0x80-0xff.
+func testRSAModulus() []byte {
+	n := make([]byte, 128)
+	for i := range n {
+		n[i] = byte(0x80 + i)
+	}
+	return n
+}
+
 // 为了覆盖率100%增加的测试 ------------------------------------
 func TestT0x0704Parse(t *testing.T) {
 	msg := "7e070400610123456789017fff000301001c000004000000080006eeb6ad02633df7013800030063200707192359001c000004000000080006eeb6ad02633df70138000300632007071923590020000004000000080006eeb6ad02633df701380003006320070719235902010012177e"
@@ -1358,3 +1501,87 @@ func TestP9208AlarmSignEncode(t *testing.T) {
 		return
 	}
 }
+
+func TestRSAPublicKey(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	t0x0a00, err := NewT0x0A00(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("NewT0x0A00() error = %v", err)
+	}
+	if got, err := t0x0a00.PublicKey(); err != nil || !got.Equal(&priv.PublicKey) {
+		t.Errorf("T0x0A00 PublicKey() got = %v err = %v", got, err)
+	}
+	p0x8a00, err := NewP0x8A00(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("NewP0x8A00() error = %v", err)
+	}
+	if got, err := p0x8a00.PublicKey(); err != nil || !got.Equal(&priv.PublicKey) {
+		t.Errorf("P0x8A00 PublicKey() got = %v err = %v", got, err)
+	}
+	if len(p0x8a00.Encode()) != 132 {
+		t.Errorf("P0x8A00 Encode() len = %d, want 132", len(p0x8a00.Encode()))
+	}
+	// n不足128字节的情况 前补0
+	short := &T0x0A00{E: 3, N: []byte{0x01, 0x02}}
+	if data := short.Encode(); len(data) != 132 || data[130] != 0x01 || data[131] != 0x02 {
+		t.Errorf("T0x0A00 Encode() got = %x", data)
+	}
+	if _, err := short.PublicKey(); !errors.Is(err, protocol.ErrRSAPublicKey) {
+		t.Errorf("short PublicKey() err = %v", err)
+	}
+}
+
+func TestRSAPublicKey_invalid(t *testing.T) {
+	big2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	if _, err := NewT0x0A00(&big2048.PublicKey); !errors.Is(err, protocol.ErrRSAPublicKey) {
+		t.Errorf("NewT0x0A00(2048) err = %v", err)
+	}
+	if _, err := NewP0x8A00(&big2048.PublicKey); !errors.Is(err, protocol.ErrRSAPublicKey) {
+		t.Errorf("NewP0x8A00(2048) err = %v", err)
+	}
+	if _, err := NewT0x0A00(nil); !errors.Is(err, protocol.ErrRSAPublicKey) {
+		t.Errorf("NewT0x0A00(nil) err = %v", err)
+	}
+
+	modulus := func(size int) []byte {
+		n := make([]byte, 128)
+		n[128-size] = 0x80
+		n[127] |= 0x01
+		return n
+	}
+	tests := []struct {
+		name string
+		e    uint32
+		n    []byte
+	}{
+		{name: "n 10字节", e: 65537, n: modulus(10)},
+		{name: "n 11字节", e: 65537, n: modulus(11)},
+		{name: "n 全0", e: 65537, n: make([]byte, 128)},
+		{name: "e 为1", e: 1, n: modulus(128)},
+		{name: "e 为偶数", e: 65536, n: modulus(128)},
+		{name: "e 超过int32", e: 1 << 31, n: modulus(128)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := (&T0x0A00{E: tt.e, N: tt.n}).Encode()
+			jtMsg := &jt808.JTMessage{Header: &jt808.Header{ID: uint16(consts.T0A00TerminalRSAPublicKey)}, Body: body}
+			if err := (&T0x0A00{}).Parse(jtMsg); !errors.Is(err, protocol.ErrRSAPublicKey) {
+				t.Errorf("T0x0A00 Parse() err = %v", err)
+			}
+			if err := (&P0x8A00{}).Parse(jtMsg); !errors.Is(err, protocol.ErrRSAPublicKey) {
+				t.Errorf("P0x8A00 Parse() err = %v", err)
+			}
+		})
+	}
+	// 合法的公钥
+	body := (&T0x0A00{E: 65537, N: modulus(128)}).Encode()
+	if err := (&T0x0A00{}).Parse(&jt808.JTMessage{Header: &jt808.Header{}, Body: body}); err != nil {
+		t.Errorf("T0x0A00 Parse() err = %v", err)
+	}
+}
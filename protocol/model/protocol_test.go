@@ -226,6 +226,18 @@ func TestReplyProtocol(t *testing.T) {
 			wantProtocol:      consts.P9212FileUploadCompleteRespond,
 			wantReplyProtocol: consts.T0001GeneralRespond,
 		},
+		{
+			name:              "T0x0A00 终端-RSA公钥",
+			args:              &T0x0A00{},
+			wantProtocol:      consts.T0A00TerminalRSAPublicKey,
+			wantReplyProtocol: consts.P8001GeneralRespond,
+		},
+		{
+			name:              "P0x8A00 平台-RSA公钥",
+			args:              &P0x8A00{},
+			wantProtocol:      consts.P8A00PlatformRSAPublicKey,
+			wantReplyProtocol: consts.T0001GeneralRespond,
+		},
 		{
 			name:              "P0x8300 平台-平台-文本信息下发",
 			args:              &P0x8300{},
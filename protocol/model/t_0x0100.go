@@ -24,6 +24,7 @@ type T0x0100 struct {
 	// 政区划代码六位中后四位。
 	CityID uint16 `json:"cityId"`
 	// ManufacturerID 制造商 ID
+	// 2011版本 5 个字节，终端制造商编码
 	// 2013版本 5 个字节，终端制造商编码
 	// 2019版本 11 个字节，终端制造商编码
 	ManufacturerID string `json:"manufacturerId"`
@@ -33,6 +34,7 @@ type T0x0100 struct {
 	// 2019版本   30 个字节，此终端型号由制造商自行定义，位数不足时，后补“0X00”。
 	TerminalModel string `json:"terminalModel"`
 	// TerminalID 终端 ID
+	// 2011版本  7个字节，由大写字母和数字组成，此终端 ID 由制造商自行定义，位数不足时，后补“0X00”。
 	// 2013版本  7个字节，由大写字母和数字组成，此终端 ID 由制造商自行定义，位数不足时，后补“0X00”。
 	// 2019版本  30个字节，由大写字母和数字组成，此终端 ID 由制造商自行定义，位数不足时，后补“0X00”。
 	TerminalID string `json:"terminalID"`
@@ -58,33 +60,10 @@ func (t *T0x0100) ReplyProtocol() consts.JT808CommandType {
 }
 
 func (t *T0x0100) Parse(jtMsg *jt808.JTMessage) error {
-	var ( // 默认按照2011版本
-		mLen   = 5
-		tLen   = 8
-		tIDLen = 7
-	)
 	body := jtMsg.Body
-	switch jtMsg.Header.ProtocolVersion {
-	case consts.JT808Protocol2019:
-		mLen = 11
-		tLen = 30
-		tIDLen = 30
-		t.Version = consts.JT808Protocol2019
-	case consts.JT808Protocol2013, consts.JT808Protocol2011:
-		// 根据body长度判断是不是2011版本的 2013版本的车牌颜色是36
-		if len(body) > 36 {
-			t.Version = consts.JT808Protocol2013
-			mLen = 5
-			tLen = 20
-			tIDLen = 7
-		} else {
-			t.Version = consts.JT808Protocol2011
-		}
-	}
-
-	if t.Version == consts.JT808Protocol2011 && len(body) < 25 {
-		return protocol.ErrBodyLengthInconsistency
-	} else if t.Version == consts.JT808Protocol2019 && len(body) < 76 {
+	t.Version = DetectProtocolVersion(jtMsg)
+	mLen, tLen, tIDLen := t.protocolDiff()
+	if len(body) < 4+mLen+tLen+tIDLen+1 {
 		return protocol.ErrBodyLengthInconsistency
 	}
 
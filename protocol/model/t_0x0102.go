@@ -29,11 +29,7 @@ func (t *T0x0102) Protocol() consts.JT808CommandType {
 }
 
 func (t *T0x0102) Parse(jtMsg *jt808.JTMessage) error {
-	version := consts.JT808Protocol2013
-	if jtMsg.Header.ProtocolVersion == consts.JT808Protocol2019 {
-		version = consts.JT808Protocol2019
-	}
-	t.Version = version
+	t.Version = DetectProtocolVersion(jtMsg) // 2011和2013版本的格式相同
 
 	body := jtMsg.Body
 	if t.Version == consts.JT808Protocol2019 {
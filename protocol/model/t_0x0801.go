@@ -20,10 +20,13 @@ type T0x0801 struct {
 	// EventItemEncode 事件项编码 0-平台下发指令 1-定时动作 2-抢劫报警触发 3-碰撞侧翻报警触发 4-门开拍照 5-门关拍照
 	EventItemEncode byte `json:"eventItemEncode"`
 	// ChannelID 通道ID
-	ChannelID           byte `json:"channelID"`
+	ChannelID byte `json:"channelID"`
+	// T0x0200LocationItem 位置信息汇报 2011版本没有
 	T0x0200LocationItem `json:"t0X0200LocationItem"`
 	// MultimediaPackage 多媒体包
 	MultimediaPackage []byte `json:"multimediaPackage"`
+	// Version 版本 1-2011 2-2013 3-2019
+	Version consts.ProtocolVersionType `json:"version"`
 }
 
 func (t *T0x0801) Protocol() consts.JT808CommandType {
@@ -36,7 +39,12 @@ func (t *T0x0801) ReplyProtocol() consts.JT808CommandType {
 
 func (t *T0x0801) Parse(jtMsg *jt808.JTMessage) error {
 	body := jtMsg.Body
-	if len(body) < 36 {
+	t.Version = DetectProtocolVersion(jtMsg)
+	if t.Version == consts.JT808Protocol2011 {
+		if len(body) < 8 {
+			return protocol.ErrBodyLengthInconsistency
+		}
+	} else if len(body) < 36 {
 		return protocol.ErrBodyLengthInconsistency
 	}
 	t.MultimediaID = binary.BigEndian.Uint32(body[0:4])
@@ -44,6 +52,10 @@ func (t *T0x0801) Parse(jtMsg *jt808.JTMessage) error {
 	t.MultimediaFormatEncode = body[5]
 	t.EventItemEncode = body[6]
 	t.ChannelID = body[7]
+	if t.Version == consts.JT808Protocol2011 {
+		t.MultimediaPackage = body[8:]
+		return nil
+	}
 	_ = t.T0x0200LocationItem.parse(body[8:36])
 	t.MultimediaPackage = body[36:]
 	return nil
@@ -56,7 +68,9 @@ func (t *T0x0801) Encode() []byte {
 	data[5] = t.MultimediaFormatEncode
 	data[6] = t.EventItemEncode
 	data[7] = t.ChannelID
-	data = append(data, t.T0x0200LocationItem.encode()...)
+	if t.Version != consts.JT808Protocol2011 {
+		data = append(data, t.T0x0200LocationItem.encode()...)
+	}
 	data = append(data, t.MultimediaPackage...)
 	return data
 }
@@ -70,15 +84,21 @@ func (t *T0x0801) ReplyBody(jtMsg *jt808.JTMessage) ([]byte, error) {
 }
 
 func (t *T0x0801) String() string {
+	data, location := t.Encode(), t.T0x0200LocationItem.String()
+	if t.Version == consts.JT808Protocol2011 {
+		data, location = data[:8], "\t2011版本没有位置信息"
+	} else {
+		data = data[:26]
+	}
 	return strings.Join([]string{
 		"数据体对象:{",
-		fmt.Sprintf("\t%s:[%x]", t.Protocol(), t.Encode()[:26]),
+		fmt.Sprintf("\t%s:[%x]", t.Protocol(), data),
 		fmt.Sprintf("\t[%08x] 多媒体数据ID:[%d]", t.MultimediaID, t.MultimediaID),
 		fmt.Sprintf("\t[%02x] 多媒体数据类型:[%d] 0-图像 1-音频 2-视频", t.MultimediaType, t.MultimediaType),
 		fmt.Sprintf("\t[%02x] 多媒体格式编码:[%d] 0-jpeg 1-tlf 2-mp3 4-wav 4-wmv", t.MultimediaFormatEncode, t.MultimediaFormatEncode),
 		fmt.Sprintf("\t[%02x] 事件项编码:[%d] 0-平台下发指令 1-定时动作 2-抢劫报警触发 3-碰撞侧翻报警触发", t.EventItemEncode, t.EventItemEncode),
 		fmt.Sprintf("\t[%02x] 通道ID:[%d]", t.ChannelID, t.ChannelID),
-		t.T0x0200LocationItem.String(),
+		location,
 		fmt.Sprintf("\t多媒体包大小:[%d]", len(t.MultimediaPackage)),
 		"}",
 	}, "\n")
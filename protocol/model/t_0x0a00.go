@@ -0,0 +1,103 @@
+package model
+
+import (
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"github.com/cuteLittleDevil/go-jt808/protocol"
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+	"math/big"
+	"strings"
+)
+
+// rsaModulusLen RSA公钥{e,n}中n的长度.
+const rsaModulusLen = 128
+
+type T0x0A00 struct {
+	BaseHandle
+	// E 终端RSA公钥{e,n}中的e
+	E uint32 `json:"e"`
+	// N 终端RSA公钥{e,n}中的n 128个字节
+	N []byte `json:"n"`
+}
+
+// NewT0x0A00 根据终端的RSA公钥创建 公钥长度需要是1024位.
+func NewT0x0A00(pub *rsa.PublicKey) (*T0x0A00, error) {
+	e, n, err := fromRSAPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &T0x0A00{E: e, N: n}, nil
+}
+
+func (t *T0x0A00) Protocol() consts.JT808CommandType {
+	return consts.T0A00TerminalRSAPublicKey
+}
+
+func (t *T0x0A00) ReplyProtocol() consts.JT808CommandType {
+	return consts.P8001GeneralRespond
+}
+
+func (t *T0x0A00) Parse(jtMsg *jt808.JTMessage) error {
+	e, n, err := parseRSAPublicKey(jtMsg.Body)
+	if err != nil {
+		return err
+	}
+	t.E, t.N = e, n
+	return nil
+}
+
+func (t *T0x0A00) Encode() []byte {
+	return encodeRSAPublicKey(t.E, t.N)
+}
+
+// PublicKey 返回终端的RSA公钥 平台下发的消息体使用该公钥加密, 不合法的返回 protocol.ErrRSAPublicKey.
+func (t *T0x0A00) PublicKey() (*rsa.PublicKey, error) {
+	return toRSAPublicKey(t.E, t.N)
+}
+
+func (t *T0x0A00) String() string {
+	return strings.Join([]string{
+		"数据体对象:{",
+		fmt.Sprintf("\t%s:[%x]", t.Protocol(), t.Encode()),
+		fmt.Sprintf("\t[%08x] 终端RSA公钥e:[%d]", t.E, t.E),
+		fmt.Sprintf("\t[%x] 终端RSA公钥n", t.N),
+		"}",
+	}, "\n")
+}
+
+func parseRSAPublicKey(body []byte) (uint32, []byte, error) {
+	if len(body) != 4+rsaModulusLen {
+		return 0, nil, protocol.ErrBodyLengthInconsistency
+	}
+	e, n := binary.BigEndian.Uint32(body[:4]), body[4:]
+	if _, err := toRSAPublicKey(e, n); err != nil {
+		return 0, nil, err
+	}
+	return e, n, nil
+}
+
+func encodeRSAPublicKey(e uint32, n []byte) []byte {
+	data := make([]byte, 4, 4+rsaModulusLen)
+	binary.BigEndian.PutUint32(data, e)
+	if len(n) < rsaModulusLen { // 不足128字节 前补0
+		data = append(data, make([]byte, rsaModulusLen-len(n))...)
+	}
+	return append(data, n...)
+}
+
+func fromRSAPublicKey(pub *rsa.PublicKey) (uint32, []byte, error) {
+	if err := jt808.CheckRSAPublicKey(pub); err != nil {
+		return 0, nil, err
+	}
+	return uint32(pub.E), pub.N.FillBytes(make([]byte, rsaModulusLen)), nil
+}
+
+func toRSAPublicKey(e uint32, n []byte) (*rsa.PublicKey, error) {
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(e)}
+	if err := jt808.CheckRSAPublicKey(pub); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
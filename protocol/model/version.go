@@ -0,0 +1,55 @@
+package model
+
+import (
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// DetectProtocolVersion 判断报文的协议版本.
+// 2019版本根据固定头判断, 2011和2013版本的固定头相同,
+// 固定头已经指定为2011版本(见 jt808.Header.ApplyProtocolVersion)的情况直接使用,
+// 否则只有终端注册(0x0100)可以根据消息体判断, 其他报文按照2013版本.
+func DetectProtocolVersion(jtMsg *jt808.JTMessage) consts.ProtocolVersionType {
+	switch jtMsg.Header.ProtocolVersion {
+	case consts.JT808Protocol2019, consts.JT808Protocol2011:
+		return jtMsg.Header.ProtocolVersion
+	default:
+	}
+	if consts.JT808CommandType(jtMsg.Header.ID) == consts.T0100Register && is2011Register(jtMsg.Body) {
+		return consts.JT808Protocol2011
+	}
+	return consts.JT808Protocol2013
+}
+
+// is2011Register 根据注册的消息体判断是不是2011版本.
+// 2013版本 终端型号20个字节 车牌颜色在36, 消息体不超过36个字节的是2011版本.
+// 2011版本的车牌(如车辆VIN)比较长时也会超过36个字节, 只有按照2013版本的车牌颜色不合法
+// 并且按照2011版本(终端ID在[17:24] 车牌颜色在24)合法的情况 才是2011版本.
+// 2011版本的车牌后补0x00等情况 第36个字节也是合法的车牌颜色 会误判为2013版本,
+// 这种终端需要用 service.WithProtocolVersionFunc 指定版本.
+func is2011Register(body []byte) bool {
+	if len(body) <= 36 {
+		return true
+	}
+	if isPlateColor(body[36]) {
+		return false
+	}
+	return isTerminalID(body[17:24]) && isPlateColor(body[24])
+}
+
+// isTerminalID 终端ID由字母和数字组成 位数不足时后补0x00.
+func isTerminalID(data []byte) bool {
+	for _, v := range data {
+		switch {
+		case v == 0x00, v >= '0' && v <= '9', v >= 'A' && v <= 'Z', v >= 'a' && v <= 'z':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isPlateColor 车牌颜色 0=未上牌 1=蓝 2=黄 3=黑 4=白 5=绿 9=其他.
+func isPlateColor(v byte) bool {
+	return v <= 5 || v == 9
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"encoding/hex"
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+	"testing"
+)
+
+func TestDetectProtocolVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want consts.ProtocolVersionType
+	}{
+		{
+			name: "2011版本 消息体不超过36个字节",
+			msg:  "7e010000200123456789010000001f007363640000007777772e3830382e3736353433323101b2e24131323334a17e",
+			want: consts.JT808Protocol2011,
+		},
+		{
+			name: "2011版本 车辆VIN",
+			msg:  "7e0100002a0123456789010000001f007363640000007777772e3830382e37363534333231004c53564155323138304e32313833323934907e",
+			want: consts.JT808Protocol2011,
+		},
+		{
+			name: "2013版本",
+			msg:  "7e0100002c0123456789010000001f007363640000007777772e3830382e636f6d0000000000000000003736353433323101b2e24131323334cc7e",
+			want: consts.JT808Protocol2013,
+		},
+		{
+			// 已知的误判: 2011版本的车牌补0x00 第36个字节按照2013版本是合法的车牌颜色
+			// 无法从报文中区分 需要使用 service.WithProtocolVersionFunc 指定版本
+			name: "2011版本 车牌补0x00 判断为2013版本",
+			msg:  "7e0100002c0123456789010000001f007363640000007777772e3830382e3736353433323101b2e24131323334000000000000000000000000ad7e",
+			want: consts.JT808Protocol2013,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.msg)
+			jtMsg := jt808.NewJTMessage()
+			if err := jtMsg.Decode(data); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if got := DetectProtocolVersion(jtMsg); got != tt.want {
+				t.Errorf("DetectProtocolVersion() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -9,6 +10,19 @@ import (
 	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 )
 
+// defaultActiveOverTime 主动下发默认的超时时间.
+const defaultActiveOverTime = 3 * time.Second
+
+// RetransmitPolicy 主动下发超时后的重传策略.
+// 对应终端参数 0x0002(TCP消息应答超时时间) 和 0x0003(TCP消息重传次数),
+// UDP 的情况对应 0x0004 和 0x0005.
+// 每次重传使用相同的流水号, 第n次重传后的超时时间 T(n+1) = T(n) * (n+1),
+// T(0) 为 ActiveMessage 的超时时间.
+type RetransmitPolicy struct {
+	// Count 重传次数 0表示不重传
+	Count int `json:"count"`
+}
+
 // ActiveMessage 表示平台主动下发到终端的一条消息请求.
 type ActiveMessage struct {
 	// header 设备消息固体头 使用的是第一次报文的固定头
@@ -17,6 +31,26 @@ type ActiveMessage struct {
 	replyChan chan *Message
 	// convertMessage 平台最终转换的Message
 	convertMessage *Message
+	// timer 超时定时器
+	timer *time.Timer
+	// ctx 调用方的上下文 取消后不再等待终端应答
+	ctx context.Context
+	// stopCancelFunc 取消对 ctx 的监听
+	stopCancelFunc func() bool
+	// packets 最终下发的报文 重传时使用
+	packets [][]byte
+	// retransmitSum 已经重传的次数
+	retransmitSum int
+	// currentOverTime 当前这次下发的超时时间
+	currentOverTime time.Duration
+	// sendTime 第一次下发的时间
+	sendTime time.Time
+	// span 主动下发的追踪 见 WithTracer
+	span Span
+	// forwarded 其他节点转发过来的 不再转发
+	forwarded bool
+	// offline 从离线指令恢复的 终端不在线的情况不再保存
+	offline *OfflineMessage
 	// Key 唯一标识符 默认手机号
 	Key string `json:"key"`
 	// Command 平台下发的指令
@@ -25,7 +59,11 @@ type ActiveMessage struct {
 	Body []byte `json:"body"`
 	// OverTimeDuration  超时时间 默认3秒
 	OverTimeDuration time.Duration `json:"overTimeDuration"`
-	ExtensionFields  struct {
+	// Retransmit 超时后的重传策略 nil使用服务的配置 见 WithRetransmitPolicy
+	Retransmit *RetransmitPolicy `json:"retransmit,omitempty"`
+	// MaxBodyLength 单个包 body最大长度 超过的分包下发 0使用服务的配置 见 WithMaxBodyLength
+	MaxBodyLength   int `json:"maxBodyLength,omitempty"`
+	ExtensionFields struct {
 		// PlatformSeq 平台下发的流水号
 		PlatformSeq uint16 `json:"platformSeq,omitempty"`
 		// Data 平台最终下发的数据
@@ -38,6 +76,44 @@ func NewActiveMessage(key string, command consts.JT808CommandType, body []byte,
 	return &ActiveMessage{Key: key, Command: command, Body: body, OverTimeDuration: overTimeDuration}
 }
 
+// context 返回下发使用的上下文 未设置的情况为 context.Background().
+func (a *ActiveMessage) context() context.Context {
+	if a.ctx == nil {
+		return context.Background()
+	}
+	return a.ctx
+}
+
+// overTime 超时时间 未设置的情况默认3秒.
+func (a *ActiveMessage) overTime() time.Duration {
+	if a.OverTimeDuration > 0 {
+		return a.OverTimeDuration
+	}
+	return defaultActiveOverTime
+}
+
+// nextOverTime 第n次超时后 计算重传的超时时间 T(n+1) = T(n) * (n+1).
+// 已经达到重传次数的情况返回false.
+func (a *ActiveMessage) nextOverTime(policy RetransmitPolicy) (time.Duration, bool) {
+	if a.Retransmit != nil {
+		policy = *a.Retransmit
+	}
+	if a.retransmitSum >= policy.Count {
+		return 0, false
+	}
+	a.retransmitSum++
+	a.currentOverTime *= time.Duration(a.retransmitSum)
+	return a.currentOverTime, true
+}
+
+// maxBodyLength 单个包 body最大长度 没有设置的情况使用服务的配置.
+func (a *ActiveMessage) maxBodyLength(defaultLength int) int {
+	if a.MaxBodyLength > 0 {
+		return a.MaxBodyLength
+	}
+	return defaultLength
+}
+
 func (a *ActiveMessage) String() string {
 	return strings.Join([]string{
 		fmt.Sprintf("key[%s]", a.Key),
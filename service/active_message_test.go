@@ -0,0 +1,77 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// readBodyLengths 读取平台下发的报文 直到消息体的总长度为 total, 返回每个包的消息体长度.
+func readBodyLengths(t *testing.T, conn net.Conn, total int) []int {
+	t.Helper()
+	var (
+		reader  = jt808.NewFrameReader()
+		lengths []int
+		sum     int
+		buf     = make([]byte, 4096)
+	)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for sum < total {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error = %v lengths = %v", err, lengths)
+		}
+		for _, frame := range reader.ReadFrames(buf[:n]) {
+			jtMsg := jt808.NewJTMessage()
+			if err := jtMsg.Decode(frame); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			lengths = append(lengths, len(jtMsg.Body))
+			sum += len(jtMsg.Body)
+		}
+	}
+	return lengths
+}
+
+func TestService_maxBodyLength(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithMaxBodyLength(1023),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+	conn := joinTestTerminal(t, addr, events)
+
+	tests := []struct {
+		name          string
+		maxBodyLength int
+		want          []int
+	}{
+		{name: "服务的配置", maxBodyLength: 0, want: []int{1023, 1023, 454}},
+		{name: "单条下发的配置", maxBodyLength: 512, want: []int{512, 512, 512, 512, 452}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activeMsg := NewActiveMessage("12345678901", consts.P8108DistributeTerminalUpgradePackage, make([]byte, 2500), 200*time.Millisecond)
+			activeMsg.MaxBodyLength = tt.maxBodyLength
+			done := make(chan *Message, 1)
+			go func() {
+				done <- g.SendActiveMessage(activeMsg)
+			}()
+			got := readBodyLengths(t, conn, 2500)
+			if len(got) != len(tt.want) {
+				t.Fatalf("body lengths = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("body lengths = %v, want %v", got, tt.want)
+				}
+			}
+			<-done
+		})
+	}
+}
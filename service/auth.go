@@ -0,0 +1,201 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// RegisterResult 终端注册应答(0x8100)的结果.
+type RegisterResult byte
+
+const (
+	// RegisterSuccess 成功.
+	RegisterSuccess RegisterResult = iota
+	// RegisterVehicleRegistered 车辆已被注册.
+	RegisterVehicleRegistered
+	// RegisterVehicleNotFound 数据库中无该车辆.
+	RegisterVehicleNotFound
+	// RegisterTerminalRegistered 终端已被注册.
+	RegisterTerminalRegistered
+	// RegisterTerminalNotFound 数据库中无该终端.
+	RegisterTerminalNotFound
+)
+
+func (r RegisterResult) String() string {
+	switch r {
+	case RegisterSuccess:
+		return "成功"
+	case RegisterVehicleRegistered:
+		return "车辆已被注册"
+	case RegisterVehicleNotFound:
+		return "数据库中无该车辆"
+	case RegisterTerminalRegistered:
+		return "终端已被注册"
+	case RegisterTerminalNotFound:
+		return "数据库中无该终端"
+	}
+	return fmt.Sprintf("未知结果[%d]", byte(r))
+}
+
+// Authenticator 终端注册(0x0100)和鉴权(0x0102)的校验, 见 WithAuthenticator.
+// 所有连接共用同一个 Authenticator 实现需要保证并发安全.
+// 方法在连接的读取协程中执行 耗时操作会阻塞该终端的读取.
+// 发生 panic 的情况按失败回复(注册为 RegisterTerminalNotFound), 见 WithHandlerPanic.
+type Authenticator interface {
+	// Register 终端注册 返回 0x8100 的结果和下发的鉴权码.
+	// 结果不是 RegisterSuccess 的情况 鉴权码不会下发.
+	// msg.Key 在终端未加入时为空 可以使用 msg.JTMessage.Header.TerminalPhoneNo.
+	Register(msg *Message, register *model.T0x0100) (RegisterResult, string)
+	// Auth 终端鉴权 校验终端上报的鉴权码 通过返回true.
+	Auth(msg *Message, auth *model.T0x0102) bool
+}
+
+// authReplyHandle 开启鉴权后 0x0100和0x0102 使用的处理器.
+// 校验在读取协程中完成 回复时直接使用校验的结果, 其余的事件还是原来的处理器.
+type authReplyHandle struct {
+	Handler
+	body []byte
+	err  error
+}
+
+func (a *authReplyHandle) ReplyBody(_ *jt808.JTMessage) ([]byte, error) {
+	return a.body, a.err
+}
+
+// onAuthEvent 开启鉴权后 校验注册和鉴权的报文, 鉴权通过前收到
+// 注册(0x0100)、鉴权(0x0102)和注销(0x0003)以外的报文返回 ErrUnauthenticated.
+// 在读取协程中执行 在终端加入之前.
+func (c *connection) onAuthEvent(msg *Message) error {
+	if msg.Handler == nil { // 没有处理器的 无法回复 只校验是否鉴权通过
+		return c.checkAuthenticated(msg)
+	}
+	switch msg.Command {
+	case consts.T0100Register:
+		handle := &authReplyHandle{Handler: msg.Handler}
+		register := &model.T0x0100{}
+		if handle.err = register.Parse(msg.JTMessage); handle.err == nil {
+			result, authCode := RegisterTerminalNotFound, ""
+			c.safeCall("Authenticator.Register", msg, func() {
+				result, authCode = c.authenticator.Register(msg, register)
+			})
+			if result != RegisterSuccess {
+				authCode = ""
+			}
+			handle.body = (&model.P0x8100{
+				RespondSerialNumber: msg.JTMessage.Header.SerialNumber,
+				Result:              byte(result),
+				AuthCode:            authCode,
+			}).Encode()
+		}
+		msg.Handler = handle
+	case consts.T0102RegisterAuth:
+		handle := &authReplyHandle{Handler: msg.Handler}
+		auth := &model.T0x0102{}
+		if handle.err = auth.Parse(msg.JTMessage); handle.err == nil {
+			result := byte(1) // 0-成功 1-失败
+			var ok bool
+			c.safeCall("Authenticator.Auth", msg, func() {
+				ok = c.authenticator.Auth(msg, auth)
+			})
+			if ok {
+				result = 0
+				c.authenticated = true
+			}
+			handle.body = (&model.P0x8001{
+				RespondSerialNumber: msg.JTMessage.Header.SerialNumber,
+				RespondID:           msg.JTMessage.Header.ID,
+				Result:              result,
+			}).Encode()
+		}
+		msg.Handler = handle
+	default:
+		return c.checkAuthenticated(msg)
+	}
+	return nil
+}
+
+func (c *connection) checkAuthenticated(msg *Message) error {
+	switch msg.Command {
+	case consts.T0100Register, consts.T0102RegisterAuth, consts.T0003Logout:
+		return nil
+	}
+	if !c.authenticated {
+		return errors.Join(ErrUnauthenticated,
+			fmt.Errorf("phone=[%s] command=[%s]", msg.JTMessage.Header.TerminalPhoneNo, msg.Command))
+	}
+	return nil
+}
+
+// MemoryAuthenticator 内存存储的终端注册和鉴权 按手机号区分终端.
+// 只有 AddTerminal 添加过的终端可以注册, 注册成功后生成随机的鉴权码,
+// 已经注册过的再次注册返回 RegisterTerminalRegistered.
+type MemoryAuthenticator struct {
+	mu sync.Mutex
+	// record 手机号 -> 鉴权码 未注册的鉴权码为空
+	record map[string]string
+}
+
+// NewMemoryAuthenticator 创建内存存储的终端注册和鉴权, phones 为允许注册的终端手机号.
+func NewMemoryAuthenticator(phones ...string) *MemoryAuthenticator {
+	m := &MemoryAuthenticator{
+		record: make(map[string]string, len(phones)),
+	}
+	for _, phone := range phones {
+		m.AddTerminal(phone)
+	}
+	return m
+}
+
+// AddTerminal 添加允许注册的终端 已经存在的情况不变.
+func (m *MemoryAuthenticator) AddTerminal(phone string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.record[phone]; !ok {
+		m.record[phone] = ""
+	}
+}
+
+// RemoveTerminal 删除终端 之后注册和鉴权都会失败.
+func (m *MemoryAuthenticator) RemoveTerminal(phone string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.record, phone)
+}
+
+// AuthCode 获取终端的鉴权码 未注册的情况返回false.
+func (m *MemoryAuthenticator) AuthCode(phone string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := m.record[phone]
+	return code, code != ""
+}
+
+func (m *MemoryAuthenticator) Register(msg *Message, _ *model.T0x0100) (RegisterResult, string) {
+	phone := msg.JTMessage.Header.TerminalPhoneNo
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code, ok := m.record[phone]
+	switch {
+	case !ok:
+		return RegisterTerminalNotFound, ""
+	case code != "":
+		return RegisterTerminalRegistered, ""
+	}
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	code = hex.EncodeToString(buf)
+	m.record[phone] = code
+	return RegisterSuccess, code
+}
+
+func (m *MemoryAuthenticator) Auth(msg *Message, auth *model.T0x0102) bool {
+	code, ok := m.AuthCode(msg.JTMessage.Header.TerminalPhoneNo)
+	return ok && code == auth.AuthCode
+}
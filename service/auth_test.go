@@ -0,0 +1,205 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func encodeRegisterPacket(t *testing.T, serial uint16) []byte {
+	t.Helper()
+	register := &model.T0x0100{
+		ProvinceID:         31,
+		CityID:             110,
+		ManufacturerID:     "cd123",
+		TerminalModel:      "jt808",
+		TerminalID:         "1234567",
+		PlateColor:         1,
+		LicensePlateNumber: "测A12345",
+		Version:            consts.JT808Protocol2013,
+	}
+	return encodeTerminalPacket(t, consts.T0100Register, register.Encode(), serial)
+}
+
+func encodeAuthPacket(t *testing.T, authCode string, serial uint16) []byte {
+	t.Helper()
+	auth := &model.T0x0102{AuthCode: authCode, Version: consts.JT808Protocol2013}
+	return encodeTerminalPacket(t, consts.T0102RegisterAuth, auth.Encode(), serial)
+}
+
+func readRegisterRespond(t *testing.T, conn net.Conn) *model.P0x8100 {
+	t.Helper()
+	platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+	if consts.JT808CommandType(platformMsg.Header.ID) != consts.P8100RegisterRespond {
+		t.Fatalf("reply command = 0x%04X, want 0x8100", platformMsg.Header.ID)
+	}
+	p8100 := &model.P0x8100{}
+	if err := p8100.Parse(platformMsg); err != nil {
+		t.Fatalf("Parse 0x8100 error = %v", err)
+	}
+	return p8100
+}
+
+func readGeneralRespondResult(t *testing.T, conn net.Conn) byte {
+	t.Helper()
+	platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+	p8001 := &model.P0x8001{}
+	if err := p8001.Parse(platformMsg); err != nil {
+		t.Fatalf("Parse 0x8001 error = %v", err)
+	}
+	return p8001.Result
+}
+
+func TestService_authenticator(t *testing.T) {
+	authenticator := NewMemoryAuthenticator()
+	_, addr := startTestServer(t, WithAuthenticator(authenticator))
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(encodeRegisterPacket(t, 1)); err != nil {
+		t.Fatalf("Write 0x0100 error = %v", err)
+	}
+	if got := readRegisterRespond(t, conn); RegisterResult(got.Result) != RegisterTerminalNotFound {
+		t.Fatalf("register result = %s, want %s", RegisterResult(got.Result), RegisterTerminalNotFound)
+	}
+
+	authenticator.AddTerminal("12345678901")
+	if _, err := conn.Write(encodeRegisterPacket(t, 2)); err != nil {
+		t.Fatalf("Write 0x0100 error = %v", err)
+	}
+	p8100 := readRegisterRespond(t, conn)
+	if RegisterResult(p8100.Result) != RegisterSuccess || p8100.AuthCode == "" {
+		t.Fatalf("register result = %s auth code = %s", RegisterResult(p8100.Result), p8100.AuthCode)
+	}
+	if code, _ := authenticator.AuthCode("12345678901"); code != p8100.AuthCode {
+		t.Fatalf("auth code = %s, want %s", p8100.AuthCode, code)
+	}
+	if _, err := conn.Write(encodeRegisterPacket(t, 3)); err != nil {
+		t.Fatalf("Write 0x0100 error = %v", err)
+	}
+	if got := readRegisterRespond(t, conn); RegisterResult(got.Result) != RegisterTerminalRegistered {
+		t.Fatalf("register again result = %s, want %s", RegisterResult(got.Result), RegisterTerminalRegistered)
+	}
+
+	if _, err := conn.Write(encodeAuthPacket(t, "wrong", 4)); err != nil {
+		t.Fatalf("Write 0x0102 error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 1 {
+		t.Fatalf("wrong auth code result = %d, want 1", got)
+	}
+	if _, err := conn.Write(encodeAuthPacket(t, p8100.AuthCode, 5)); err != nil {
+		t.Fatalf("Write 0x0102 error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 0 {
+		t.Fatalf("auth result = %d, want 0", got)
+	}
+
+	// 鉴权通过后可以正常上报业务报文
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 0 {
+		t.Fatalf("heartbeat result = %d, want 0", got)
+	}
+}
+
+func TestService_authenticatorRejectUnauthenticated(t *testing.T) {
+	_, addr := startTestServer(t, WithAuthenticator(NewMemoryAuthenticator("12345678901")))
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(encodeAuthPacket(t, "wrong", 1)); err != nil {
+		t.Fatalf("Write 0x0102 error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 1 {
+		t.Fatalf("auth result = %d, want 1", got)
+	}
+
+	// 鉴权没有通过 上报业务报文直接断开
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 64)); !errors.Is(err, io.EOF) {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("connection not closed after unauthenticated heartbeat")
+		}
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			t.Fatalf("Read() error = %v, want connection closed", err)
+		}
+	}
+}
+
+func TestService_authenticatorBeforeJoin(t *testing.T) {
+	authenticator := NewMemoryAuthenticator("12345678901")
+	events := newRecordingTerminalEvent()
+	_, addr := startTestServer(t,
+		WithAuthenticator(authenticator),
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(encodeRegisterPacket(t, 1)); err != nil {
+		t.Fatalf("Write 0x0100 error = %v", err)
+	}
+	p8100 := readRegisterRespond(t, conn)
+	// 鉴权通过前不会加入
+	select {
+	case key := <-events.joined:
+		t.Fatalf("join before auth: %s", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := conn.Write(encodeAuthPacket(t, p8100.AuthCode, 2)); err != nil {
+		t.Fatalf("Write 0x0102 error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 0 {
+		t.Fatalf("auth result = %d, want 0", got)
+	}
+	if key := waitChan(t, events.joined, 2*time.Second); key != "12345678901" {
+		t.Fatalf("join key = %s, want 12345678901", key)
+	}
+}
+
+func TestService_authenticatorRejectAllCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet func(t *testing.T) []byte
+	}{
+		{name: "没有处理器的指令", packet: func(t *testing.T) []byte {
+			return encodeTerminalPacket(t, consts.JT808CommandType(0x0F01), []byte{0x01}, 1)
+		}},
+		{name: "通用应答", packet: func(t *testing.T) []byte {
+			return encodeGeneralRespond(t, 1, consts.P8300TextInfoDistribution, 1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := newRecordingTerminalEvent()
+			_, addr := startTestServer(t,
+				WithAuthenticator(NewMemoryAuthenticator("12345678901")),
+				WithCustomTerminalEventer(func() TerminalEventer { return events }),
+			)
+			drainStringChan(events.joined)
+
+			conn := dialTerminal(t, addr)
+			if _, err := conn.Write(tt.packet(t)); err != nil {
+				t.Fatalf("Write error = %v", err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Read(make([]byte, 64)); errors.Is(err, os.ErrDeadlineExceeded) || err == nil {
+				t.Fatalf("connection not closed, err = %v", err)
+			}
+			select {
+			case key := <-events.joined:
+				t.Fatalf("unauthenticated join: %s", key)
+			default:
+			}
+		})
+	}
+}
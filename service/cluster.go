@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// defaultClusterTimeout 访问 SessionRegistry 默认的超时时间.
+const defaultClusterTimeout = 3 * time.Second
+
+type (
+	// SessionRegistry 记录终端所在的节点, 多个节点共用, 见 WithCluster.
+	// 实现需要保证并发安全, 可以使用 redis、etcd 等.
+	SessionRegistry interface {
+		// Register 终端加入了 nodeID 节点, key 已经存在的情况覆盖.
+		Register(ctx context.Context, key string, nodeID string) error
+		// Unregister 终端离开了 nodeID 节点, 只有 key 仍然属于 nodeID 时删除.
+		Unregister(ctx context.Context, key string, nodeID string) error
+		// Lookup 查询终端所在的节点, 不存在的情况 ok 为false.
+		Lookup(ctx context.Context, key string) (nodeID string, ok bool, err error)
+	}
+
+	// NodeTransport 节点之间转发主动下发, 见 WithCluster.
+	NodeTransport interface {
+		// Serve 开始接收其他节点转发的主动下发 handle 在本节点下发并返回终端的应答.
+		// 在 Run 的时候调用 不能阻塞.
+		Serve(handle func(ctx context.Context, activeMsg *ActiveMessage) *Message) error
+		// Forward 把主动下发转发到 nodeID 节点 返回终端的应答.
+		Forward(ctx context.Context, nodeID string, activeMsg *ActiveMessage) (*Message, error)
+		// Close 停止接收 在 Shutdown 的时候调用.
+		Close() error
+	}
+
+	// Cluster 集群配置, 见 WithCluster.
+	Cluster struct {
+		// NodeID 本节点的唯一标识
+		NodeID string
+		// Registry 终端所在节点的记录
+		Registry SessionRegistry
+		// Transport 节点之间的转发
+		Transport NodeTransport
+		// Timeout 访问 Registry 的超时时间 默认3秒
+		Timeout time.Duration
+	}
+)
+
+func (c *Cluster) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultClusterTimeout
+}
+
+// register 终端加入后记录到 Registry 失败的情况只记录日志 不影响本节点的会话.
+func (s *sessionManager) register(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cluster.timeout())
+	defer cancel()
+	if err := s.cluster.Registry.Register(ctx, key, s.cluster.NodeID); err != nil {
+		slog.Warn("session registry register fail",
+			slog.String("key", key),
+			slog.String("node", s.cluster.NodeID),
+			slog.Any("err", err))
+	}
+}
+
+func (s *sessionManager) unregister(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cluster.timeout())
+	defer cancel()
+	if err := s.cluster.Registry.Unregister(ctx, key, s.cluster.NodeID); err != nil {
+		slog.Warn("session registry unregister fail",
+			slog.String("key", key),
+			slog.String("node", s.cluster.NodeID),
+			slog.Any("err", err))
+	}
+}
+
+// forward 本节点没有该终端 查询所在的节点并转发. 在新的协程中执行.
+func (s *sessionManager) forward(activeMsg *ActiveMessage) {
+	ctx := activeMsg.context()
+	lookupCtx, cancel := context.WithTimeout(ctx, s.cluster.timeout())
+	nodeID, ok, err := s.cluster.Registry.Lookup(lookupCtx, activeMsg.Key)
+	cancel()
+	if err != nil {
+		activeMsg.replyChan <- newErrMessage(errors.Join(ErrForwardFail,
+			fmt.Errorf("key=[%s] lookup", activeMsg.Key), err))
+		return
+	}
+	if !ok || nodeID == s.cluster.NodeID {
+		// 其他节点也没有 按照本节点不在线处理(离线指令等)
+		if !s.submit(func(record map[string]*session) {
+			s.dispatchLocal(record, activeMsg, false)
+		}) {
+			activeMsg.replyChan <- newErrMessage(ErrServerClosed)
+		}
+		return
+	}
+	reply, err := s.cluster.Transport.Forward(ctx, nodeID, activeMsg)
+	if err != nil {
+		reply = newErrMessage(errors.Join(ErrForwardFail,
+			fmt.Errorf("key=[%s] node=[%s]", activeMsg.Key, nodeID), err))
+	}
+	activeMsg.replyChan <- reply
+}
+
+// serveForward 处理其他节点转发的主动下发, 本节点没有该终端的情况不再转发.
+func (g *GoJT808) serveForward(ctx context.Context, activeMsg *ActiveMessage) *Message {
+	msg := NewActiveMessage(activeMsg.Key, activeMsg.Command, activeMsg.Body, activeMsg.OverTimeDuration)
+	msg.Retransmit = activeMsg.Retransmit
+	msg.MaxBodyLength = activeMsg.MaxBodyLength
+	msg.forwarded = true
+	return g.sendActiveMessages(ctx, []*ActiveMessage{msg})[0]
+}
+
+// MemorySessionRegistry 进程内的 SessionRegistry, 用于测试或者一个进程中运行多个节点.
+type MemorySessionRegistry struct {
+	mu     sync.RWMutex
+	record map[string]string
+}
+
+func NewMemorySessionRegistry() *MemorySessionRegistry {
+	return &MemorySessionRegistry{record: map[string]string{}}
+}
+
+func (m *MemorySessionRegistry) Register(_ context.Context, key string, nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record[key] = nodeID
+	return nil
+}
+
+func (m *MemorySessionRegistry) Unregister(_ context.Context, key string, nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.record[key] == nodeID {
+		delete(m.record, key)
+	}
+	return nil
+}
+
+func (m *MemorySessionRegistry) Lookup(_ context.Context, key string) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodeID, ok := m.record[key]
+	return nodeID, ok, nil
+}
+
+// MemoryNetwork 进程内的节点网络, 每个节点使用 Transport 获取自己的 NodeTransport.
+type MemoryNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]func(ctx context.Context, activeMsg *ActiveMessage) *Message
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: map[string]func(ctx context.Context, activeMsg *ActiveMessage) *Message{}}
+}
+
+// Transport 返回 nodeID 节点使用的 NodeTransport.
+func (m *MemoryNetwork) Transport(nodeID string) NodeTransport {
+	return &memoryTransport{network: m, nodeID: nodeID}
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	nodeID  string
+}
+
+func (t *memoryTransport) Serve(handle func(ctx context.Context, activeMsg *ActiveMessage) *Message) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.network.nodes[t.nodeID] = handle
+	return nil
+}
+
+func (t *memoryTransport) Forward(ctx context.Context, nodeID string, activeMsg *ActiveMessage) (*Message, error) {
+	t.network.mu.RLock()
+	handle, ok := t.network.nodes[nodeID]
+	t.network.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("node [%s] not found", nodeID)
+	}
+	return handle(ctx, activeMsg), nil
+}
+
+func (t *memoryTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	delete(t.network.nodes, t.nodeID)
+	return nil
+}
@@ -0,0 +1,410 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultForwardTimeout 转发没有设置超时(ctx没有deadline)的情况 默认的超时时间.
+	defaultForwardTimeout = 30 * time.Second
+	// maxForwardFrameSize 节点之间一个数据帧的最大长度.
+	maxForwardFrameSize = 16 * 1024 * 1024
+	// forwardNonceSize 共享密钥认证 双方随机数的长度.
+	forwardNonceSize = 32
+)
+
+// forwardErrors 转发的应答中需要保留的错误 调用方仍然可以使用 errors.Is 判断.
+var forwardErrors = []error{
+	ErrWriteDataFail,
+	ErrWriteDataOverTime,
+	ErrNotExistKey,
+	ErrConnectionClosed,
+	ErrServerClosed,
+	ErrOfflineMessageQueued,
+	ErrHandlerPanic,
+	context.Canceled,
+	context.DeadlineExceeded,
+	// 按下标传输 新增的只能追加在后面
+	ErrQueueOverflow,
+	ErrForwardFail,
+}
+
+type (
+	// TCPTransport 基于TCP的 NodeTransport, 每次转发建立一个连接.
+	// 数据格式为 4字节长度(大端) + JSON, 必须配置 TCPTransportAuth 认证其他节点.
+	TCPTransport struct {
+		addr  string
+		peers map[string]string
+		auth  TCPTransportAuth
+
+		mu       sync.Mutex
+		listener net.Listener
+		wg       sync.WaitGroup
+	}
+
+	// TCPTransportAuth 节点之间的认证 TLSConfig 和 Secret 至少设置一个, 未通过认证的节点断开连接.
+	TCPTransportAuth struct {
+		// TLSConfig 节点之间使用TLS 接收和转发共用.
+		// 只使用TLS认证的情况 ClientAuth 需要为 tls.RequireAndVerifyClientCert,
+		// 转发时 ServerName 为空的使用 peers 中地址的主机名.
+		TLSConfig *tls.Config
+		// Secret 共享密钥 所有节点相同, 每个连接双方交换随机数后 请求和应答都带上 HMAC-SHA256 签名.
+		// 密钥不在网络中传输 但数据不加密 需要加密的情况和 TLSConfig 一起使用.
+		Secret []byte
+	}
+
+	forwardRequest struct {
+		ActiveMessage *ActiveMessage `json:"activeMessage"`
+		// Timeout 调用方剩余的等待时间
+		Timeout time.Duration `json:"timeout"`
+	}
+
+	forwardReply struct {
+		Message *Message `json:"message,omitempty"`
+		// Err 终端应答的错误
+		Err string `json:"err,omitempty"`
+		// ErrIndexes Err 中包含的 forwardErrors
+		ErrIndexes []int `json:"errIndexes,omitempty"`
+	}
+
+	// forwardError 其他节点返回的错误.
+	forwardError struct {
+		msg     string
+		targets []error
+	}
+)
+
+// NewTCPTransport 创建基于TCP的节点转发.
+// addr 为本节点接收转发的地址 建议只监听内网地址, peers 为 nodeID -> 地址, 不在 peers 中的 nodeID 当作地址使用.
+// 接收的转发会下发到终端 因此必须配置认证, 没有配置的情况 Serve 和 Forward 返回 ErrClusterAuth.
+//
+// 使用示例：
+//
+//	transport := service.NewTCPTransport("10.0.0.1:18080", map[string]string{
+//		"node-1": "10.0.0.1:18080",
+//		"node-2": "10.0.0.2:18080",
+//	}, service.TCPTransportAuth{Secret: []byte(os.Getenv("JT808_CLUSTER_SECRET"))})
+func NewTCPTransport(addr string, peers map[string]string, auth TCPTransportAuth) *TCPTransport {
+	return &TCPTransport{addr: addr, peers: peers, auth: auth}
+}
+
+// check 没有配置认证 或者只使用TLS但不校验客户端证书的情况返回错误.
+func (a TCPTransportAuth) check() error {
+	if len(a.Secret) > 0 {
+		return nil
+	}
+	if a.TLSConfig != nil && a.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil
+	}
+	return errors.Join(ErrClusterAuth, errors.New("tcp transport needs Secret or TLSConfig with RequireAndVerifyClientCert"))
+}
+
+// Addr 返回实际监听的地址 未开始监听的情况返回配置的地址.
+func (t *TCPTransport) Addr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener != nil {
+		return t.listener.Addr().String()
+	}
+	return t.addr
+}
+
+func (t *TCPTransport) Serve(handle func(ctx context.Context, activeMsg *ActiveMessage) *Message) error {
+	if err := t.auth.check(); err != nil {
+		return err
+	}
+	in, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.listener = in
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			conn, err := in.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Warn("transport accept fail",
+					slog.Any("err", err))
+				continue
+			}
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				t.serveConn(conn, handle)
+			}()
+		}
+	}()
+	return nil
+}
+
+func (t *TCPTransport) serveConn(conn net.Conn, handle func(ctx context.Context, activeMsg *ActiveMessage) *Message) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(defaultForwardTimeout))
+	if t.auth.TLSConfig != nil {
+		conn = tls.Server(conn, t.auth.TLSConfig)
+	}
+	signer, err := t.serverHandshake(conn)
+	if err != nil {
+		slog.Warn("transport auth fail",
+			slog.String("address", conn.RemoteAddr().String()),
+			slog.Any("err", err))
+		return
+	}
+	var req forwardRequest
+	if err := readForwardFrame(conn, &req, signer.request); err != nil || req.ActiveMessage == nil {
+		slog.Warn("transport read request fail",
+			slog.String("address", conn.RemoteAddr().String()),
+			slog.Any("err", err))
+		return
+	}
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = defaultForwardTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	reply := newForwardReply(handle(ctx, req.ActiveMessage))
+	_ = conn.SetWriteDeadline(time.Now().Add(defaultForwardTimeout))
+	if err := writeForwardFrame(conn, reply, signer.reply); err != nil {
+		slog.Warn("transport write reply fail",
+			slog.String("address", conn.RemoteAddr().String()),
+			slog.String("key", req.ActiveMessage.Key),
+			slog.Any("err", err))
+	}
+}
+
+func (t *TCPTransport) Forward(ctx context.Context, nodeID string, activeMsg *ActiveMessage) (*Message, error) {
+	if err := t.auth.check(); err != nil {
+		return nil, err
+	}
+	addr := nodeID
+	if v, ok := t.peers[nodeID]; ok {
+		addr = v
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultForwardTimeout)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	// ctx 取消的情况 立即结束读取
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	_ = conn.SetDeadline(deadline)
+	if t.auth.TLSConfig != nil {
+		conn = tls.Client(conn, t.clientTLSConfig(addr))
+	}
+	signer, err := t.clientHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeForwardFrame(conn, forwardRequest{
+		ActiveMessage: activeMsg,
+		Timeout:       time.Until(deadline),
+	}, signer.request); err != nil {
+		return nil, err
+	}
+	var reply forwardReply
+	if err := readForwardFrame(conn, &reply, signer.reply); err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Join(ctx.Err(), err)
+		}
+		return nil, err
+	}
+	return reply.message(), nil
+}
+
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	listener := t.listener
+	t.mu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	err := listener.Close()
+	t.wg.Wait()
+	return err
+}
+
+func (t *TCPTransport) clientTLSConfig(addr string) *tls.Config {
+	config := t.auth.TLSConfig
+	if config.ServerName != "" {
+		return config
+	}
+	config = config.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	}
+	return config
+}
+
+// forwardSigner 共享密钥认证 请求和应答的签名 没有配置 Secret 的情况为nil.
+type forwardSigner struct {
+	secret []byte
+	// nonce 服务端和客户端的随机数 每个连接不同 防止重放
+	nonce []byte
+}
+
+// serverHandshake 发送服务端的随机数 读取客户端的随机数.
+func (t *TCPTransport) serverHandshake(conn net.Conn) (*forwardSigner, error) {
+	if len(t.auth.Secret) == 0 {
+		return nil, nil
+	}
+	nonce := make([]byte, 2*forwardNonceSize)
+	_, _ = rand.Read(nonce[:forwardNonceSize])
+	if _, err := conn.Write(nonce[:forwardNonceSize]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, nonce[forwardNonceSize:]); err != nil {
+		return nil, err
+	}
+	return &forwardSigner{secret: t.auth.Secret, nonce: nonce}, nil
+}
+
+// clientHandshake 读取服务端的随机数 发送客户端的随机数.
+func (t *TCPTransport) clientHandshake(conn net.Conn) (*forwardSigner, error) {
+	if len(t.auth.Secret) == 0 {
+		return nil, nil
+	}
+	nonce := make([]byte, 2*forwardNonceSize)
+	if _, err := io.ReadFull(conn, nonce[:forwardNonceSize]); err != nil {
+		return nil, err
+	}
+	_, _ = rand.Read(nonce[forwardNonceSize:])
+	if _, err := conn.Write(nonce[forwardNonceSize:]); err != nil {
+		return nil, err
+	}
+	return &forwardSigner{secret: t.auth.Secret, nonce: nonce}, nil
+}
+
+func (f *forwardSigner) request(data []byte) []byte {
+	return f.sign('q', data)
+}
+
+func (f *forwardSigner) reply(data []byte) []byte {
+	return f.sign('p', data)
+}
+
+// sign 签名 随机数 + 方向 + 数据, 区分方向避免把请求当作应答返回.
+func (f *forwardSigner) sign(direction byte, data []byte) []byte {
+	if f == nil {
+		return nil
+	}
+	h := hmac.New(sha256.New, f.secret)
+	h.Write(f.nonce)
+	h.Write([]byte{direction})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func newForwardReply(msg *Message) forwardReply {
+	var reply forwardReply
+	if err := msg.ExtensionFields.Err; err != nil {
+		reply.Err = err.Error()
+		for i, target := range forwardErrors {
+			if errors.Is(err, target) {
+				reply.ErrIndexes = append(reply.ErrIndexes, i)
+			}
+		}
+	}
+	tmp := *msg
+	tmp.Handler = nil
+	tmp.ExtensionFields.Err = nil
+	reply.Message = &tmp
+	return reply
+}
+
+func (f forwardReply) message() *Message {
+	msg := f.Message
+	if msg == nil {
+		msg = &Message{}
+	}
+	if f.Err != "" {
+		err := &forwardError{msg: f.Err}
+		for _, i := range f.ErrIndexes {
+			if i >= 0 && i < len(forwardErrors) {
+				err.targets = append(err.targets, forwardErrors[i])
+			}
+		}
+		msg.ExtensionFields.Err = err
+	}
+	return msg
+}
+
+func (e *forwardError) Error() string {
+	return e.msg
+}
+
+func (e *forwardError) Unwrap() []error {
+	return e.targets
+}
+
+// writeForwardFrame 写一个数据帧 sign 返回的签名追加在 JSON 后面.
+func writeForwardFrame(w io.Writer, v any, sign func(data []byte) []byte) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data = append(data, sign(data)...)
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
+
+// readForwardFrame 读一个数据帧 签名不一致的情况返回 ErrClusterAuth.
+func readForwardFrame(r io.Reader, v any, sign func(data []byte) []byte) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxForwardFrameSize {
+		return fmt.Errorf("frame size [%d] > [%d]", n, maxForwardFrameSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if size := len(sign(nil)); size > 0 {
+		if len(data) < size {
+			return errors.Join(ErrClusterAuth, errors.New("frame without signature"))
+		}
+		var mac []byte
+		data, mac = data[:len(data)-size], data[len(data)-size:]
+		if !hmac.Equal(mac, sign(data)) {
+			return errors.Join(ErrClusterAuth, errors.New("frame signature mismatch"))
+		}
+	}
+	return json.Unmarshal(data, v)
+}
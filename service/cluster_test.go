@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// replyActive 终端收到平台下发后回复通用应答.
+func replyActive(t *testing.T, conn net.Conn, command consts.JT808CommandType) {
+	go func() {
+		platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, command, 2)
+		if _, err := conn.Write(resp); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}()
+}
+
+func TestService_cluster(t *testing.T) {
+	registry := NewMemorySessionRegistry()
+	network := NewMemoryNetwork()
+	events := newRecordingTerminalEvent()
+	_, addrA := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithCluster(Cluster{NodeID: "a", Registry: registry, Transport: network.Transport("a")}),
+	)
+	b, _ := startTestServer(t,
+		WithCluster(Cluster{NodeID: "b", Registry: registry, Transport: network.Transport("b")}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := joinTestTerminal(t, addrA, events)
+	if nodeID, ok, _ := registry.Lookup(context.Background(), "12345678901"); !ok || nodeID != "a" {
+		t.Fatalf("Lookup() = %s %v, want a true", nodeID, ok)
+	}
+
+	// 终端在a节点 b节点下发的时候转发到a节点
+	replyActive(t, conn, consts.P9101RealTimeAudioVideoRequest)
+	reply := b.SendActiveMessage(NewActiveMessage("12345678901", consts.P9101RealTimeAudioVideoRequest, nil, time.Second))
+	if reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+	}
+	if reply.Command != consts.T0001GeneralRespond {
+		t.Fatalf("reply command = %s, want %s", reply.Command, consts.T0001GeneralRespond)
+	}
+
+	_ = conn.Close()
+	_ = waitChan(t, events.left, 2*time.Second)
+	waitFor(t, 2*time.Second, func() bool {
+		_, ok, _ := registry.Lookup(context.Background(), "12345678901")
+		return !ok
+	})
+	reply = b.SendActiveMessage(NewActiveMessage("12345678901", consts.P9101RealTimeAudioVideoRequest, nil, time.Second))
+	if !errors.Is(reply.ExtensionFields.Err, ErrNotExistKey) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrNotExistKey)
+	}
+}
+
+func TestService_clusterTCPTransport(t *testing.T) {
+	registry := NewMemorySessionRegistry()
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	peers := map[string]string{"a": addrA, "b": addrB}
+	auth := TCPTransportAuth{Secret: []byte("cluster secret")}
+	events := newRecordingTerminalEvent()
+	_, terminalAddr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithCluster(Cluster{NodeID: "a", Registry: registry, Transport: NewTCPTransport(addrA, peers, auth)}),
+	)
+	b, _ := startTestServer(t,
+		WithCluster(Cluster{NodeID: "b", Registry: registry, Transport: NewTCPTransport(addrB, peers, auth)}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := joinTestTerminal(t, terminalAddr, events)
+	replyActive(t, conn, consts.P9101RealTimeAudioVideoRequest)
+	reply := b.SendActiveMessage(NewActiveMessage("12345678901", consts.P9101RealTimeAudioVideoRequest, []byte{0x01}, time.Second))
+	if reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+	}
+	if reply.Command != consts.T0001GeneralRespond || reply.ExtensionFields.PlatformCommand != consts.P9101RealTimeAudioVideoRequest {
+		t.Fatalf("reply = %+v", reply)
+	}
+
+	// 记录在a节点 但a节点没有该终端 返回a节点的错误
+	_ = registry.Register(context.Background(), "1", "a")
+	reply = b.SendActiveMessage(NewActiveMessage("1", consts.P9101RealTimeAudioVideoRequest, nil, time.Second))
+	if !errors.Is(reply.ExtensionFields.Err, ErrNotExistKey) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrNotExistKey)
+	}
+
+	// 节点不可用
+	_ = registry.Register(context.Background(), "2", "c")
+	reply = b.SendActiveMessage(NewActiveMessage("2", consts.P9101RealTimeAudioVideoRequest, nil, time.Second))
+	if !errors.Is(reply.ExtensionFields.Err, ErrForwardFail) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrForwardFail)
+	}
+}
+
+// serveTestTransport 开始接收转发 handle 记录收到的主动下发.
+func serveTestTransport(t *testing.T, auth TCPTransportAuth) (*TCPTransport, <-chan *ActiveMessage) {
+	t.Helper()
+	handled := make(chan *ActiveMessage, 1)
+	transport := NewTCPTransport("127.0.0.1:0", nil, auth)
+	if err := transport.Serve(func(_ context.Context, activeMsg *ActiveMessage) *Message {
+		handled <- activeMsg
+		return newErrMessage(ErrQueueOverflow)
+	}); err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	t.Cleanup(func() { _ = transport.Close() })
+	return transport, handled
+}
+
+func TestTCPTransport_auth(t *testing.T) {
+	// 没有配置认证 或者TLS不校验客户端证书 不能接收转发
+	for _, auth := range []TCPTransportAuth{{}, {TLSConfig: &tls.Config{}}} {
+		if err := NewTCPTransport("127.0.0.1:0", nil, auth).Serve(nil); !errors.Is(err, ErrClusterAuth) {
+			t.Fatalf("Serve() error = %v, want %v", err, ErrClusterAuth)
+		}
+	}
+
+	ca := newTestCA(t)
+	node := ca.issue(t, "node", x509.ExtKeyUsageAny)
+	other := newTestCA(t).issue(t, "node", x509.ExtKeyUsageAny)
+	nodeTLS := func(cert tls.Certificate) *tls.Config {
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      ca.pool,
+			ClientCAs:    ca.pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+	}
+	tests := []struct {
+		name   string
+		server TCPTransportAuth
+		client TCPTransportAuth
+		ok     bool
+	}{
+		{
+			name:   "共享密钥",
+			server: TCPTransportAuth{Secret: []byte("secret")},
+			client: TCPTransportAuth{Secret: []byte("secret")},
+			ok:     true,
+		},
+		{
+			name:   "共享密钥不一致",
+			server: TCPTransportAuth{Secret: []byte("secret")},
+			client: TCPTransportAuth{Secret: []byte("other")},
+		},
+		{
+			name:   "双向TLS",
+			server: TCPTransportAuth{TLSConfig: nodeTLS(node)},
+			client: TCPTransportAuth{TLSConfig: nodeTLS(node)},
+			ok:     true,
+		},
+		{
+			name:   "客户端证书不是同一个CA签发的",
+			server: TCPTransportAuth{TLSConfig: nodeTLS(node)},
+			client: TCPTransportAuth{TLSConfig: nodeTLS(other)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, handled := serveTestTransport(t, tt.server)
+			client := NewTCPTransport("127.0.0.1:0", nil, tt.client)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			reply, err := client.Forward(ctx, server.Addr(), NewActiveMessage("1", consts.P8201QueryLocation, nil, time.Second))
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("Forward() reply = %+v, want error", reply)
+				}
+				select {
+				case activeMsg := <-handled:
+					t.Fatalf("unauthenticated forward handled: %+v", activeMsg)
+				case <-time.After(100 * time.Millisecond):
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Forward() error = %v", err)
+			}
+			// 转发后仍然可以判断队列满了等错误
+			if !errors.Is(reply.ExtensionFields.Err, ErrQueueOverflow) {
+				t.Fatalf("Forward() reply err = %v, want %v", reply.ExtensionFields.Err, ErrQueueOverflow)
+			}
+			_ = waitChan(t, handled, time.Second)
+		})
+	}
+}
+
+func TestTCPTransport_rejectPlaintextPeer(t *testing.T) {
+	server, handled := serveTestTransport(t, TCPTransportAuth{Secret: []byte("secret")})
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	// 不知道密钥的节点 直接发送请求
+	nonce := make([]byte, forwardNonceSize)
+	_, _ = conn.Write(nonce)
+	_ = writeForwardFrame(conn, forwardRequest{
+		ActiveMessage: NewActiveMessage("1", consts.P8201QueryLocation, nil, time.Second),
+	}, func([]byte) []byte { return make([]byte, 32) })
+	select {
+	case activeMsg := <-handled:
+		t.Fatalf("unauthenticated forward handled: %+v", activeMsg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_forwardReply_errors(t *testing.T) {
+	for _, target := range []error{ErrQueueOverflow, ErrForwardFail, ErrNotExistKey} {
+		reply := newForwardReply(newErrMessage(errors.Join(target, errors.New("detail"))))
+		if got := reply.message().ExtensionFields.Err; !errors.Is(got, target) {
+			t.Fatalf("forward reply err = %v, want %v", got, target)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package service
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
@@ -25,23 +28,62 @@ type (
 	connection struct {
 		connectionParams
 
-		// finallyCompleteChan 用于等待当前所有正在主动下发的指令完成或超时后才真正关闭连接.
+		// stopChan 连接关闭后通知 write 协程结束未完成的主动下发并退出.
+		stopChan chan struct{}
+		// finallyCompleteChan write 协程退出后关闭, 用于通知超时等异步协程不再投递.
 		finallyCompleteChan chan struct{}
 		// terminalUplinkMsgChan 终端上报的普通消息（上行消息）会放入此通道，
 		// 随后由 write 协程统一处理回复逻辑.
 		terminalUplinkMsgChan chan *Message
 		// reissuePackChan 需要补发的分包消息通道.
 		reissuePackChan chan *Message
-		// platformSerialNumber 平台侧流水号（0~65535），自增后循环使用.
-		platformSerialNumber uint16
+		// platformSerialNumber 平台侧流水号 取低16位（0~65535）自增后循环使用（原子操作）,
+		// 在 write 协程中分配 读取协程只用于日志.
+		platformSerialNumber atomic.Uint32
 
 		// activeMsgChan 平台主动下发给终端的指令会包装成 ActiveMessage 放入此通道.
 		activeMsgChan chan *ActiveMessage
 		// activeMsgCompleteChan 当平台主动下发的指令收到终端应答（或超时）后，
 		// 会把完整的 Message 放入此通道，用于通知等待应答的协程.
 		activeMsgCompleteChan chan *Message
+		// activeMsgTimeoutChan 平台主动下发的指令超时后 放入此通道.
+		activeMsgTimeoutChan chan *ActiveMessage
+		// activeMsgCancelChan 平台主动下发的指令被调用方取消(ctx结束)后 放入此通道.
+		activeMsgCancelChan chan *ActiveMessage
+		// uplinkHandler 终端上传的报文经过中间件后的处理.
+		uplinkHandler HandlerFunc
+		// activeHandler 平台主动下发经过中间件后的处理 仅在 write 协程中使用.
+		activeHandler ActiveHandlerFunc
+		// rateLimiter 限流 nil表示不限流, 仅在读取协程中使用.
+		rateLimiter *rateLimiter
+		// queueOverflowSum 终端上传报文的队列满了的次数（原子操作）.
+		queueOverflowSum atomic.Uint64
+		// activeWaiting 队列满了 阻塞等待放入主动下发队列的 waitActive 协程.
+		activeWaiting sync.WaitGroup
+		// activeBlockedMu 保护 activeBlocked.
+		activeBlockedMu sync.Mutex
+		// activeBlocked 按顺序等待放入主动下发队列的指令 第一个由 waitActive 协程处理.
+		activeBlocked []*ActiveMessage
+		// pendingMu 保护 pendingReplies.
+		pendingMu sync.Mutex
+		// pendingReplies write 协程中等待应答的主动下发的副本, 丢弃最早的报文时用于保留这些应答.
+		pendingReplies map[uint16]*ActiveMessage
 		// activeUnfinishedSum 当前仍在等待终端应答的主动下发指令数量（原子操作）.
 		activeUnfinishedSum int32
+		// lastPacketTime 收到最后一个报文的时间 UnixNano（原子操作）, 用于会话查询.
+		lastPacketTime atomic.Int64
+		// protocolVersion 终端的协议版本（原子操作）, 用于会话查询 见 onProtocolVersion.
+		protocolVersion atomic.Uint32
+		// terminalPublicKey 终端上传的RSA公钥(0x0A00) nil表示平台下发的消息体不加密.
+		terminalPublicKey atomic.Pointer[rsa.PublicKey]
+		// kickReason 被平台踢下线的原因, 为空表示不是被踢下线的.
+		kickReason atomic.Pointer[string]
+		// joined 是否已经加入会话管理器.
+		joined atomic.Bool
+		// authenticated 是否已经鉴权通过 仅开启鉴权时使用, 在读取协程中读写.
+		authenticated bool
+		// replacedSession 加入时替换掉的相同key的旧会话, 由 onJoinEvent 赋值.
+		replacedSession *SessionInfo
 		// key 当前连接对应的终端唯一标识（默认是 SIM 卡号），
 		// 由 onJoinEvent 回调函数返回后赋值.
 		key string
@@ -49,8 +91,8 @@ type (
 
 	// connectionParams 连接所需的配置参数集合.
 	connectionParams struct {
-		// conn 与终端建立的 TCP 连接
-		conn *net.TCPConn
+		// conn 与终端建立的连接 TCP连接或UDP虚拟连接
+		conn net.Conn
 		// handles 信令处理.每一个连接都是独立的map, 不会影响其他的.
 		handles map[consts.JT808CommandType]Handler
 		// activeRespondHandles 主动下发，自定义处理回复相关的指令
@@ -61,51 +103,107 @@ type (
 		filter bool
 		// timeout 超时相关配置(空闲超时、首次包时间、最后包时间等).
 		timeout TerminalTimeout
+		// authenticator 终端注册和鉴权的校验 nil表示不校验.
+		authenticator Authenticator
+		// joinPolicy 终端加入的条件 nil表示第一个报文就加入.
+		joinPolicy *JoinPolicy
+		// retransmit 主动下发超时后的重传策略.
+		retransmit RetransmitPolicy
+		// metrics 监控指标.
+		metrics Metrics
+		// queue 队列大小和队列满了的处理方式.
+		queue QueueOptions
+		// rateLimit 限流配置 nil表示不限流.
+		rateLimit *RateLimit
+		// middlewares 终端上传报文的中间件.
+		middlewares []Middleware
+		// activeMiddlewares 平台主动下发的中间件.
+		activeMiddlewares []ActiveMiddleware
+		// onPanicEvent 用户回调发生 panic 的事件 可以为nil.
+		onPanicEvent func(p HandlerPanic)
+		// panicDisconnect 用户回调发生 panic 后是否断开连接.
+		panicDisconnect bool
+		// rsaPrivateKey 平台的RSA私钥 用于解密终端上传的消息体.
+		rsaPrivateKey *rsa.PrivateKey
+		// decodeOptions 终端报文的解码选项.
+		decodeOptions jt808.DecodeOptions
+		// skipDecodeError 报文解码失败时是否跳过该报文 false表示断开连接.
+		skipDecodeError bool
+		// maxBodyLength 平台下发时单个包 body最大长度 0表示默认的1000.
+		maxBodyLength int
+		// protocolVersionFunc 根据手机号指定终端的协议版本 nil表示根据报文判断.
+		protocolVersionFunc jt808.ProtocolVersionFunc
+		// certificateKeyFunc 从TLS客户端证书获取终端的key nil表示不校验.
+		certificateKeyFunc func(cert *x509.Certificate) string
+		// tracer 链路追踪.
+		tracer Tracer
 		// onTerminalTimeoutEvent 空闲超时事件，设置IdleTimeout时触发.
 		onTerminalTimeoutEvent func(timeout TerminalTimeout)
 		// 终端上线时的回调函数.
-		onJoinEvent func(message *Message, activeChan chan<- *ActiveMessage) (string, error)
+		onJoinEvent func(message *Message, c *connection) (string, error)
 		// 终端下线时的回调函数.
-		onLeaveEvent func(key string)
+		onLeaveEvent func(key string, c *connection)
 	}
 )
 
 func newConnection(params connectionParams) *connection {
-	return &connection{
+	c := &connection{
 		connectionParams: params,
 
-		finallyCompleteChan:   make(chan struct{}),           // 等待所有主动下发完成
-		terminalUplinkMsgChan: make(chan *Message, 10),       // 上行普通消息队列
-		activeMsgChan:         make(chan *ActiveMessage, 10), // 主动下发指令队列
-		activeMsgCompleteChan: make(chan *Message, 10),       // 主动下发应答通知队列
-		reissuePackChan:       make(chan *Message, 10),       // 补发包队列
+		stopChan:              make(chan struct{}),                                  // 连接关闭通知
+		finallyCompleteChan:   make(chan struct{}),                                  // write协程退出通知
+		terminalUplinkMsgChan: make(chan *Message, params.queue.uplinkSize()),       // 上行普通消息队列
+		activeMsgChan:         make(chan *ActiveMessage, params.queue.activeSize()), // 主动下发指令队列
+		pendingReplies:        make(map[uint16]*ActiveMessage),                      // 等待应答的主动下发
+		activeMsgCompleteChan: make(chan *Message, 10),                              // 主动下发应答通知队列
+		activeMsgTimeoutChan:  make(chan *ActiveMessage, 10),                        // 主动下发超时通知队列
+		activeMsgCancelChan:   make(chan *ActiveMessage, 10),                        // 主动下发取消通知队列
+		reissuePackChan:       make(chan *Message, 10),                              // 补发包队列
+
+		rateLimiter: newRateLimiter(params.rateLimit), // 限流
 
 		// 初始状态
-		platformSerialNumber: 0,        // 平台流水号从0开始
-		key:                  "",       // 终端唯一标识，注册成功后由 joinFunc 填充
-		activeUnfinishedSum:  int32(0), // 当前未完成的下发指令计数
+		key:                 "",       // 终端唯一标识，注册成功后由 joinFunc 填充
+		activeUnfinishedSum: int32(0), // 当前未完成的下发指令计数
 	}
+	c.uplinkHandler = chainMiddleware(params.middlewares, c.handleUplink)
+	c.activeHandler = chainActiveMiddleware(params.activeMiddlewares, func(activeMsg *ActiveMessage) error {
+		return nil
+	})
+	return c
 }
 
+// run 启动读写协程, 读写协程都退出后返回.
 func (c *connection) run() {
-	go c.reader()
-	go c.write()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.reader()
+	}()
+	go func() {
+		defer wg.Done()
+		c.write()
+	}()
+	wg.Wait()
 }
 
 func (c *connection) reader() {
 	var (
 		// 消息体长度最大为 10bit 也就是 1023 的字节
-		// 实际上reader相当于同步执行的 因此无需拷贝一份新的
-		// 1. onReadExecutionEvent 这里处理后在read读取因此不会污染 如果onRead事件需要的话 用户自行拷贝一份
-		// 2. 历史的图片数据是make一份新的 因此一样不会有污染
-		// 3. write异步的情况 即使污染了也不影响 因为实际用不到（仅需要已经序列化的头部)
+		// data 每次读取都复用 解析时每个报文会拷贝一份 见 packageParse.decodeFrame
+		// 因此交给 write 协程异步处理的报文不会被下一次读取污染
 		data = make([]byte, 1023)
 		pack = newPackageParse()
-		join = false
 		once sync.Once
 	)
 
+	pack.metrics = c.metrics
+	pack.decodeOptions = c.decodeOptions
+	pack.skipDecodeError = c.skipDecodeError
+	stopJoinTimer := c.startJoinTimer()
 	defer func() {
+		stopJoinTimer()
 		pack.clear()
 		c.stop()
 	}()
@@ -121,48 +219,62 @@ func (c *connection) reader() {
 			effectiveData := data[:n]
 			msgs, err := pack.parse(effectiveData) // 解析 JT808 协议包（支持分包重组）
 			if err != nil {
+				c.metrics.IncDecodeError()
 				slog.Error("parse data",
-					slog.Bool("join", join),
-					slog.Any("platform num", c.platformSerialNumber),
+					slog.Bool("join", c.joined.Load()),
+					slog.Any("platform num", uint16(c.platformSerialNumber.Load())),
 					slog.String("effective data", fmt.Sprintf("%x", effectiveData)),
 					slog.Any("err", err))
 				return
 			}
+			var wait time.Duration
+			if c.rateLimiter != nil {
+				if msgs, wait, err = c.onRateLimit(msgs, n, pack.frameReader.Pending()); err != nil {
+					slog.Warn("rate limit",
+						slog.String("key", c.key),
+						slog.String("address", c.conn.RemoteAddr().String()),
+						slog.Any("err", err))
+					return
+				}
+			}
 			if len(msgs) > 0 {
-				if !join {
-					if err := c.joinHandle(msgs[0]); err == nil {
-						join = true
-						c.timeout.Key = c.key
-					} else if errors.Is(err, _errKeyExist) {
-						slog.Warn("key",
-							slog.String("effective data", fmt.Sprintf("%x", effectiveData)),
-							slog.Any("err", err))
-						return
-					}
+				for _, msg := range msgs {
+					c.onProtocolVersion(msg)
 				}
-
 				once.Do(func() {
 					c.timeout.FirstPacketTime = time.Now()
 				})
 				c.timeout.LastPacketTime = time.Now()
-				c.handleMessages(msgs)
+				c.lastPacketTime.Store(c.timeout.LastPacketTime.UnixNano())
+				if err := c.handleMessages(msgs); err != nil {
+					slog.Warn("handle messages",
+						slog.String("key", c.key),
+						slog.String("address", c.conn.RemoteAddr().String()),
+						slog.Any("err", err))
+					return
+				}
+			}
+			if wait > 0 { // 超过限流 延迟下一次读取
+				time.Sleep(wait)
 			}
 		}
 
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) { // 读取超时,仅当设置 idleTimeout 时生效
 				if c.onTerminalTimeoutEvent != nil {
-					c.onTerminalTimeoutEvent(c.timeout)
+					c.safeCall("OnTerminalTimeoutEvent", nil, func() {
+						c.onTerminalTimeoutEvent(c.timeout)
+					})
 				}
 			} else if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
 				slog.Debug("connection close",
-					slog.Bool("join", join),
-					slog.Any("platform num", c.platformSerialNumber),
+					slog.Bool("join", c.joined.Load()),
+					slog.Any("platform num", uint16(c.platformSerialNumber.Load())),
 					slog.Any("err", err))
 			} else {
 				slog.Error("read data",
-					slog.Bool("join", join),
-					slog.Any("platform num", c.platformSerialNumber),
+					slog.Bool("join", c.joined.Load()),
+					slog.Any("platform num", uint16(c.platformSerialNumber.Load())),
 					slog.Any("err", err))
 			}
 			return
@@ -170,32 +282,97 @@ func (c *connection) reader() {
 	}
 }
 
+// onJoinFirstEvent 未设置加入策略 第一个报文就加入(开启鉴权的情况为鉴权通过后的第一个报文).
+// key已经存在或者和证书不一致的 返回错误断开连接, 其他的加入失败下一个报文再次加入.
+func (c *connection) onJoinFirstEvent(msg *Message) error {
+	err := c.joinHandle(msg)
+	if err == nil {
+		c.joined.Store(true)
+		c.timeout.Key = c.key
+		return nil
+	}
+	if errors.Is(err, _errKeyExist) || errors.Is(err, ErrCertificateKeyMismatch) {
+		slog.Warn("key",
+			slog.String("terminal data", fmt.Sprintf("%x", msg.ExtensionFields.TerminalData)),
+			slog.Any("err", err))
+		return err
+	}
+	return nil
+}
+
 func (c *connection) joinHandle(msg *Message) error {
-	key, err := c.onJoinEvent(msg, c.activeMsgChan)
+	_, span := c.tracer.Start(context.Background(), SpanJoin,
+		Attribute{Key: AttrRemoteAddress, Value: c.conn.RemoteAddr().String()},
+		commandAttr(AttrCommand, msg.Command),
+		Attribute{Key: AttrSerialNumber, Value: int(msg.ExtensionFields.TerminalSeq)})
+	key, err := c.onJoinEvent(msg, c)
 	if err == nil {
 		c.key = key
 	}
+	span.SetAttributes(Attribute{Key: AttrKey, Value: key})
+	span.End(err)
 
-	c.terminalEvent.OnJoinEvent(msg, key, err)
+	c.safeCall("TerminalEventer.OnJoinEvent", msg, func() {
+		c.terminalEvent.OnJoinEvent(msg, key, err)
+	})
+	if c.replacedSession != nil {
+		if replaceEventer, ok := c.terminalEvent.(TerminalReplaceEventer); ok {
+			c.safeCall("TerminalReplaceEventer.OnReplaceEvent", msg, func() {
+				replaceEventer.OnReplaceEvent(key, *c.replacedSession)
+			})
+		}
+	}
 	return err
 }
 
-func (c *connection) handleMessages(msgs []*Message) {
+func (c *connection) handleMessages(msgs []*Message) error {
 	for _, msg := range msgs {
 		msg.Key = c.key
+		c.startUplinkSpan(msg)
+		if ok, err := c.onDecrypt(msg); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		if handler, ok := c.handles[msg.Command]; ok {
 			msg.Handler = handler
-			if msg.Command == consts.P8003ReissueSubcontractingRequest {
-				c.reissuePackChan <- msg
-				continue
+		}
+		// 鉴权在加入之前 鉴权通过前只允许注册、鉴权和注销
+		if c.authenticator != nil {
+			if err := c.onAuthEvent(msg); err != nil {
+				c.endUplinkSpan(msg, "unauthenticated", err)
+				return err
+			}
+		}
+		if c.joinPolicy == nil && !c.joined.Load() && (c.authenticator == nil || c.authenticated) {
+			if err := c.onJoinFirstEvent(msg); err != nil {
+				c.endUplinkSpan(msg, "join fail", err)
+				return err
+			}
+			msg.Key = c.key
+		}
+		if c.joinPolicy != nil && !c.joined.Load() && !c.joinPolicy.allowBeforeJoin(msg.Command) {
+			if err := c.onRejectBeforeJoin(msg); err != nil {
+				return err
 			}
-			c.onReadExecutionEvent(msg)
-		} else {
-			c.terminalEvent.OnNotSupportedEvent(msg)
 			continue
 		}
-		c.terminalUplinkMsgChan <- msg
+		if msg.Handler != nil {
+			if c.joinPolicy != nil && !c.joined.Load() {
+				if err := c.onJoinPolicyEvent(msg); err != nil {
+					c.endUplinkSpan(msg, "join fail", err)
+					return err
+				}
+			}
+		}
+		c.onRemoteAddr()
+		c.onTerminalPublicKey(msg)
+		if err := c.onUplinkMiddleware(msg); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // write 是连接的核心处理协程，负责统一处理以下事件：
@@ -206,64 +383,149 @@ func (c *connection) handleMessages(msgs []*Message) {
 func (c *connection) write() {
 	record := map[uint16]*ActiveMessage{}
 	defer func() {
-		close(c.activeMsgChan)
-		close(c.activeMsgCompleteChan)
-		close(c.reissuePackChan)
-		close(c.terminalUplinkMsgChan)
+		close(c.finallyCompleteChan)
 		clear(record)
 		clear(c.handles)
 	}()
 
 	for {
 		select {
-		case <-c.finallyCompleteChan: // 如果现在有平台主动下发的, 需要等待完成在退出
+		case <-c.stopChan: // 连接已经关闭 终端不会再应答了 未完成的主动下发直接结束
+			c.onConnectionClosed(record)
 			return
 		case activeMsg := <-c.activeMsgChan: // 平台主动下发的
+			if err := activeMsg.context().Err(); err != nil { // 排队期间已经取消了 不再下发
+				activeMsg.replyChan <- newErrMessage(errors.Join(err,
+					fmt.Errorf("key=[%s] command=[%s]", c.key, activeMsg.Command)))
+				continue
+			}
+			if err := c.onActiveMiddleware(activeMsg); err != nil { // 中间件拒绝了 不再下发
+				activeMsg.replyChan <- newErrMessage(errors.Join(err,
+					fmt.Errorf("key=[%s] command=[%s]", c.key, activeMsg.Command)))
+				continue
+			}
 			atomic.AddInt32(&c.activeUnfinishedSum, 1)
 			c.onActiveSendEvent(activeMsg, record)
 
 		case msg := <-c.activeMsgCompleteChan: // 平台主动下发的完成情况
 			seq := msg.ExtensionFields.PlatformSeq
-			// 超时的情况一定执行一次, 如果完成了,还可能在执行一次超时的回调
 			if v, ok := record[seq]; ok {
-				c.onActiveEventComplete(msg, v)
-				delete(record, seq)
-				atomic.AddInt32(&c.activeUnfinishedSum, -1)
+				c.completeActive(seq, msg, v, record)
+			}
+
+		case activeMsg := <-c.activeMsgTimeoutChan: // 平台主动下发的超时情况
+			seq := activeMsg.ExtensionFields.PlatformSeq
+			// 已经完成的情况 定时器可能已经触发了 需要确认是同一条主动下发
+			if v, ok := record[seq]; ok && v == activeMsg {
+				c.onActiveTimeoutEvent(seq, activeMsg, record)
+			}
+
+		case activeMsg := <-c.activeMsgCancelChan: // 平台主动下发的取消情况
+			seq := activeMsg.ExtensionFields.PlatformSeq
+			if v, ok := record[seq]; ok && v == activeMsg {
+				msg := activeMsg.convertMessage
+				msg.ExtensionFields.Err = errors.Join(activeMsg.context().Err(),
+					fmt.Errorf("key=[%s] command=[%s]", c.key, activeMsg.Command))
+				c.completeActive(seq, msg, v, record)
 			}
 
 		case subPackMsg := <-c.reissuePackChan: // 分包补传的
 			c.onReissueSubcontractingEvent(subPackMsg)
+			c.endUplinkSpan(subPackMsg, "reissue", subPackMsg.ExtensionFields.Err)
 
 		case msg := <-c.terminalUplinkMsgChan: // 终端上传的
 			if len(record) > 0 && msg.hasComplete() { // 说明现在有主动的请求 等待回复中
 				if c.onActiveRespondEvent(record, msg) {
+					c.endUplinkSpan(msg, "active respond", nil)
 					continue
 				}
 			}
 			if msg.hasComplete() || !c.filter { // 默认完整包才触发回复
 				c.defaultReplyEvent(msg)
 			}
+			outcome := "no reply"
+			if msg.ExtensionFields.PlatformCommand != 0 {
+				outcome = "reply"
+			}
+			c.endUplinkSpan(msg, outcome, msg.ExtensionFields.Err)
 		}
 	}
 }
 
-// stop 执行连接关闭流程：下线通知、关闭 TCP 连接、等待未完成指令.
+// kick 平台主动断开连接, 随后 reader 协程退出并执行正常的下线流程.
+func (c *connection) kick(reason string) {
+	c.kickReason.Store(&reason)
+	if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Warn("kick conn close fail",
+			slog.String("key", c.key),
+			slog.Any("err", err))
+	}
+}
+
+// stop 执行连接关闭流程：下线通知、关闭连接、通知 write 协程结束未完成指令.
 func (c *connection) stop() {
-	c.onLeaveEvent(c.key)
-	c.terminalEvent.OnLeaveEvent(c.key)
-	if err := c.conn.Close(); err != nil {
+	if reason := c.kickReason.Load(); reason != nil {
+		slog.Info("kick",
+			slog.String("key", c.key),
+			slog.String("address", c.conn.RemoteAddr().String()),
+			slog.String("reason", *reason))
+	}
+	c.onLeaveEvent(c.key, c)
+	c.safeCall("TerminalEventer.OnLeaveEvent", nil, func() {
+		c.terminalEvent.OnLeaveEvent(c.key)
+	})
+	if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 		slog.Warn("conn close fail",
 			slog.String("key", c.key),
 			slog.Any("err", err))
 	}
-	time.Sleep(time.Second)
-	for atomic.LoadInt32(&c.activeUnfinishedSum) != 0 {
-		time.Sleep(time.Second)
+	close(c.stopChan)
+}
+
+// onConnectionClosed 连接关闭后 等待应答的和还在队列中的主动下发都以 ErrConnectionClosed 结束.
+func (c *connection) onConnectionClosed(record map[uint16]*ActiveMessage) {
+	for seq, activeMsg := range record {
+		msg := activeMsg.convertMessage
+		msg.ExtensionFields.Err = errors.Join(ErrConnectionClosed, msg.ExtensionFields.Err)
+		c.completeActive(seq, msg, activeMsg, record)
+	}
+	// 离开会话管理器后不会再有新的主动下发 这里只需要处理已经在队列中的
+	// 和还在等待放入队列的(等待的协程结束后可能刚好放入了)
+	c.drainActive()
+	c.activeWaiting.Wait()
+	c.drainActive()
+}
+
+func (c *connection) drainActive() {
+	for {
+		select {
+		case activeMsg := <-c.activeMsgChan:
+			activeMsg.replyChan <- newErrMessage(errors.Join(ErrConnectionClosed,
+				fmt.Errorf("key=[%s]", c.key)))
+		default:
+			return
+		}
+	}
+}
+
+// completeActive 结束一条主动下发 并从记录中删除.
+func (c *connection) completeActive(seq uint16, msg *Message, activeMsg *ActiveMessage,
+	record map[uint16]*ActiveMessage) {
+	if activeMsg.timer != nil {
+		activeMsg.timer.Stop()
+	}
+	if activeMsg.stopCancelFunc != nil {
+		activeMsg.stopCancelFunc()
 	}
-	close(c.finallyCompleteChan)
+	c.metrics.ObserveActiveLatency(activeMsg.Command, time.Since(activeMsg.sendTime), msg.ExtensionFields.Err)
+	c.onActiveEventComplete(msg, activeMsg)
+	delete(record, seq)
+	c.setPendingReply(seq, nil)
+	atomic.AddInt32(&c.activeUnfinishedSum, -1)
 }
 
 func (c *connection) defaultReplyEvent(msg *Message) {
+	defer c.recoverPanic("Handler.ReplyBody", msg)
 	if has := msg.HasReply(); !has {
 		return
 	}
@@ -279,13 +541,21 @@ func (c *connection) defaultReplyEvent(msg *Message) {
 	platformSeq, _ := c.allocSeq(0)
 	header.PlatformSerialNumber = platformSeq
 
-	packets := header.EncodePackets(body)
+	packets, err := c.encodePackets(header, body, c.maxBodyLength)
+	if err != nil {
+		slog.Warn("encode reply fail",
+			slog.String("key", c.key),
+			slog.Any("err", err))
+		msg.ExtensionFields.Err = errors.Join(ErrWriteDataFail, err)
+	}
 	for _, data := range packets {
 		if _, err = c.conn.Write(data); err != nil {
 			slog.Warn("write fail",
 				slog.String("data", fmt.Sprintf("%x", data)),
 				slog.Any("err", err))
 			msg.ExtensionFields.Err = errors.Join(ErrWriteDataFail, err)
+		} else {
+			c.metrics.IncMessageOut(msg.ReplyProtocol())
 		}
 		msg.ExtensionFields.PlatformData = append(msg.ExtensionFields.PlatformData, data...)
 	}
@@ -304,13 +574,14 @@ func (c *connection) onReissueSubcontractingEvent(msg *Message) {
 	original, _ := c.allocSeq(1)
 	header.PlatformSerialNumber = original
 	header.ReplyID = uint16(consts.P8003ReissueSubcontractingRequest)
-	packets := header.EncodePackets(msg.JTMessage.Body)
+	packets, err := c.encodePackets(header, msg.JTMessage.Body, c.maxBodyLength)
 
-	if len(packets) != 1 { // 分包补传的报文固定大小，不会分包
+	if err != nil || len(packets) != 1 { // 分包补传的报文固定大小，不会分包
 		slog.Warn("onReissueSubcontractingEvent",
 			slog.String("key", c.key),
 			slog.Int("packets", len(packets)),
-			slog.Any("data", fmt.Sprintf("%x", msg.JTMessage.Body)))
+			slog.Any("data", fmt.Sprintf("%x", msg.JTMessage.Body)),
+			slog.Any("err", err))
 		return
 	}
 
@@ -320,6 +591,8 @@ func (c *connection) onReissueSubcontractingEvent(msg *Message) {
 			slog.String("data", fmt.Sprintf("%x", data)),
 			slog.Any("err", err))
 		msg.ExtensionFields.Err = errors.Join(ErrWriteDataFail, err)
+	} else {
+		c.metrics.IncMessageOut(consts.P8003ReissueSubcontractingRequest)
 	}
 
 	msg.ExtensionFields.PlatformSeq = original
@@ -338,7 +611,9 @@ func (c *connection) onActiveSendEvent(activeMsg *ActiveMessage, record map[uint
 		replyMsg.Handler = v
 		c.onReadExecutionEvent(replyMsg)
 	} else {
-		c.terminalEvent.OnNotSupportedEvent(replyMsg)
+		c.safeCall("TerminalEventer.OnNotSupportedEvent", replyMsg, func() {
+			c.terminalEvent.OnNotSupportedEvent(replyMsg)
+		})
 	}
 	activeMsg.ExtensionFields = struct {
 		PlatformSeq uint16 `json:"platformSeq,omitempty"`
@@ -349,26 +624,61 @@ func (c *connection) onActiveSendEvent(activeMsg *ActiveMessage, record map[uint
 	}
 
 	activeMsg.convertMessage = replyMsg
+	activeMsg.sendTime = time.Now()
+	activeMsg.trace().SetAttributes(Attribute{Key: AttrPlatformSerialNumber, Value: int(platformSeq)})
+	activeMsg.trace().AddEvent("write", Attribute{Key: "jt808.data_length", Value: len(data)})
 	record[platformSeq] = activeMsg
+	c.setPendingReply(platformSeq, activeMsg)
 	if err != nil {
 		c.activeMsgCompleteChan <- replyMsg
 	} else {
-		duration := 3 * time.Second
-		if activeMsg.OverTimeDuration > 0 {
-			duration = activeMsg.OverTimeDuration
-		}
-		go func(overtimeMsg *Message, timeout time.Duration) {
-			time.Sleep(timeout)
+		activeMsg.currentOverTime = activeMsg.overTime()
+		activeMsg.timer = time.AfterFunc(activeMsg.currentOverTime, func() {
 			select {
+			case c.activeMsgTimeoutChan <- activeMsg:
+			case <-c.finallyCompleteChan:
+			}
+		})
+		// 调用方取消后立即结束等待 释放 record 中的记录
+		activeMsg.stopCancelFunc = context.AfterFunc(activeMsg.context(), func() {
+			select {
+			case c.activeMsgCancelChan <- activeMsg:
 			case <-c.finallyCompleteChan:
-				return
-			default:
 			}
-			overtimeMsg.ExtensionFields.Err = errors.Join(ErrWriteDataOverTime,
-				fmt.Errorf("overtime is [%.2f]second", timeout.Seconds()))
-			c.activeMsgCompleteChan <- overtimeMsg
-		}(replyMsg, duration)
+		})
+	}
+}
+
+// onActiveTimeoutEvent 主动下发超时 还有重传次数的情况使用相同的流水号重新下发
+// 否则以 ErrWriteDataOverTime 结束.
+func (c *connection) onActiveTimeoutEvent(seq uint16, activeMsg *ActiveMessage, record map[uint16]*ActiveMessage) {
+	msg := activeMsg.convertMessage
+	overTime, ok := activeMsg.nextOverTime(c.retransmit)
+	if !ok {
+		c.metrics.IncActiveOverTime(activeMsg.Command)
+		msg.ExtensionFields.Err = errors.Join(ErrWriteDataOverTime,
+			fmt.Errorf("overtime is [%.2f]second retransmit [%d]",
+				activeMsg.currentOverTime.Seconds(), activeMsg.retransmitSum))
+		c.completeActive(seq, msg, activeMsg, record)
+		return
+	}
+	activeMsg.trace().AddEvent("retransmit",
+		Attribute{Key: "jt808.retransmit", Value: activeMsg.retransmitSum},
+		Attribute{Key: "jt808.overtime", Value: overTime.String()})
+	slog.Debug("active retransmit",
+		slog.String("key", c.key),
+		slog.Any("seq", seq),
+		slog.Int("retransmit", activeMsg.retransmitSum),
+		slog.Duration("overtime", overTime))
+	for _, data := range activeMsg.packets {
+		if _, err := c.conn.Write(data); err != nil {
+			msg.ExtensionFields.Err = errors.Join(ErrWriteDataFail, err)
+			c.completeActive(seq, msg, activeMsg, record)
+			return
+		}
+		c.metrics.IncMessageOut(activeMsg.Command)
 	}
+	activeMsg.timer.Reset(overTime)
 }
 
 func (c *connection) activeWritePackets(activeMsg *ActiveMessage) (*jt808.JTMessage, []byte, error) {
@@ -381,11 +691,17 @@ func (c *connection) activeWritePackets(activeMsg *ActiveMessage) (*jt808.JTMess
 	platformSeq, _ := c.allocSeq(0)
 	header.PlatformSerialNumber = platformSeq
 	header.ReplyID = uint16(activeMsg.Command)
-	packets := header.EncodePackets(activeMsg.Body)
+	packets, err := c.encodePackets(header, activeMsg.Body, activeMsg.maxBodyLength(c.maxBodyLength))
+	if err != nil {
+		writeErr = errors.Join(ErrWriteDataFail, err)
+	}
+	activeMsg.packets = packets
 
 	for _, data := range packets {
 		if _, err := c.conn.Write(data); err != nil {
 			writeErr = errors.Join(ErrWriteDataFail, err)
+		} else {
+			c.metrics.IncMessageOut(activeMsg.Command)
 		}
 		if err := jtMsg.Decode(data); err == nil {
 			platformData = append(platformData, jtMsg.Body...)
@@ -395,6 +711,11 @@ func (c *connection) activeWritePackets(activeMsg *ActiveMessage) (*jt808.JTMess
 	if len(packets) > 0 {
 		_ = jtMsg.Decode(platformData)
 	}
+	if jtMsg.Header.Property.EncryptMethod == jt808.EncryptMethodRSA { // 加密的情况 记录加密前的数据
+		platformData = activeMsg.Body
+		jtMsg.Body = activeMsg.Body
+		jtMsg.Header.Property.EncryptMethod = 0
+	}
 	_, _ = c.allocSeq(len(packets))
 	return jtMsg, platformData, writeErr
 }
@@ -403,7 +724,16 @@ func (c *connection) onActiveRespondEvent(record map[uint16]*ActiveMessage, term
 	matchFunc, ok := c.activeRespondHandles[terminalMsg.Command]
 	if ok {
 		for seq, platformMessage := range record {
-			if matchFunc(platformMessage, terminalMsg) {
+			matched := false
+			if c.safeCall("ActiveRespondHandler", terminalMsg, func() {
+				matched = matchFunc(platformMessage, terminalMsg)
+			}) {
+				return false
+			}
+			if matched {
+				platformMessage.trace().AddEvent("respond",
+					commandAttr(AttrCommand, terminalMsg.Command),
+					Attribute{Key: AttrSerialNumber, Value: int(terminalMsg.ExtensionFields.TerminalSeq)})
 				terminalMsg.ExtensionFields.PlatformSeq = seq
 				terminalMsg.ExtensionFields.TerminalCommand = terminalMsg.Protocol()
 				c.activeMsgCompleteChan <- terminalMsg
@@ -438,9 +768,12 @@ func (c *connection) onReadExecutionEvent(msg *Message) {
 			slog.String("read", msg.Header.String()))
 		return
 	}
-	msg.Handler.OnReadExecutionEvent(msg)
-
-	c.terminalEvent.OnReadExecutionEvent(msg)
+	c.safeCall("Handler.OnReadExecutionEvent", msg, func() {
+		msg.Handler.OnReadExecutionEvent(msg)
+	})
+	c.safeCall("TerminalEventer.OnReadExecutionEvent", msg, func() {
+		c.terminalEvent.OnReadExecutionEvent(msg)
+	})
 }
 
 func (c *connection) onWriteExecutionEvent(msg *Message) {
@@ -452,13 +785,15 @@ func (c *connection) onWriteExecutionEvent(msg *Message) {
 			slog.String("write", msg.Header.String()))
 		return
 	}
-	msg.Handler.OnWriteExecutionEvent(*msg)
-
-	c.terminalEvent.OnWriteExecutionEvent(*msg)
+	c.safeCall("Handler.OnWriteExecutionEvent", msg, func() {
+		msg.Handler.OnWriteExecutionEvent(*msg)
+	})
+	c.safeCall("TerminalEventer.OnWriteExecutionEvent", msg, func() {
+		c.terminalEvent.OnWriteExecutionEvent(*msg)
+	})
 }
 
 func (c *connection) allocSeq(n int) (uint16, uint16) {
-	original := c.platformSerialNumber
-	c.platformSerialNumber += uint16(n)
-	return original, c.platformSerialNumber
+	end := c.platformSerialNumber.Add(uint32(n))
+	return uint16(end - uint32(n)), uint16(end)
 }
@@ -1,11 +1,38 @@
 package service
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/proxyproto"
+)
 
 var (
 	ErrWriteDataFail     = errors.New("write data fail")
 	ErrWriteDataOverTime = errors.New("write data is overtime")
 	ErrNotExistKey       = errors.New("key not exist")
+	ErrConnectionClosed  = errors.New("connection closed")
+	ErrServerClosed      = errors.New("server closed")
+	// ErrOfflineMessageQueued 终端不在线 指令已经保存为离线指令 见 WithOfflineQueue.
+	ErrOfflineMessageQueued = errors.New("offline message queued")
+	// ErrOfflineMessageExpired 离线指令过期了 终端仍未上线.
+	ErrOfflineMessageExpired = errors.New("offline message expired")
+	// ErrUnauthenticated 开启鉴权后 终端鉴权通过前发送了业务报文 见 WithAuthenticator.
+	ErrUnauthenticated = errors.New("terminal unauthenticated")
+	// ErrQueueOverflow 终端上传报文的队列满了 使用 OverflowDisconnect 时断开连接,
+	// 平台主动下发的队列满了的情况 该指令返回此错误.
+	ErrQueueOverflow = errors.New("queue overflow")
+	// ErrRateLimited 终端发送的报文超过限流 使用 RateLimitDisconnect 时断开连接.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrCertificateKeyMismatch 终端的key和TLS客户端证书不一致(或者不是TLS连接) 见 WithCertificateKeyFunc.
+	ErrCertificateKeyMismatch = errors.New("certificate key mismatch")
+	// ErrProxyHeaderInvalid PROXY protocol 头部错误或者缺失 见 WithProxyProtocol.
+	ErrProxyHeaderInvalid = proxyproto.ErrHeaderInvalid
+	// ErrHandlerPanic 平台主动下发的中间件发生了 panic 不再下发 见 WithHandlerPanic.
+	ErrHandlerPanic = errors.New("handler panic")
+	// ErrForwardFail 转发到终端所在的节点失败 见 WithCluster.
+	ErrForwardFail = errors.New("forward fail")
+	// ErrClusterAuth 节点之间转发的认证失败 或者没有配置认证 见 NewTCPTransport.
+	ErrClusterAuth = errors.New("cluster auth fail")
 )
 
 var (
@@ -8,3 +8,8 @@ require (
 )
 
 require golang.org/x/text v0.26.0 // indirect
+
+replace (
+	github.com/cuteLittleDevil/go-jt808/protocol => ../protocol
+	github.com/cuteLittleDevil/go-jt808/shared => ../shared
+)
@@ -3,6 +3,7 @@ package service
 import (
 	"fmt"
 	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
 	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 	"log/slog"
 	"time"
@@ -29,6 +30,15 @@ type (
 		Eventer
 	}
 
+	// TerminalReplaceEventer 可选的终端事件, TerminalEventer 同时实现该接口时生效.
+	// 配合 WithDuplicateKeyPolicy 使用.
+	TerminalReplaceEventer interface {
+		// OnReplaceEvent 相同 key 的终端重新连接, 旧连接被关闭并替换时触发.
+		// 由新连接的事件处理器触发, 在 OnJoinEvent 之后, old 为被替换的旧会话.
+		// 旧连接仍会正常触发自己的 OnLeaveEvent.
+		OnReplaceEvent(key string, old SessionInfo)
+	}
+
 	Eventer interface {
 		// OnReadExecutionEvent 读事件触发时机：
 		//   1. 终端主动上传报文并完成Parse后，如0x0200位置信息
@@ -64,6 +74,24 @@ func (d *defaultHandle) OnWriteExecutionEvent(_ Message) {
 	//fmt.Println(fmt.Sprintf("write %x", message.ReplyData))
 }
 
+// failReplyHandle 不做处理的报文 回复通用应答失败, 如加入前和超过限流的报文.
+type failReplyHandle struct {
+	model.BaseHandle
+	command consts.JT808CommandType
+}
+
+func (f *failReplyHandle) Protocol() consts.JT808CommandType {
+	return f.command
+}
+
+func (f *failReplyHandle) ReplyBody(jtMsg *jt808.JTMessage) ([]byte, error) {
+	return (&model.P0x8001{
+		RespondSerialNumber: jtMsg.Header.SerialNumber,
+		RespondID:           jtMsg.Header.ID,
+		Result:              1, // 0-成功 1-失败
+	}).Encode(), nil
+}
+
 type defaultTerminalEvent struct {
 	createTime time.Time
 }
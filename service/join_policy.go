@@ -0,0 +1,126 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// BeforeJoinAction 终端加入前收到其他报文的处理方式.
+type BeforeJoinAction int
+
+const (
+	// BeforeJoinReplyFail 回复通用应答(0x8001) 结果为失败(默认).
+	BeforeJoinReplyFail BeforeJoinAction = iota
+	// BeforeJoinDrop 直接丢弃 不回复.
+	BeforeJoinDrop
+)
+
+func (b BeforeJoinAction) String() string {
+	switch b {
+	case BeforeJoinReplyFail:
+		return "回复失败"
+	case BeforeJoinDrop:
+		return "丢弃"
+	}
+	return "未知处理方式"
+}
+
+// JoinPolicy 终端加入会话管理器的条件, 见 WithJoinPolicy.
+// 加入后才可以接收平台主动下发的指令, 才会触发 OnJoinEvent.
+type JoinPolicy struct {
+	// Commands 可以触发加入的指令 默认只有0x0102鉴权成功后加入.
+	// 0x0102 的情况需要鉴权成功, 鉴权码的校验使用 WithAuthenticator 设置的,
+	// 没有设置的情况鉴权码等于手机号为成功 和默认的0x0102处理一致.
+	Commands []consts.JT808CommandType
+	// Action 加入前收到 Commands 和注册鉴权(0x0100 0x0102)以外的报文的处理方式
+	Action BeforeJoinAction
+	// Timeout 连接建立后超过该时间还未加入 关闭连接 <=0表示不限制
+	Timeout time.Duration
+}
+
+// allowBeforeJoin 加入前可以正常处理的指令.
+func (j *JoinPolicy) allowBeforeJoin(command consts.JT808CommandType) bool {
+	switch command {
+	case consts.T0100Register, consts.T0102RegisterAuth, consts.T0001GeneralRespond:
+		return true
+	}
+	return slices.Contains(j.Commands, command)
+}
+
+// canJoin 该指令是否可以触发加入.
+func (j *JoinPolicy) canJoin(command consts.JT808CommandType) bool {
+	if len(j.Commands) == 0 {
+		return command == consts.T0102RegisterAuth
+	}
+	return slices.Contains(j.Commands, command)
+}
+
+// startJoinTimer 设置了加入超时的情况 超时还未加入就关闭连接. 返回的函数用于停止定时器.
+func (c *connection) startJoinTimer() func() {
+	if c.joinPolicy == nil || c.joinPolicy.Timeout <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(c.joinPolicy.Timeout, func() {
+		if !c.joined.Load() {
+			c.kick(fmt.Sprintf("not joined within [%s]", c.joinPolicy.Timeout))
+		}
+	})
+	return func() {
+		timer.Stop()
+	}
+}
+
+// onJoinPolicyEvent 设置了加入策略的情况 满足条件的报文触发加入. 在读取协程中执行.
+func (c *connection) onJoinPolicyEvent(msg *Message) error {
+	if !c.joinPolicy.canJoin(msg.Command) {
+		return nil
+	}
+	if msg.Command == consts.T0102RegisterAuth {
+		if c.authenticator == nil {
+			c.authenticated = defaultAuth(msg.JTMessage)
+		}
+		if !c.authenticated {
+			return nil
+		}
+	}
+	if err := c.joinHandle(msg); err != nil {
+		if errors.Is(err, _errKeyExist) || errors.Is(err, ErrCertificateKeyMismatch) {
+			return err
+		}
+		return nil
+	}
+	c.joined.Store(true)
+	c.timeout.Key = c.key
+	msg.Key = c.key
+	return nil
+}
+
+// onRejectBeforeJoin 加入前收到的其他报文 按照 JoinPolicy.Action 回复失败或者丢弃.
+func (c *connection) onRejectBeforeJoin(msg *Message) error {
+	slog.Debug("before join",
+		slog.String("address", c.conn.RemoteAddr().String()),
+		slog.String("command", msg.Command.String()),
+		slog.String("action", c.joinPolicy.Action.String()))
+	if c.joinPolicy.Action == BeforeJoinDrop {
+		c.endUplinkSpan(msg, "dropped", nil)
+		return nil
+	}
+	msg.Handler = newDefaultHandle(&failReplyHandle{command: msg.Command})
+	return c.pushUplink(msg)
+}
+
+// defaultAuth 默认的鉴权 鉴权码等于手机号为成功.
+func defaultAuth(jtMsg *jt808.JTMessage) bool {
+	auth := &model.T0x0102{}
+	if err := auth.Parse(jtMsg); err != nil {
+		return false
+	}
+	return auth.AuthCode == jtMsg.Header.TerminalPhoneNo
+}
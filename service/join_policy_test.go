@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func TestService_joinPolicyRequireAuth(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithJoinPolicy(JoinPolicy{}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 1 {
+		t.Fatalf("heartbeat before join result = %d, want 1", got)
+	}
+	if _, err := conn.Write(encodeAuthPacket(t, "wrong", 2)); err != nil {
+		t.Fatalf("Write 0x0102 error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 1 {
+		t.Fatalf("wrong auth result = %d, want 1", got)
+	}
+	if got := g.OnlineCount(); got != 0 {
+		t.Fatalf("OnlineCount() before auth = %d, want 0", got)
+	}
+
+	// 没有设置 Authenticator 鉴权码等于手机号为成功
+	if _, err := conn.Write(encodeAuthPacket(t, "12345678901", 3)); err != nil {
+		t.Fatalf("Write 0x0102 error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 0 {
+		t.Fatalf("auth result = %d, want 0", got)
+	}
+	if key := waitChan(t, events.joined, 2*time.Second); key != "12345678901" {
+		t.Fatalf("join key = %s, want 12345678901", key)
+	}
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 0 {
+		t.Fatalf("heartbeat after join result = %d, want 0", got)
+	}
+}
+
+func TestService_joinPolicyDropAndTimeout(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	_, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithJoinPolicy(JoinPolicy{Action: BeforeJoinDrop, Timeout: 300 * time.Millisecond}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() dropped heartbeat error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// 超时还未加入 连接被关闭
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(buf); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() after join timeout error = %v, want connection closed", err)
+	}
+	select {
+	case key := <-events.joined:
+		t.Fatalf("unexpected join: %s", key)
+	default:
+	}
+}
+
+func TestService_joinPolicyCommands(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	_, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithJoinPolicy(JoinPolicy{Commands: []consts.JT808CommandType{consts.T0002HeartBeat}}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 0 {
+		t.Fatalf("heartbeat result = %d, want 0", got)
+	}
+	if key := waitChan(t, events.joined, 2*time.Second); key != "12345678901" {
+		t.Fatalf("join key = %s, want 12345678901", key)
+	}
+}
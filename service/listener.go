@@ -0,0 +1,64 @@
+package service
+
+import (
+	"crypto/tls"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// Listener 一个监听地址, 见 WithListeners.
+// 所有的地址共用一个会话管理, SendActiveMessage 等不区分终端连接的是哪个地址.
+type Listener struct {
+	// Addr 监听地址 如0.0.0.0:7808
+	Addr string
+	// Network 协议 默认tcp 支持udp
+	Network string
+	// TLSConfig TLS配置 nil表示不使用TLS 仅TCP有效
+	TLSConfig *tls.Config
+	// ProxyProtocol 解析 PROXY protocol 头部 nil表示不解析 仅TCP有效
+	ProxyProtocol *ProxyProtocol
+	// CustomHandleFunc 该地址的消息处理 覆盖 WithCustomHandleFunc 中相同指令的 可以为nil
+	CustomHandleFunc func() map[consts.JT808CommandType]Handler
+	// CustomTerminalEventerFunc 该地址的终端事件 nil的情况使用 WithCustomTerminalEventer 的
+	CustomTerminalEventerFunc func() TerminalEventer
+}
+
+func (l *Listener) network() string {
+	if l.Network == "" {
+		return defaultNetwork
+	}
+	return l.Network
+}
+
+// commandHandle 在全局的消息处理上 覆盖该地址自定义的.
+func (l *Listener) commandHandle(handles map[consts.JT808CommandType]Handler) map[consts.JT808CommandType]Handler {
+	if l.CustomHandleFunc == nil {
+		return handles
+	}
+	for k, v := range l.CustomHandleFunc() {
+		handles[k] = v
+	}
+	return handles
+}
+
+func (l *Listener) terminalEventer(opts *Options) TerminalEventer {
+	if l.CustomTerminalEventerFunc != nil {
+		return l.CustomTerminalEventerFunc()
+	}
+	return opts.CustomTerminalEventerFunc()
+}
+
+// listeners 主地址(Addr、Network、TLSConfig、ProxyProtocol)和 WithListeners 设置的其他地址.
+func (o *Options) listeners() []*Listener {
+	listeners := make([]*Listener, 0, 1+len(o.Listeners))
+	listeners = append(listeners, &Listener{
+		Addr:          o.Addr,
+		Network:       o.Network,
+		TLSConfig:     o.TLSConfig,
+		ProxyProtocol: o.ProxyProtocol,
+	})
+	for i := range o.Listeners {
+		listeners = append(listeners, &o.Listeners[i])
+	}
+	return listeners
+}
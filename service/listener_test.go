@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().String()
+}
+
+func TestService_listeners(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	extra := freeAddr(t)
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithListeners(Listener{
+			Addr: extra,
+			CustomHandleFunc: func() map[consts.JT808CommandType]Handler {
+				return map[consts.JT808CommandType]Handler{
+					consts.T0002HeartBeat: newDefaultHandle(&failReplyHandle{command: consts.T0002HeartBeat}),
+				}
+			},
+		}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, extra)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	// 该地址的心跳处理覆盖了全局的
+	if result := readGeneralRespondResult(t, conn); result != 1 {
+		t.Fatalf("extra listener heartbeat result = %d, want 1", result)
+	}
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	// 主地址使用全局的处理 且和其他地址共用会话 相同的key不能重复加入
+	main := dialTerminal(t, addr)
+	if _, err := main.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	waitClosed(t, main)
+
+	go func() {
+		platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P9101RealTimeAudioVideoRequest, 2)
+		if _, err := conn.Write(resp); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}()
+	reply := g.SendActiveMessage(NewActiveMessage(key, consts.P9101RealTimeAudioVideoRequest, nil, time.Second))
+	if reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+	}
+}
+
+func TestService_listenersListenFail(t *testing.T) {
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer func() { _ = used.Close() }()
+
+	addr := freeAddr(t)
+	g := New(WithHostPorts(addr), WithListeners(Listener{Addr: used.Addr().String()}))
+	if err := g.RunContext(context.Background()); err == nil {
+		t.Fatal("RunContext() error = nil, want listen error")
+	}
+	// 已经开始的主地址也关闭了
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatalf("Dial(%s) succeeded after listen fail", addr)
+	}
+}
@@ -9,6 +9,8 @@ import (
 type Message struct {
 	*jt808.JTMessage
 	Handler `json:"-"`
+	// span 终端上传报文的追踪 见 WithTracer
+	span Span
 	// Key 唯一标识符 默认手机号 终端未加入的时候为空
 	Key string `json:"key"`
 	// Command 当前的指令类型
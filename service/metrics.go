@@ -0,0 +1,223 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// Metrics 服务的监控指标, 见 WithMetrics.
+// 方法在会话管理协程和连接的读写协程中调用 实现需要保证并发安全并且不能阻塞.
+type Metrics interface {
+	// SetOnlineSessions 当前在线的终端数量 终端加入或者离开后触发
+	SetOnlineSessions(sum int)
+	// IncMessageIn 收到终端的一个报文 分包的情况每一个分包都算
+	IncMessageIn(command consts.JT808CommandType)
+	// IncMessageOut 平台下发的一个报文 包括回复、主动下发、重传和分包补传
+	IncMessageOut(command consts.JT808CommandType)
+	// IncDecodeError 终端的报文解析失败
+	IncDecodeError()
+	// IncSubPackageTimeout 分包超时还未完成 被丢弃了
+	IncSubPackageTimeout(command consts.JT808CommandType)
+	// ObserveActiveLatency 主动下发从发送到结束(应答、超时或取消)的耗时
+	ObserveActiveLatency(command consts.JT808CommandType, latency time.Duration, err error)
+	// IncActiveOverTime 主动下发最终超时 即 ErrWriteDataOverTime
+	IncActiveOverTime(command consts.JT808CommandType)
+	// IncQueueOverflow 终端上传报文的队列满了 command 为被丢弃(或等待放入)的报文指令
+	IncQueueOverflow(command consts.JT808CommandType)
+}
+
+// nopMetrics 默认的监控指标 不做任何处理.
+type nopMetrics struct{}
+
+func (nopMetrics) SetOnlineSessions(_ int)                                                  {}
+func (nopMetrics) IncMessageIn(_ consts.JT808CommandType)                                   {}
+func (nopMetrics) IncMessageOut(_ consts.JT808CommandType)                                  {}
+func (nopMetrics) IncDecodeError()                                                          {}
+func (nopMetrics) IncSubPackageTimeout(_ consts.JT808CommandType)                           {}
+func (nopMetrics) ObserveActiveLatency(_ consts.JT808CommandType, _ time.Duration, _ error) {}
+func (nopMetrics) IncActiveOverTime(_ consts.JT808CommandType)                              {}
+func (nopMetrics) IncQueueOverflow(_ consts.JT808CommandType)                               {}
+
+// defaultLatencyBuckets 主动下发耗时直方图的默认区间 单位秒.
+var defaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// PrometheusMetrics 使用 Prometheus 文本格式输出的监控指标, 不依赖外部服务.
+// 同时实现了 http.Handler, 可以直接注册到 /metrics.
+// command 标签为指令的十六进制 如0x0200, 没有定义的指令统一为 other.
+//
+// 使用示例：
+//
+//	metrics := service.NewPrometheusMetrics()
+//	http.Handle("/metrics", metrics)
+//	goJt808 := service.New(service.WithMetrics(metrics))
+type PrometheusMetrics struct {
+	mu                sync.Mutex
+	buckets           []float64
+	onlineSessions    int
+	messageIn         map[string]uint64
+	messageOut        map[string]uint64
+	decodeError       uint64
+	subPackageTimeout map[string]uint64
+	activeLatency     map[string]*histogram
+	activeOverTime    map[string]uint64
+	queueOverflow     map[string]uint64
+}
+
+// histogram 累计的直方图 counts[i] 为小于等于 buckets[i] 的数量.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusMetrics 创建 Prometheus 文本格式的监控指标.
+// buckets 为主动下发耗时直方图的区间(秒) 为空使用默认的 0.05秒到60秒.
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = defaultLatencyBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &PrometheusMetrics{
+		buckets:           buckets,
+		messageIn:         make(map[string]uint64),
+		messageOut:        make(map[string]uint64),
+		subPackageTimeout: make(map[string]uint64),
+		activeLatency:     make(map[string]*histogram),
+		activeOverTime:    make(map[string]uint64),
+		queueOverflow:     make(map[string]uint64),
+	}
+}
+
+func (p *PrometheusMetrics) SetOnlineSessions(sum int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onlineSessions = sum
+}
+
+func (p *PrometheusMetrics) IncMessageIn(command consts.JT808CommandType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messageIn[commandLabel(command)]++
+}
+
+func (p *PrometheusMetrics) IncMessageOut(command consts.JT808CommandType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messageOut[commandLabel(command)]++
+}
+
+func (p *PrometheusMetrics) IncDecodeError() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.decodeError++
+}
+
+func (p *PrometheusMetrics) IncSubPackageTimeout(command consts.JT808CommandType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subPackageTimeout[commandLabel(command)]++
+}
+
+func (p *PrometheusMetrics) ObserveActiveLatency(command consts.JT808CommandType, latency time.Duration, _ error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	label := commandLabel(command)
+	h, ok := p.activeLatency[label]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(p.buckets))}
+		p.activeLatency[label] = h
+	}
+	seconds := latency.Seconds()
+	for i, bucket := range p.buckets {
+		if seconds <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (p *PrometheusMetrics) IncActiveOverTime(command consts.JT808CommandType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.activeOverTime[commandLabel(command)]++
+}
+
+func (p *PrometheusMetrics) IncQueueOverflow(command consts.JT808CommandType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queueOverflow[commandLabel(command)]++
+}
+
+// ServeHTTP 以 Prometheus 文本格式输出全部指标.
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = p.WriteTo(w)
+}
+
+// WriteTo 以 Prometheus 文本格式输出全部指标到 w.
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	p.mu.Lock()
+	writeHelp(&sb, "jt808_online_sessions", "gauge", "当前在线的终端数量")
+	fmt.Fprintf(&sb, "jt808_online_sessions %d\n", p.onlineSessions)
+	writeCommandCounter(&sb, "jt808_messages_in_total", "收到终端的报文数量", p.messageIn)
+	writeCommandCounter(&sb, "jt808_messages_out_total", "平台下发的报文数量", p.messageOut)
+	writeHelp(&sb, "jt808_decode_errors_total", "counter", "终端报文解析失败的数量")
+	fmt.Fprintf(&sb, "jt808_decode_errors_total %d\n", p.decodeError)
+	writeCommandCounter(&sb, "jt808_subpackage_timeouts_total", "分包超时未完成的数量", p.subPackageTimeout)
+	p.writeActiveLatency(&sb)
+	writeCommandCounter(&sb, "jt808_active_message_overtime_total", "主动下发最终超时的数量", p.activeOverTime)
+	writeCommandCounter(&sb, "jt808_queue_overflow_total", "终端上传报文的队列满了的次数", p.queueOverflow)
+	p.mu.Unlock()
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (p *PrometheusMetrics) writeActiveLatency(sb *strings.Builder) {
+	const name = "jt808_active_message_duration_seconds"
+	writeHelp(sb, name, "histogram", "主动下发从发送到结束的耗时")
+	for _, command := range slices.Sorted(maps.Keys(p.activeLatency)) {
+		h := p.activeLatency[command]
+		label := fmt.Sprintf("command=\"%s\"", command)
+		for i, bucket := range p.buckets {
+			fmt.Fprintf(sb, "%s_bucket{%s,le=\"%s\"} %d\n", name, label,
+				strconv.FormatFloat(bucket, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(sb, "%s_sum{%s} %s\n", name, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(sb, "%s_count{%s} %d\n", name, label, h.count)
+	}
+}
+
+func writeHelp(sb *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCommandCounter(sb *strings.Builder, name string, help string, record map[string]uint64) {
+	writeHelp(sb, name, "counter", help)
+	for _, command := range slices.Sorted(maps.Keys(record)) {
+		fmt.Fprintf(sb, "%s{command=\"%s\"} %d\n", name, command, record[command])
+	}
+}
+
+// otherCommandLabel 没有定义的指令统一使用的标签.
+// 指令来自终端的报文头 按原值做标签的话 终端可以让标签数量无限增长.
+const otherCommandLabel = "other"
+
+func commandLabel(command consts.JT808CommandType) string {
+	if !command.Known() {
+		return otherCommandLabel
+	}
+	return fmt.Sprintf("0x%04x", uint16(command))
+}
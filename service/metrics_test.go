@@ -0,0 +1,129 @@
+package service
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func TestPrometheusMetrics_writeTo(t *testing.T) {
+	metrics := NewPrometheusMetrics(0.1, 1)
+	metrics.SetOnlineSessions(2)
+	metrics.IncMessageIn(consts.T0200LocationReport)
+	metrics.IncMessageIn(consts.T0200LocationReport)
+	metrics.IncMessageOut(consts.P8001GeneralRespond)
+	metrics.IncDecodeError()
+	metrics.IncSubPackageTimeout(consts.T0801MultimediaDataUpload)
+	metrics.ObserveActiveLatency(consts.P8300TextInfoDistribution, 50*time.Millisecond, nil)
+	metrics.ObserveActiveLatency(consts.P8300TextInfoDistribution, 3*time.Second, ErrWriteDataOverTime)
+	metrics.IncActiveOverTime(consts.P8300TextInfoDistribution)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"# TYPE jt808_online_sessions gauge",
+		"jt808_online_sessions 2\n",
+		`jt808_messages_in_total{command="0x0200"} 2`,
+		`jt808_messages_out_total{command="0x8001"} 1`,
+		"jt808_decode_errors_total 1\n",
+		`jt808_subpackage_timeouts_total{command="0x0801"} 1`,
+		"# TYPE jt808_active_message_duration_seconds histogram",
+		`jt808_active_message_duration_seconds_bucket{command="0x8300",le="0.1"} 1`,
+		`jt808_active_message_duration_seconds_bucket{command="0x8300",le="1"} 1`,
+		`jt808_active_message_duration_seconds_bucket{command="0x8300",le="+Inf"} 2`,
+		`jt808_active_message_duration_seconds_count{command="0x8300"} 2`,
+		`jt808_active_message_overtime_total{command="0x8300"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q\n%s", want, body)
+		}
+	}
+}
+
+func TestPrometheusMetrics_otherCommand(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	// 终端发送的未定义指令 不能让标签数量无限增长
+	for command := consts.JT808CommandType(0xF000); command < 0xF100; command++ {
+		metrics.IncMessageIn(command)
+		metrics.IncQueueOverflow(command)
+	}
+	metrics.IncMessageIn(consts.T0002HeartBeat)
+	metrics.ObserveActiveLatency(0xF001, time.Second, nil)
+
+	var sb strings.Builder
+	_, _ = metrics.WriteTo(&sb)
+	body := sb.String()
+	for _, want := range []string{
+		`jt808_messages_in_total{command="0x0002"} 1`,
+		`jt808_messages_in_total{command="other"} 256`,
+		`jt808_queue_overflow_total{command="other"} 256`,
+		`jt808_active_message_duration_seconds_count{command="other"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "0xf0") {
+		t.Errorf("metrics has unknown command label\n%s", body)
+	}
+}
+
+func TestService_metrics(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	metrics := NewPrometheusMetrics()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithMetrics(metrics),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	go func() {
+		_ = readPacket(t, conn, 2*time.Second)
+	}()
+	reply := g.SendActiveMessage(NewActiveMessage(key, consts.P8201QueryLocation, nil, 100*time.Millisecond))
+	if reply.ExtensionFields.Err == nil {
+		t.Fatal("SendActiveMessage() want overtime")
+	}
+
+	var sb strings.Builder
+	if _, err := metrics.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	body := sb.String()
+	for _, want := range []string{
+		"jt808_online_sessions 1\n",
+		`jt808_messages_in_total{command="0x0002"} 1`,
+		`jt808_messages_out_total{command="0x8001"} 1`,
+		`jt808_messages_out_total{command="0x8201"} 1`,
+		`jt808_active_message_duration_seconds_count{command="0x8201"} 1`,
+		`jt808_active_message_overtime_total{command="0x8201"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q\n%s", want, body)
+		}
+	}
+
+	// 解析失败后断开连接 在线数量变为0
+	if _, err := conn.Write([]byte{0x7e, 0x00, 0x02, 0x7e}); err != nil {
+		t.Fatalf("Write invalid data error = %v", err)
+	}
+	_ = waitChan(t, events.left, 2*time.Second)
+	waitFor(t, time.Second, func() bool {
+		sb.Reset()
+		_, _ = metrics.WriteTo(&sb)
+		return strings.Contains(sb.String(), "jt808_decode_errors_total 1\n") &&
+			strings.Contains(sb.String(), "jt808_online_sessions 0\n")
+	})
+}
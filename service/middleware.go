@@ -0,0 +1,90 @@
+package service
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+type (
+	// HandlerFunc 处理一个终端上传的报文, 返回错误的情况该报文不再继续处理(不触发事件也不回复).
+	HandlerFunc func(msg *Message) error
+
+	// Middleware 终端上传报文的中间件, 见 WithMiddleware.
+	// 在读取协程中执行, 位于内置的鉴权和加入之后, 触发 OnReadExecutionEvent 和回复之前.
+	// 可以修改 msg 如替换 msg.Handler, 没有对应处理的报文 msg.Handler 为nil.
+	Middleware func(next HandlerFunc) HandlerFunc
+
+	// ActiveHandlerFunc 处理一条平台主动下发的消息, 返回错误的情况不再下发, 调用方收到该错误.
+	ActiveHandlerFunc func(activeMsg *ActiveMessage) error
+
+	// ActiveMiddleware 平台主动下发的中间件, 见 WithActiveMiddleware.
+	// 在连接的 write 协程中执行, 位于编码和下发之前, 可以修改 activeMsg.Body 等.
+	ActiveMiddleware func(next ActiveHandlerFunc) ActiveHandlerFunc
+)
+
+// chainMiddleware 组合中间件 第一个在最外层.
+func chainMiddleware(middlewares []Middleware, final HandlerFunc) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		final = middlewares[i](final)
+	}
+	return final
+}
+
+func chainActiveMiddleware(middlewares []ActiveMiddleware, final ActiveHandlerFunc) ActiveHandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		final = middlewares[i](final)
+	}
+	return final
+}
+
+// onUplinkMiddleware 终端上传的报文经过中间件处理. 在读取协程中执行.
+// 返回错误表示需要断开连接(队列满了), 中间件返回的错误只丢弃该报文.
+func (c *connection) onUplinkMiddleware(msg *Message) (err error) {
+	if c.safeCall("Middleware", msg, func() {
+		err = c.uplinkHandler(msg)
+	}) {
+		c.endUplinkSpan(msg, "middleware panic", nil)
+		return nil
+	}
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrQueueOverflow) {
+		return err
+	}
+	slog.Debug("middleware",
+		slog.String("key", c.key),
+		slog.String("command", msg.Command.String()),
+		slog.Any("err", err))
+	c.endUplinkSpan(msg, "middleware", err)
+	return nil
+}
+
+// handleUplink 中间件之后的处理, 没有对应处理的报文触发 OnNotSupportedEvent.
+func (c *connection) handleUplink(msg *Message) error {
+	if msg.Handler == nil {
+		c.safeCall("TerminalEventer.OnNotSupportedEvent", msg, func() {
+			c.terminalEvent.OnNotSupportedEvent(msg)
+		})
+		c.endUplinkSpan(msg, "not supported", nil)
+		return nil
+	}
+	if msg.Command == consts.P8003ReissueSubcontractingRequest {
+		c.reissuePackChan <- msg
+		return nil
+	}
+	c.onReadExecutionEvent(msg)
+	return c.pushUplink(msg)
+}
+
+// onActiveMiddleware 平台主动下发经过中间件处理 中间件 panic 的情况不再下发.
+func (c *connection) onActiveMiddleware(activeMsg *ActiveMessage) (err error) {
+	if c.safeCall("ActiveMiddleware", nil, func() {
+		err = c.activeHandler(activeMsg)
+	}) {
+		return ErrHandlerPanic
+	}
+	return err
+}
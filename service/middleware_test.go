@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func TestService_middleware(t *testing.T) {
+	order := make(chan string, 16)
+	errDrop := errors.New("drop")
+	dropped := false
+	_, addr := startTestServer(t,
+		WithMiddleware(func(next HandlerFunc) HandlerFunc {
+			return func(msg *Message) error {
+				order <- "outer"
+				return next(msg)
+			}
+		}, func(next HandlerFunc) HandlerFunc {
+			return func(msg *Message) error {
+				order <- "inner"
+				// 第一个心跳丢弃 不回复
+				if !dropped {
+					dropped = true
+					return errDrop
+				}
+				// 修改处理 回复失败
+				msg.Handler = newDefaultHandle(&failReplyHandle{command: msg.Command})
+				return next(msg)
+			}
+		}),
+	)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	for _, want := range []string{"outer", "inner"} {
+		if got := waitChan(t, order, 2*time.Second); got != want {
+			t.Fatalf("middleware order = %s, want %s", got, want)
+		}
+	}
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	// 第一个心跳被丢弃 收到的是第二个的回复
+	if result := readGeneralRespondResult(t, conn); result != 1 {
+		t.Fatalf("heartbeat result = %d, want 1", result)
+	}
+}
+
+func TestService_activeMiddleware(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	errReject := errors.New("reject")
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithActiveMiddleware(func(next ActiveHandlerFunc) ActiveHandlerFunc {
+			return func(activeMsg *ActiveMessage) error {
+				if activeMsg.Command == consts.P8104QueryTerminalParams {
+					return errReject
+				}
+				activeMsg.Body = []byte{0x01, 0x02}
+				return next(activeMsg)
+			}
+		}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+	conn := joinTestTerminal(t, addr, events)
+
+	reply := g.SendActiveMessage(NewActiveMessage("12345678901", consts.P8104QueryTerminalParams, nil, time.Second))
+	if !errors.Is(reply.ExtensionFields.Err, errReject) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, errReject)
+	}
+
+	go func() {
+		platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+		if !bytes.Equal(platformMsg.Body, []byte{0x01, 0x02}) {
+			t.Errorf("active body = %x, want 0102", platformMsg.Body)
+		}
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P9101RealTimeAudioVideoRequest, 2)
+		if _, err := conn.Write(resp); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}()
+	reply = g.SendActiveMessage(NewActiveMessage("12345678901", consts.P9101RealTimeAudioVideoRequest, nil, time.Second))
+	if reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+	}
+}
@@ -0,0 +1,507 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// offlineFileSuffix 文件存储的离线指令文件后缀 每个key一个文件 每行一条指令.
+const offlineFileSuffix = ".jsonl"
+
+type (
+	// OfflineQueue 离线指令存储.
+	// 终端不在线时 ActiveMessage 会保存到这里, 终端加入后按保存顺序下发,
+	// 终端应答(或者超时等最终结果)后才删除, 下发中断(连接断开、服务关闭等)的下次加入再下发.
+	// 实现需要保证并发安全.
+	OfflineQueue interface {
+		// Push 保存一条离线指令.
+		Push(msg *OfflineMessage) error
+		// Peek 按保存顺序返回 key 的全部离线指令 不删除.
+		Peek(key string) ([]*OfflineMessage, error)
+		// Remove 删除 key 中 ID 为 id 的离线指令, 不存在的情况不处理.
+		Remove(key string, id string) error
+		// Expire 取出并删除所有在 now 时已经过期的离线指令.
+		Expire(now time.Time) ([]*OfflineMessage, error)
+	}
+
+	// OfflineMessage 终端不在线时保存的一条平台下发指令.
+	OfflineMessage struct {
+		// ID 离线指令的唯一标识 保存时生成
+		ID string `json:"id"`
+		// Key 唯一标识符 默认手机号
+		Key string `json:"key"`
+		// Command 平台下发的指令
+		Command consts.JT808CommandType `json:"command"`
+		// Body 平台下发的数据
+		Body []byte `json:"body"`
+		// OverTimeDuration 下发后等待应答的超时时间
+		OverTimeDuration time.Duration `json:"overTimeDuration"`
+		// Retransmit 超时后的重传策略 nil使用服务的配置
+		Retransmit *RetransmitPolicy `json:"retransmit,omitempty"`
+		// MaxBodyLength 单个包 body最大长度 0使用服务的配置
+		MaxBodyLength int `json:"maxBodyLength,omitempty"`
+		// CreateTime 保存的时间
+		CreateTime time.Time `json:"createTime"`
+		// ExpireTime 过期时间 零值表示不过期
+		ExpireTime time.Time `json:"expireTime"`
+	}
+)
+
+// offlineMessageSeq 生成离线指令 ID 的序号.
+var offlineMessageSeq atomic.Uint64
+
+func newOfflineMessage(activeMsg *ActiveMessage, ttl time.Duration) *OfflineMessage {
+	now := time.Now()
+	msg := &OfflineMessage{
+		ID:               fmt.Sprintf("%x-%x", now.UnixNano(), offlineMessageSeq.Add(1)),
+		Key:              activeMsg.Key,
+		Command:          activeMsg.Command,
+		Body:             activeMsg.Body,
+		OverTimeDuration: activeMsg.OverTimeDuration,
+		Retransmit:       activeMsg.Retransmit,
+		MaxBodyLength:    activeMsg.MaxBodyLength,
+		CreateTime:       now,
+	}
+	if ttl > 0 {
+		msg.ExpireTime = now.Add(ttl)
+	}
+	return msg
+}
+
+// HasExpired 在 now 时是否已经过期.
+func (o *OfflineMessage) HasExpired(now time.Time) bool {
+	return !o.ExpireTime.IsZero() && now.After(o.ExpireTime)
+}
+
+func (o *OfflineMessage) activeMessage() *ActiveMessage {
+	activeMsg := NewActiveMessage(o.Key, o.Command, o.Body, o.OverTimeDuration)
+	activeMsg.Retransmit = o.Retransmit
+	activeMsg.MaxBodyLength = o.MaxBodyLength
+	activeMsg.offline = o
+	return activeMsg
+}
+
+// MemoryOfflineQueue 内存存储的离线指令 服务重启后丢失.
+type MemoryOfflineQueue struct {
+	mu     sync.Mutex
+	record map[string][]*OfflineMessage
+}
+
+// NewMemoryOfflineQueue 创建内存存储的离线指令队列.
+func NewMemoryOfflineQueue() *MemoryOfflineQueue {
+	return &MemoryOfflineQueue{
+		record: make(map[string][]*OfflineMessage),
+	}
+}
+
+func (m *MemoryOfflineQueue) Push(msg *OfflineMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record[msg.Key] = append(m.record[msg.Key], msg)
+	return nil
+}
+
+func (m *MemoryOfflineQueue) Peek(key string) ([]*OfflineMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.record[key]), nil
+}
+
+func (m *MemoryOfflineQueue) Remove(key string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msgs := slices.DeleteFunc(m.record[key], func(msg *OfflineMessage) bool {
+		return msg.ID == id
+	})
+	if len(msgs) == 0 {
+		delete(m.record, key)
+	} else {
+		m.record[key] = msgs
+	}
+	return nil
+}
+
+func (m *MemoryOfflineQueue) Expire(now time.Time) ([]*OfflineMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var expired []*OfflineMessage
+	for key, msgs := range m.record {
+		kept := msgs[:0]
+		for _, msg := range msgs {
+			if msg.HasExpired(now) {
+				expired = append(expired, msg)
+				continue
+			}
+			kept = append(kept, msg)
+		}
+		if len(kept) == 0 {
+			delete(m.record, key)
+		} else {
+			m.record[key] = kept
+		}
+	}
+	return expired, nil
+}
+
+// FileOfflineQueue 文件存储的离线指令 服务重启后仍然保留.
+// 每个key一个文件(文件名是key的十六进制), 每行一条 json 格式的指令.
+type FileOfflineQueue struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewFileOfflineQueue 创建文件存储的离线指令队列, dir 不存在时自动创建.
+func NewFileOfflineQueue(dir string) (*FileOfflineQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileOfflineQueue{dir: dir}, nil
+}
+
+func (f *FileOfflineQueue) Push(msg *OfflineMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path(msg.Key), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	return errors.Join(err, file.Close())
+}
+
+func (f *FileOfflineQueue) Peek(key string) ([]*OfflineMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msgs, err := readOfflineFile(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return msgs, err
+}
+
+func (f *FileOfflineQueue) Remove(key string, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := f.path(key)
+	msgs, err := readOfflineFile(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return writeOfflineFile(name, msgs, func(msg *OfflineMessage) bool {
+		return msg.ID != id
+	})
+}
+
+func (f *FileOfflineQueue) Expire(now time.Time) ([]*OfflineMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names, err := filepath.Glob(filepath.Join(f.dir, "*"+offlineFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		expired []*OfflineMessage
+		errs    []error
+	)
+	for _, name := range names {
+		msgs, err := readOfflineFile(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, writeOfflineFile(name, msgs, func(msg *OfflineMessage) bool {
+			if msg.HasExpired(now) {
+				expired = append(expired, msg)
+				return false
+			}
+			return true
+		}))
+	}
+	return expired, errors.Join(errs...)
+}
+
+func (f *FileOfflineQueue) path(key string) string {
+	return filepath.Join(f.dir, hex.EncodeToString([]byte(key))+offlineFileSuffix)
+}
+
+// writeOfflineFile 只保留 keep 返回true的指令, 全部删除的情况删除文件, 没有变化的情况不改动.
+func writeOfflineFile(name string, msgs []*OfflineMessage, keep func(msg *OfflineMessage) bool) error {
+	var (
+		kept    bytes.Buffer
+		keptSum int
+	)
+	for _, msg := range msgs {
+		if !keep(msg) {
+			continue
+		}
+		data, _ := json.Marshal(msg)
+		kept.Write(append(data, '\n'))
+		keptSum++
+	}
+	switch keptSum {
+	case 0:
+		return os.Remove(name)
+	case len(msgs):
+		return nil
+	default:
+		return os.WriteFile(name, kept.Bytes(), 0o644)
+	}
+}
+
+func readOfflineFile(name string) ([]*OfflineMessage, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var msgs []*OfflineMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var msg OfflineMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, scanner.Err()
+}
+
+// offlineOptions 会话管理器使用的离线指令配置.
+type offlineOptions struct {
+	queue OfflineQueue
+	// ttl 离线指令的有效期 <=0 表示不过期
+	ttl time.Duration
+	// onEvent 离线指令最终的结果 下发后终端的应答或者过期
+	onEvent func(msg *OfflineMessage, reply *Message)
+	// pending 等待执行的存储操作 按提交顺序在 runIO 协程中执行
+	// 存储可能是文件等慢操作 不能阻塞会话管理器
+	mu      sync.Mutex
+	pending []func()
+	closed  bool
+	notify  chan struct{}
+	// ioCompleteChan runIO 协程退出后关闭.
+	ioCompleteChan chan struct{}
+	// expiring 上一次过期检查还没有完成
+	expiring atomic.Bool
+	// delivering 正在下发离线指令的key 值为下发过程中终端是否又加入了
+	// 同一个key同时只有一个协程按顺序下发
+	delivering map[string]bool
+}
+
+func newOfflineOptions(queue OfflineQueue, ttl time.Duration,
+	onEvent func(msg *OfflineMessage, reply *Message)) *offlineOptions {
+	return &offlineOptions{
+		queue:      queue,
+		ttl:        ttl,
+		onEvent:    onEvent,
+		notify:         make(chan struct{}, 1),
+		ioCompleteChan: make(chan struct{}),
+		delivering:     make(map[string]bool),
+	}
+}
+
+// do 提交一个存储操作 不等待执行完成.
+func (o *offlineOptions) do(op func()) {
+	o.mu.Lock()
+	o.pending = append(o.pending, op)
+	o.mu.Unlock()
+	o.wakeup()
+}
+
+// closeIO 执行完已经提交的存储操作后 runIO 协程退出, 等待退出后返回.
+func (o *offlineOptions) closeIO() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+	o.wakeup()
+	<-o.ioCompleteChan
+}
+
+func (o *offlineOptions) wakeup() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// runIO 按提交顺序执行存储操作 保证同一个key的保存和取出不会乱序.
+func (o *offlineOptions) runIO() {
+	defer close(o.ioCompleteChan)
+	for {
+		<-o.notify
+		o.mu.Lock()
+		ops, closed := o.pending, o.closed
+		o.pending = nil
+		o.mu.Unlock()
+		for _, op := range ops {
+			op()
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// expireInterval 检查过期的间隔 有效期的一半 最少1秒 最多1分钟.
+func (o *offlineOptions) expireInterval() time.Duration {
+	return min(max(o.ttl/2, time.Second), time.Minute)
+}
+
+// reportOffline 回调离线指令的最终结果 发生 panic 的情况见 WithHandlerPanic.
+func (s *sessionManager) reportOffline(msg *OfflineMessage, reply *Message) {
+	if s.offline.onEvent == nil {
+		return
+	}
+	safeCall(HandlerPanic{
+		Key:      msg.Key,
+		Callback: "OnOfflineMessageEvent",
+		Message:  reply,
+	}, s.onPanicEvent, func() {
+		s.offline.onEvent(msg, reply)
+	})
+}
+
+// pushOffline 终端不在线 保存为离线指令 保存结果通过 replyChan 返回.
+// 在会话管理协程中调用 存储在 runIO 协程中执行.
+func (s *sessionManager) pushOffline(activeMsg *ActiveMessage) {
+	msg := newOfflineMessage(activeMsg, s.offline.ttl)
+	s.offline.do(func() {
+		if err := s.offline.queue.Push(msg); err != nil {
+			activeMsg.replyChan <- newErrMessage(errors.Join(ErrNotExistKey, err))
+			return
+		}
+		activeMsg.replyChan <- newErrMessage(errors.Join(ErrOfflineMessageQueued,
+			fmt.Errorf("key=[%s] command=[%s]", activeMsg.Key, activeMsg.Command)))
+	})
+}
+
+// popOffline 终端加入后 按顺序下发离线指令.
+// 在会话管理协程中调用 在 runIO 协程中开始下发 保证之前保存的离线指令都能取到.
+func (s *sessionManager) popOffline(key string) {
+	if s.offline == nil {
+		return
+	}
+	s.offline.do(func() {
+		s.offline.mu.Lock()
+		defer s.offline.mu.Unlock()
+		if _, ok := s.offline.delivering[key]; ok {
+			// 上一次加入的还在下发 完成后再取一次
+			s.offline.delivering[key] = true
+			return
+		}
+		s.offline.delivering[key] = false
+		s.goBackground(func() { s.deliverOffline(key) })
+	})
+}
+
+// deliverOffline 按顺序下发 key 的离线指令 上一条完成(应答或超时)后再下发下一条.
+// 下发过程中终端又加入的情况 完成后再取一次.
+func (s *sessionManager) deliverOffline(key string) {
+	for {
+		s.deliverOfflineOnce(key)
+		s.offline.mu.Lock()
+		if !s.offline.delivering[key] {
+			delete(s.offline.delivering, key)
+			s.offline.mu.Unlock()
+			return
+		}
+		s.offline.delivering[key] = false
+		s.offline.mu.Unlock()
+	}
+}
+
+func (s *sessionManager) deliverOfflineOnce(key string) {
+	msgs, err := s.offline.queue.Peek(key)
+	if err != nil {
+		slog.Warn("offline queue peek fail",
+			slog.String("key", key),
+			slog.Any("err", err))
+		return
+	}
+	for _, msg := range msgs {
+		var reply *Message
+		if msg.HasExpired(time.Now()) {
+			reply = newErrMessage(errors.Join(ErrOfflineMessageExpired,
+				fmt.Errorf("key=[%s] expire time=[%s]", msg.Key, msg.ExpireTime.Format(time.DateTime))))
+		} else {
+			reply = s.write(msg.activeMessage())
+			if isOfflineInterrupted(reply.ExtensionFields.Err) {
+				// 终端又离线了或者服务关闭了 保留剩下的 下次加入再下发
+				return
+			}
+		}
+		if err := s.offline.queue.Remove(msg.Key, msg.ID); err != nil {
+			slog.Warn("offline queue remove fail",
+				slog.String("key", msg.Key),
+				slog.String("id", msg.ID),
+				slog.Any("err", err))
+		}
+		s.reportOffline(msg, reply)
+	}
+}
+
+// isOfflineInterrupted 下发没有得到最终结果 离线指令需要保留.
+func isOfflineInterrupted(err error) bool {
+	return errors.Is(err, ErrOfflineMessageQueued) ||
+		errors.Is(err, ErrConnectionClosed) ||
+		errors.Is(err, ErrServerClosed) ||
+		errors.Is(err, ErrQueueOverflow)
+}
+
+// expireOffline 删除过期的离线指令. 在会话管理协程中调用 存储在 runIO 协程中执行.
+// 上一次检查还没有完成时跳过.
+func (s *sessionManager) expireOffline() {
+	if !s.offline.expiring.CompareAndSwap(false, true) {
+		return
+	}
+	s.offline.do(func() {
+		defer s.offline.expiring.Store(false)
+		msgs, err := s.offline.queue.Expire(time.Now())
+		if err != nil {
+			slog.Warn("offline queue expire fail",
+				slog.Any("err", err))
+		}
+		// 正在下发的key 由下发协程回调结果 避免重复
+		s.offline.mu.Lock()
+		msgs = slices.DeleteFunc(msgs, func(msg *OfflineMessage) bool {
+			_, ok := s.offline.delivering[msg.Key]
+			return ok
+		})
+		s.offline.mu.Unlock()
+		if len(msgs) == 0 {
+			return
+		}
+		s.goBackground(func() {
+			for _, msg := range msgs {
+				s.reportOffline(msg, newErrMessage(errors.Join(ErrOfflineMessageExpired,
+					fmt.Errorf("key=[%s] expire time=[%s]", msg.Key, msg.ExpireTime.Format(time.DateTime)))))
+			}
+		})
+	})
+}
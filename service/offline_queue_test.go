@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func TestOfflineQueue_pushPopExpire(t *testing.T) {
+	fileQueue, err := NewFileOfflineQueue(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileOfflineQueue() error = %v", err)
+	}
+	tests := []struct {
+		name  string
+		queue OfflineQueue
+	}{
+		{name: "内存", queue: NewMemoryOfflineQueue()},
+		{name: "文件", queue: fileQueue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			msgs := []*OfflineMessage{
+				{ID: "a", Key: "1", Command: consts.P8300TextInfoDistribution, Body: []byte{0x01}, CreateTime: now},
+				{ID: "b", Key: "1", Command: consts.P8201QueryLocation, CreateTime: now, ExpireTime: now.Add(-time.Second)},
+				{ID: "c", Key: "1", Command: consts.P8104QueryTerminalParams, CreateTime: now, ExpireTime: now.Add(time.Hour)},
+				{ID: "d", Key: "2", Command: consts.P8300TextInfoDistribution, CreateTime: now, ExpireTime: now.Add(-time.Second)},
+			}
+			for _, msg := range msgs {
+				if err := tt.queue.Push(msg); err != nil {
+					t.Fatalf("Push() error = %v", err)
+				}
+			}
+
+			expired, err := tt.queue.Expire(now)
+			if err != nil {
+				t.Fatalf("Expire() error = %v", err)
+			}
+			if len(expired) != 2 {
+				t.Fatalf("Expire() = %d, want 2", len(expired))
+			}
+
+			got, err := tt.queue.Peek("1")
+			if err != nil {
+				t.Fatalf("Peek() error = %v", err)
+			}
+			want := []consts.JT808CommandType{consts.P8300TextInfoDistribution, consts.P8104QueryTerminalParams}
+			if len(got) != len(want) {
+				t.Fatalf("Peek() = %d, want %d", len(got), len(want))
+			}
+			for i, msg := range got {
+				if msg.Command != want[i] {
+					t.Fatalf("Peek()[%d] command = %s, want %s", i, msg.Command, want[i])
+				}
+			}
+			if got[0].Body[0] != 0x01 {
+				t.Fatalf("Peek()[0] body = %x, want 01", got[0].Body)
+			}
+
+			// 应答后才删除 没有删除的再次取出仍然在
+			if err := tt.queue.Remove("1", got[0].ID); err != nil {
+				t.Fatalf("Remove() error = %v", err)
+			}
+			if got, _ := tt.queue.Peek("1"); len(got) != 1 || got[0].ID != msgs[2].ID {
+				t.Fatalf("Peek() after remove = %+v, want %s", got, msgs[2].ID)
+			}
+			_ = tt.queue.Remove("1", msgs[2].ID)
+			for _, key := range []string{"1", "2"} {
+				if got, _ := tt.queue.Peek(key); len(got) != 0 {
+					t.Fatalf("Peek(%s) after remove = %d, want 0", key, len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestService_offlineQueueDeliverOnJoin(t *testing.T) {
+	type result struct {
+		msg   *OfflineMessage
+		reply *Message
+	}
+	events := newRecordingTerminalEvent()
+	results := make(chan result, 4)
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithOfflineQueue(NewMemoryOfflineQueue(), 0, func(msg *OfflineMessage, reply *Message) {
+			results <- result{msg: msg, reply: reply}
+		}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	key := "12345678901"
+	for _, body := range [][]byte{{0x01, 0x31}, {0x01, 0x32}} {
+		reply := g.SendActiveMessage(NewActiveMessage(key, consts.P8300TextInfoDistribution, body, time.Second))
+		if !errors.Is(reply.ExtensionFields.Err, ErrOfflineMessageQueued) {
+			t.Fatalf("SendActiveMessage() offline err = %v, want %v", reply.ExtensionFields.Err, ErrOfflineMessageQueued)
+		}
+	}
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = waitChan(t, events.joined, 2*time.Second)
+
+	// 心跳的0x8001和离线指令可能在同一次读取中 按帧拆开 并跳过0x8001
+	frameReader := jt808.NewFrameReader()
+	var frames [][]byte
+	nextPlatformMsg := func() *jt808.JTMessage {
+		for {
+			for len(frames) == 0 {
+				frames = frameReader.ReadFrames(readPacket(t, conn, 2*time.Second))
+			}
+			frame := frames[0]
+			frames = frames[1:]
+			if msg := decodeFirstMessage(t, frame); consts.JT808CommandType(msg.Header.ID) != consts.P8001GeneralRespond {
+				return msg
+			}
+		}
+	}
+	for i, want := range []byte{0x31, 0x32} {
+		platformMsg := nextPlatformMsg()
+		if consts.JT808CommandType(platformMsg.Header.ID) != consts.P8300TextInfoDistribution {
+			t.Fatalf("offline[%d] command = 0x%04X, want 0x8300", i, platformMsg.Header.ID)
+		}
+		if got := platformMsg.Body[1]; got != want {
+			t.Fatalf("offline[%d] body = %x, want order %x", i, platformMsg.Body, want)
+		}
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P8300TextInfoDistribution, uint16(i+2))
+		if _, err := conn.Write(resp); err != nil {
+			t.Fatalf("Write 0x0001 error = %v", err)
+		}
+		r := waitChan(t, results, 2*time.Second)
+		if r.reply.ExtensionFields.Err != nil {
+			t.Fatalf("offline[%d] reply err = %v", i, r.reply.ExtensionFields.Err)
+		}
+		if r.reply.Command != consts.T0001GeneralRespond {
+			t.Fatalf("offline[%d] reply command = %s, want %s", i, r.reply.Command, consts.T0001GeneralRespond)
+		}
+	}
+}
+
+func TestService_offlineQueueExpire(t *testing.T) {
+	results := make(chan *Message, 1)
+	g, _ := startTestServer(t,
+		WithOfflineQueue(NewMemoryOfflineQueue(), 100*time.Millisecond, func(_ *OfflineMessage, reply *Message) {
+			results <- reply
+		}),
+	)
+
+	reply := g.SendActiveMessage(NewActiveMessage("missing", consts.P8201QueryLocation, nil, time.Second))
+	if !errors.Is(reply.ExtensionFields.Err, ErrOfflineMessageQueued) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrOfflineMessageQueued)
+	}
+	if got := waitChan(t, results, 3*time.Second); !errors.Is(got.ExtensionFields.Err, ErrOfflineMessageExpired) {
+		t.Fatalf("expired reply err = %v, want %v", got.ExtensionFields.Err, ErrOfflineMessageExpired)
+	}
+}
+
+// blockingOfflineQueue Push 等待 gate 关闭 模拟慢的存储.
+type blockingOfflineQueue struct {
+	*MemoryOfflineQueue
+	gate chan struct{}
+}
+
+func (b *blockingOfflineQueue) Push(msg *OfflineMessage) error {
+	<-b.gate
+	return b.MemoryOfflineQueue.Push(msg)
+}
+
+func TestService_offlineQueueNotBlockSessionManager(t *testing.T) {
+	queue := &blockingOfflineQueue{MemoryOfflineQueue: NewMemoryOfflineQueue(), gate: make(chan struct{})}
+	g, _ := startTestServer(t, WithOfflineQueue(queue, 0, nil))
+
+	replyChan := g.SendActiveMessageAsync(context.Background(),
+		NewActiveMessage("missing", consts.P8201QueryLocation, nil, time.Second))
+	done := make(chan int, 1)
+	go func() {
+		done <- g.OnlineCount()
+	}()
+	// 存储阻塞时 会话管理器仍然可以处理其他操作
+	if got := waitChan(t, done, time.Second); got != 0 {
+		t.Fatalf("OnlineCount() = %d, want 0", got)
+	}
+	close(queue.gate)
+	if reply := waitChan(t, replyChan, time.Second); !errors.Is(reply.ExtensionFields.Err, ErrOfflineMessageQueued) {
+		t.Fatalf("reply err = %v, want %v", reply.ExtensionFields.Err, ErrOfflineMessageQueued)
+	}
+}
+
+func TestService_offlineQueueKeepOnDisconnect(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	queue := NewMemoryOfflineQueue()
+	results := make(chan *Message, 2)
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithOfflineQueue(queue, time.Hour, func(_ *OfflineMessage, reply *Message) {
+			results <- reply
+		}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	key := "12345678901"
+	_ = g.SendActiveMessage(NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x31}, 5*time.Second))
+	saved, _ := queue.Peek(key)
+	if len(saved) != 1 {
+		t.Fatalf("Peek() = %d, want 1", len(saved))
+	}
+
+	// 收到离线指令后不应答就断开 指令保留 时间不变
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = waitChan(t, events.joined, 2*time.Second)
+	frameReader := jt808.NewFrameReader()
+	waitOffline := func(conn net.Conn) *jt808.JTMessage {
+		for {
+			for _, frame := range frameReader.ReadFrames(readPacket(t, conn, 2*time.Second)) {
+				if msg := decodeFirstMessage(t, frame); consts.JT808CommandType(msg.Header.ID) == consts.P8300TextInfoDistribution {
+					return msg
+				}
+			}
+		}
+	}
+	_ = waitOffline(conn)
+	_ = conn.Close()
+	_ = waitChan(t, events.left, 2*time.Second)
+	waitFor(t, 2*time.Second, func() bool {
+		got, _ := queue.Peek(key)
+		return len(got) == 1 && got[0].ID == saved[0].ID && got[0].ExpireTime.Equal(saved[0].ExpireTime)
+	})
+	select {
+	case reply := <-results:
+		t.Fatalf("interrupted offline message reported: %+v", reply.ExtensionFields.Err)
+	default:
+	}
+
+	// 再次加入后下发 应答后删除
+	conn = dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	frameReader = jt808.NewFrameReader()
+	platformMsg := waitOffline(conn)
+	resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P8300TextInfoDistribution, 2)
+	if _, err := conn.Write(resp); err != nil {
+		t.Fatalf("Write 0x0001 error = %v", err)
+	}
+	if reply := waitChan(t, results, 2*time.Second); reply.ExtensionFields.Err != nil {
+		t.Fatalf("offline reply err = %v", reply.ExtensionFields.Err)
+	}
+	if got, _ := queue.Peek(key); len(got) != 0 {
+		t.Fatalf("Peek() after reply = %d, want 0", len(got))
+	}
+}
+
+// countingOfflineQueue 记录同时执行 Peek 的数量.
+type countingOfflineQueue struct {
+	*MemoryOfflineQueue
+	gate    chan struct{}
+	running atomic.Int32
+	max     atomic.Int32
+	peeks   atomic.Int32
+}
+
+func (c *countingOfflineQueue) Peek(key string) ([]*OfflineMessage, error) {
+	n := c.running.Add(1)
+	defer c.running.Add(-1)
+	if n > c.max.Load() {
+		c.max.Store(n)
+	}
+	c.peeks.Add(1)
+	<-c.gate
+	return c.MemoryOfflineQueue.Peek(key)
+}
+
+func TestSessionManager_deliverOfflineSerialPerKey(t *testing.T) {
+	queue := &countingOfflineQueue{MemoryOfflineQueue: NewMemoryOfflineQueue(), gate: make(chan struct{})}
+	s := newSessionManager(nil)
+	s.offline = newOfflineOptions(queue, 0, nil)
+	go s.offline.runIO()
+	defer s.offline.closeIO()
+
+	// 终端快速重连 两次加入 下发不并发 第一次完成后再取一次
+	s.popOffline("1")
+	waitFor(t, time.Second, func() bool { return queue.peeks.Load() == 1 })
+	s.popOffline("1")
+	s.popOffline("1")
+	time.Sleep(50 * time.Millisecond)
+	close(queue.gate)
+	waitFor(t, time.Second, func() bool {
+		s.offline.mu.Lock()
+		defer s.offline.mu.Unlock()
+		return len(s.offline.delivering) == 0
+	})
+	if got := queue.max.Load(); got != 1 {
+		t.Fatalf("concurrent deliver = %d, want 1", got)
+	}
+	if got := queue.peeks.Load(); got != 2 {
+		t.Fatalf("peek = %d, want 2", got)
+	}
+}
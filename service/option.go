@@ -1,6 +1,10 @@
 package service
 
 import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
 	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 	"time"
 )
@@ -12,6 +16,27 @@ const (
 	defaultTimeout           = 0             // 默认不开启超时检测
 )
 
+// DuplicateKeyPolicy 终端加入时 key 已经存在的处理策略.
+type DuplicateKeyPolicy int
+
+const (
+	// DuplicateKeyRejectNew 拒绝新的连接 保留旧的连接(默认).
+	DuplicateKeyRejectNew DuplicateKeyPolicy = iota
+	// DuplicateKeyReplaceOld 关闭旧的连接 会话转移到新的连接.
+	// 适用于终端切换基站后重连 旧的TCP连接还未超时的情况.
+	DuplicateKeyReplaceOld
+)
+
+func (d DuplicateKeyPolicy) String() string {
+	switch d {
+	case DuplicateKeyRejectNew:
+		return "拒绝新连接"
+	case DuplicateKeyReplaceOld:
+		return "替换旧连接"
+	}
+	return "未知策略"
+}
+
 type (
 	Option struct {
 		F func(o *Options)
@@ -20,7 +45,7 @@ type (
 	Options struct {
 		// Addr 服务地址 默认0.0.0.0:808.
 		Addr string
-		// Network 服务协议 默认tcp.
+		// Network 服务协议 默认tcp 支持udp.
 		Network string
 		// FilterSubcontract 是否过滤分包的情况 默认true.
 		FilterSubcontract bool
@@ -33,10 +58,62 @@ type (
 		// CustomActiveRespondHandlerFunc 自定义消息回复处理
 		CustomActiveRespondHandlerFunc func() map[consts.JT808CommandType]func(
 			platformMsg *ActiveMessage, terminalMsg *Message) bool
-		// IdleTimeout 空闲超时,默认0，不设置
+		// IdleTimeout 空闲超时,默认0，不设置 UDP的虚拟会话默认3分钟
 		IdleTimeout time.Duration
 		// OnTerminalTimeoutEvent 空闲超时事件，设置IdleTimeout时触发
 		OnTerminalTimeoutEvent func(TerminalTimeout)
+		// DuplicateKeyFunc 终端加入时key已经存在的处理策略 默认nil 拒绝新的连接
+		DuplicateKeyFunc func(key string, old SessionInfo, message *Message) DuplicateKeyPolicy
+		// OfflineQueue 离线指令存储 默认nil 终端不在线时直接返回 ErrNotExistKey
+		OfflineQueue OfflineQueue
+		// OfflineTTL 离线指令的有效期 <=0 表示不过期
+		OfflineTTL time.Duration
+		// OnOfflineMessageEvent 离线指令的最终结果 终端的应答或者过期
+		OnOfflineMessageEvent func(msg *OfflineMessage, reply *Message)
+		// Retransmit 主动下发超时后的重传策略 默认不重传
+		Retransmit RetransmitPolicy
+		// Authenticator 终端注册和鉴权的校验 默认nil 不校验
+		Authenticator Authenticator
+		// JoinPolicy 终端加入的条件 默认nil 第一个报文就加入
+		JoinPolicy *JoinPolicy
+		// Metrics 监控指标 默认不记录
+		Metrics Metrics
+		// Tracer 链路追踪 默认不追踪
+		Tracer Tracer
+		// Queue 每个连接的队列大小和队列满了的处理方式 默认大小10 阻塞
+		Queue QueueOptions
+		// RateLimit 每个终端的限流 默认nil 不限流
+		RateLimit *RateLimit
+		// MaxConnections 最大连接数(UDP的情况为虚拟会话数) <=0不限制 UDP的虚拟会话默认最多10万
+		MaxConnections int
+		// TLSConfig TLS配置 默认nil 不使用TLS 仅TCP有效
+		TLSConfig *tls.Config
+		// CertificateKeyFunc 从TLS客户端证书获取终端的key 默认nil 不校验 设置后拒绝非TLS的连接
+		CertificateKeyFunc func(cert *x509.Certificate) string
+		// ProxyProtocol 解析 PROXY protocol 头部 默认nil 不解析 仅TCP有效
+		ProxyProtocol *ProxyProtocol
+		// Listeners 除了 Addr 以外的其他监听地址 共用一个会话管理
+		Listeners []Listener
+		// Middlewares 终端上传报文的中间件
+		Middlewares []Middleware
+		// ActiveMiddlewares 平台主动下发的中间件
+		ActiveMiddlewares []ActiveMiddleware
+		// OnHandlerPanic 用户回调发生 panic 的事件 默认nil 只记录日志
+		OnHandlerPanic func(p HandlerPanic)
+		// PanicDisconnect 用户回调发生 panic 后是否断开该终端的连接 默认false
+		PanicDisconnect bool
+		// Cluster 集群配置 默认nil 不开启
+		Cluster *Cluster
+		// RSAPrivateKey 平台的RSA私钥 默认nil 终端上传RSA加密的消息体时回复失败
+		RSAPrivateKey *rsa.PrivateKey
+		// DecodeOptions 终端报文的解码选项 默认严格模式
+		DecodeOptions jt808.DecodeOptions
+		// SkipDecodeError 报文解码失败时是否跳过该报文 默认false 断开连接
+		SkipDecodeError bool
+		// MaxBodyLength 平台下发时单个包 body最大长度 默认0 使用1000
+		MaxBodyLength int
+		// ProtocolVersionFunc 根据手机号指定终端的协议版本 默认nil 根据终端注册的报文判断
+		ProtocolVersionFunc jt808.ProtocolVersionFunc
 	}
 
 	TerminalTimeout struct {
@@ -61,6 +138,8 @@ func newOptions(opts []Option) *Options {
 		Network:           defaultNetwork,
 		FilterSubcontract: defaultFilterSubcontract,
 		IdleTimeout:       defaultTimeout,
+		Metrics:           nopMetrics{},
+		Tracer:            nopTracer{},
 		KeyFunc: func(message *Message) (string, bool) {
 			return message.JTMessage.Header.TerminalPhoneNo, true
 		},
@@ -88,7 +167,8 @@ func WithHostPorts(address string) Option {
 	}}
 }
 
-// WithNetwork 修改启动协议,默认TCP.(暂不支持udp).
+// WithNetwork 修改启动协议,默认TCP.
+// 支持tcp/tcp4/tcp6和udp/udp4/udp6, UDP情况按终端key建立虚拟会话.
 func WithNetwork(network string) Option {
 	return Option{F: func(o *Options) {
 		o.Network = network
@@ -111,6 +191,8 @@ func WithCustomHandleFunc(customFunc func() map[consts.JT808CommandType]Handler)
 }
 
 // WithCustomActiveRespondHandlerFunc 自定义主动消息回复报文处理.
+// 匹配函数在 write 协程中执行, OverflowDropOldest 策略下丢弃报文时还会在读取协程中执行,
+// 两个协程可能同时调用 需要并发安全 并且只读 activeMsg 和 terminalMsg.
 func WithCustomActiveRespondHandlerFunc(customFunc func() map[consts.JT808CommandType]func(
 	activeMsg *ActiveMessage, terminalMsg *Message) bool) Option {
 	return Option{F: func(o *Options) {
@@ -158,3 +240,354 @@ func WithTerminalTimeout(idleTimeout time.Duration, onTimeoutEvent func(Terminal
 		}
 	}}
 }
+
+// WithDuplicateKeyPolicy 设置终端加入时 key 已经存在的处理策略, 默认拒绝新的连接.
+// 使用 DuplicateKeyReplaceOld 时旧连接被关闭, 新连接的事件处理器如果实现了
+// TerminalReplaceEventer 会触发 OnReplaceEvent.
+func WithDuplicateKeyPolicy(policy DuplicateKeyPolicy) Option {
+	return Option{F: func(o *Options) {
+		o.DuplicateKeyFunc = func(_ string, _ SessionInfo, _ *Message) DuplicateKeyPolicy {
+			return policy
+		}
+	}}
+}
+
+// WithDuplicateKeyFunc 自定义终端加入时 key 已经存在的处理策略.
+// old 为当前在线的旧会话, message 为新连接的第一个报文.
+// 该函数在会话管理协程中执行 不能阻塞.
+//
+// 使用示例：
+//
+//	service.WithDuplicateKeyFunc(func(key string, old service.SessionInfo, _ *service.Message) service.DuplicateKeyPolicy {
+//		// 旧连接超过1分钟没有报文了 认为已经断开
+//		if time.Since(old.LastPacketTime) > time.Minute {
+//			return service.DuplicateKeyReplaceOld
+//		}
+//		return service.DuplicateKeyRejectNew
+//	}),
+func WithDuplicateKeyFunc(duplicateKeyFunc func(key string, old SessionInfo, message *Message) DuplicateKeyPolicy) Option {
+	return Option{F: func(o *Options) {
+		o.DuplicateKeyFunc = duplicateKeyFunc
+	}}
+}
+
+// WithOfflineQueue 开启离线指令, 终端不在线时 ActiveMessage 保存到 queue 中.
+//
+// 参数说明：
+//
+//	queue   - 离线指令存储 可以使用 NewMemoryOfflineQueue 或者 NewFileOfflineQueue
+//	ttl     - 离线指令的有效期 <= 0 表示不过期
+//	onEvent - 离线指令的最终结果 可以为nil
+//	          终端加入后按保存顺序下发 reply 为终端的应答(或超时等异常)
+//	          过期的情况 reply.ExtensionFields.Err 为 ErrOfflineMessageExpired
+//	          下发中途终端断开或服务关闭的 不回调 指令保留到下次加入
+//
+// 开启后终端不在线时 SendActiveMessage 立即返回 ErrOfflineMessageQueued.
+func WithOfflineQueue(queue OfflineQueue, ttl time.Duration, onEvent func(msg *OfflineMessage, reply *Message)) Option {
+	return Option{F: func(o *Options) {
+		o.OfflineQueue = queue
+		o.OfflineTTL = ttl
+		o.OnOfflineMessageEvent = onEvent
+	}}
+}
+
+// WithRetransmitPolicy 设置主动下发超时后的重传策略, 默认不重传.
+// 重传使用相同的流水号, 超时时间按 T(n+1) = T(n) * (n+1) 递增,
+// 最后一次重传仍然超时才返回 ErrWriteDataOverTime.
+// ActiveMessage.Retransmit 不为nil时优先使用 ActiveMessage 的.
+//
+// 使用示例(和终端参数0x0002 0x0003保持一致)：
+//
+//	// 终端参数 0x0002=10秒 0x0003=3次
+//	// 超时时间依次为 10秒 10秒 20秒 60秒
+//	service.WithRetransmitPolicy(service.RetransmitPolicy{Count: 3}),
+//	activeMsg := service.NewActiveMessage(key, command, body, 10*time.Second)
+func WithRetransmitPolicy(policy RetransmitPolicy) Option {
+	return Option{F: func(o *Options) {
+		o.Retransmit = policy
+	}}
+}
+
+// WithAuthenticator 开启终端注册(0x0100)和鉴权(0x0102)的校验, 默认不校验.
+// 注册应答0x8100的结果和鉴权码由 authenticator 决定, 鉴权应答0x8001的结果为鉴权码是否正确.
+// 开启后终端鉴权通过前发送其他报文(0x0100 0x0102 0x0003以外的)直接断开连接,
+// 没有设置 WithJoinPolicy 的情况 鉴权通过后才加入.
+// 可以使用 NewMemoryAuthenticator 或者自定义实现 如查询数据库.
+func WithAuthenticator(authenticator Authenticator) Option {
+	return Option{F: func(o *Options) {
+		o.Authenticator = authenticator
+	}}
+}
+
+// WithJoinPolicy 设置终端加入的条件, 默认第一个报文就加入.
+// 设置后终端需要鉴权(0x0102)成功或者发送 policy.Commands 中的指令才加入,
+// 加入前的其他报文按照 policy.Action 回复失败或者丢弃, 超过 policy.Timeout 还未加入关闭连接.
+//
+// 使用示例：
+//
+//	service.WithJoinPolicy(service.JoinPolicy{
+//		Action:  service.BeforeJoinDrop,
+//		Timeout: 30 * time.Second,
+//	}),
+func WithJoinPolicy(policy JoinPolicy) Option {
+	return Option{F: func(o *Options) {
+		o.JoinPolicy = &policy
+	}}
+}
+
+// WithMetrics 设置监控指标, 默认不记录.
+// 可以使用 NewPrometheusMetrics 以 Prometheus 文本格式输出, 或者自定义实现对接其他监控系统.
+func WithMetrics(metrics Metrics) Option {
+	return Option{F: func(o *Options) {
+		if metrics != nil {
+			o.Metrics = metrics
+		}
+	}}
+}
+
+// WithTracer 设置链路追踪, 默认不追踪.
+// 追踪终端加入(SpanJoin)、终端上传的每一个报文(SpanUplink)和平台主动下发(SpanActive),
+// 属性包括 key、指令、流水号和结果, 主动下发的 span 使用 SendActiveMessageContext 的 ctx 作为上级.
+func WithTracer(tracer Tracer) Option {
+	return Option{F: func(o *Options) {
+		if tracer != nil {
+			o.Tracer = tracer
+		}
+	}}
+}
+
+// WithQueueOptions 设置每个连接的队列大小和队列满了的处理方式, 默认大小10 阻塞.
+// 阻塞的情况一个终端处理慢了 该终端的心跳等报文也读取不到, 可以设置 OnOverflowEvent 及时发现.
+// 处理方式同时作用于终端上传和平台主动下发的队列, 平台主动下发被丢弃的返回 ErrQueueOverflow.
+//
+// 使用示例：
+//
+//	service.WithQueueOptions(service.QueueOptions{
+//		UplinkSize: 100,
+//		Policy:     service.OverflowDropOldest,
+//		OnOverflowEvent: func(overflow service.QueueOverflow) {
+//			slog.Warn("queue overflow", slog.String("key", overflow.Key), slog.Uint64("sum", overflow.Sum))
+//		},
+//	}),
+func WithQueueOptions(queue QueueOptions) Option {
+	return Option{F: func(o *Options) {
+		o.Queue = queue
+	}}
+}
+
+// WithRateLimit 设置每个终端的限流, 默认不限流.
+// 用于防止异常终端一次性补传大量盲区数据等情况.
+//
+// 使用示例：
+//
+//	service.WithRateLimit(service.RateLimit{
+//		MessagesPerSecond: 50,
+//		BytesPerSecond:    64 * 1024,
+//		Action:            service.RateLimitDelay,
+//		MaxPendingBytes:   64 * 1024,
+//	}),
+func WithRateLimit(limit RateLimit) Option {
+	return Option{F: func(o *Options) {
+		o.RateLimit = &limit
+	}}
+}
+
+// WithMaxConnections 设置最大连接数, 超过后新的连接直接关闭, <=0不限制(默认).
+func WithMaxConnections(maxConnections int) Option {
+	return Option{F: func(o *Options) {
+		o.MaxConnections = maxConnections
+	}}
+}
+
+// WithTLSConfig 使用TLS接收终端连接, 仅TCP有效, 默认不使用.
+// 需要校验客户端证书的情况设置 config.ClientAuth 和 config.ClientCAs,
+// 证书和终端的对应关系见 WithCertificateKeyFunc.
+func WithTLSConfig(config *tls.Config) Option {
+	return Option{F: func(o *Options) {
+		o.TLSConfig = config
+	}}
+}
+
+// WithCertificateKeyFunc 设置从TLS客户端证书获取终端key的方式, 需要和 WithTLSConfig 一起使用.
+// 终端加入时 key 和证书对应的不一致(或者没有客户端证书)的情况断开连接, 错误为 ErrCertificateKeyMismatch.
+// 对所有监听地址生效, 不是TLS的连接(没有 TLSConfig 的 Listener、UDP)同样断开, 因此需要每个监听地址都使用TLS.
+//
+// 使用示例：
+//
+//	service.WithTLSConfig(&tls.Config{
+//		Certificates: []tls.Certificate{cert},
+//		ClientAuth:   tls.RequireAndVerifyClientCert,
+//		ClientCAs:    pool,
+//	}),
+//	service.WithCertificateKeyFunc(service.CertificateCommonName),
+func WithCertificateKeyFunc(keyFunc func(cert *x509.Certificate) string) Option {
+	return Option{F: func(o *Options) {
+		o.CertificateKeyFunc = keyFunc
+	}}
+}
+
+// WithProxyProtocol 解析负载均衡发送的 PROXY protocol(v1/v2) 头部, 仅TCP有效, 默认不解析.
+// 开启后 TerminalTimeout.Address、SessionInfo.RemoteAddress 和日志中都是终端的真实地址.
+// 同时使用TLS的情况 头部在TLS握手之前.
+//
+// 使用示例：
+//
+//	service.WithProxyProtocol(service.ProxyProtocol{
+//		Timeout:  3 * time.Second,
+//		Required: true, // 只允许通过负载均衡连接
+//	}),
+func WithProxyProtocol(proxy ProxyProtocol) Option {
+	return Option{F: func(o *Options) {
+		o.ProxyProtocol = &proxy
+	}}
+}
+
+// WithListeners 除了 WithHostPorts 的地址以外 同时监听其他的地址, 所有地址的终端共用一个会话管理.
+// 每个地址可以单独设置协议、TLS、PROXY protocol 和消息处理, 不会继承主地址的TLS和PROXY protocol设置.
+//
+// 使用示例：
+//
+//	service.WithHostPorts("0.0.0.0:808"), // 旧的终端
+//	service.WithListeners(service.Listener{
+//		Addr:      "0.0.0.0:7808", // 新的终端 使用TLS
+//		TLSConfig: tlsConfig,
+//	}, service.Listener{
+//		Addr:    "0.0.0.0:808",
+//		Network: "udp",
+//	}),
+func WithListeners(listeners ...Listener) Option {
+	return Option{F: func(o *Options) {
+		o.Listeners = append(o.Listeners, listeners...)
+	}}
+}
+
+// WithMiddleware 添加终端上传报文的中间件, 按添加的顺序执行(第一个在最外层).
+// 用于统一的日志、校验、修改报文等, 不需要替换每一个 Handler.
+//
+// 使用示例：
+//
+//	service.WithMiddleware(func(next service.HandlerFunc) service.HandlerFunc {
+//		return func(msg *service.Message) error {
+//			start := time.Now()
+//			err := next(msg)
+//			slog.Info("uplink", slog.String("key", msg.Key),
+//				slog.String("command", msg.Command.String()), slog.Duration("cost", time.Since(start)))
+//			return err
+//		}
+//	}),
+func WithMiddleware(middlewares ...Middleware) Option {
+	return Option{F: func(o *Options) {
+		o.Middlewares = append(o.Middlewares, middlewares...)
+	}}
+}
+
+// WithActiveMiddleware 添加平台主动下发的中间件, 按添加的顺序执行(第一个在最外层).
+// 中间件返回错误的情况不再下发, SendActiveMessage 返回的 Message.ExtensionFields.Err 包含该错误.
+func WithActiveMiddleware(middlewares ...ActiveMiddleware) Option {
+	return Option{F: func(o *Options) {
+		o.ActiveMiddlewares = append(o.ActiveMiddlewares, middlewares...)
+	}}
+}
+
+// WithHandlerPanic 设置用户回调发生 panic 的处理.
+// 默认情况下 Handler、TerminalEventer、中间件等用户回调的 panic 都会被恢复并记录日志, 不会影响其他终端.
+// KeyFunc、DuplicateKeyFunc、Authenticator 和离线指令的 onEvent 同样会恢复:
+//   - KeyFunc panic 按key无效处理(UDP 使用终端地址区分)
+//   - DuplicateKeyFunc panic 按 DuplicateKeyRejectNew 处理
+//   - Authenticator panic 按注册或鉴权失败回复
+//
+// 参数说明：
+//
+//	onPanic    - panic 事件 可以为nil 在发生 panic 的协程中执行 不能阻塞
+//	disconnect - 是否断开发生 panic 的终端 false的情况跳过该回调继续处理
+func WithHandlerPanic(onPanic func(p HandlerPanic), disconnect bool) Option {
+	return Option{F: func(o *Options) {
+		o.OnHandlerPanic = onPanic
+		o.PanicDisconnect = disconnect
+	}}
+}
+
+// WithCluster 开启集群, 多个节点共用 SessionRegistry 记录终端所在的节点.
+// SendActiveMessage 的终端不在本节点时 通过 Transport 转发到终端所在的节点下发并返回应答,
+// 终端不在任何节点的情况按照本节点不在线处理(离线指令等).
+//
+// 使用示例：
+//
+//	registry := service.NewMemorySessionRegistry() // 实际使用 redis、etcd 等实现
+//	goJt808 := service.New(
+//		service.WithHostPorts("0.0.0.0:808"),
+//		service.WithCluster(service.Cluster{
+//			NodeID:    "node-1",
+//			Registry:  registry,
+//			Transport: service.NewTCPTransport("10.0.0.1:18080", map[string]string{"node-2": "10.0.0.2:18080"},
+//				service.TCPTransportAuth{Secret: []byte(os.Getenv("JT808_CLUSTER_SECRET"))}),
+//		}),
+//	)
+func WithCluster(cluster Cluster) Option {
+	return Option{F: func(o *Options) {
+		o.Cluster = &cluster
+	}}
+}
+
+// WithRSAPrivateKey 设置平台的RSA私钥, 终端上传RSA加密的消息体时使用该私钥解密后再处理.
+// 终端上传RSA公钥(0x0A00)后 平台下发给该终端的消息体都使用终端的公钥加密,
+// 开启鉴权的情况 鉴权通过后上传的公钥才会保存, 公钥需要是1024位的.
+// 平台的公钥通过主动下发 0x8A00 发送给终端.
+//
+// 使用示例：
+//
+//	priv, _ := rsa.GenerateKey(rand.Reader, 1024) // JT808 使用1024位的RSA
+//	goJt808 := service.New(service.WithRSAPrivateKey(priv))
+//	// 终端加入后发送平台的公钥
+//	p8a00, _ := model.NewP0x8A00(&priv.PublicKey)
+//	goJt808.SendActiveMessage(service.NewActiveMessage(key, consts.P8A00PlatformRSAPublicKey,
+//		p8a00.Encode(), 3*time.Second))
+func WithRSAPrivateKey(priv *rsa.PrivateKey) Option {
+	return Option{F: func(o *Options) {
+		o.RSAPrivateKey = priv
+	}}
+}
+
+// WithDecodeOptions 设置终端报文的解码选项, 用于兼容部分设备不规范的报文(校验码错误、消息体长度不一致等).
+// 解码失败的错误为 *jt808.DecodeError, 日志中包含出错的位置、期望值和实际值以及原始报文.
+//
+// 参数说明：
+//
+//	opts - 解码选项 默认严格模式 见 jt808.StrictDecodeOptions 和 jt808.LenientDecodeOptions
+//	skip - 解码失败时是否跳过该报文继续处理 false的情况断开连接
+//
+// 使用示例：
+//
+//	goJt808 := service.New(service.WithDecodeOptions(jt808.LenientDecodeOptions(), true))
+func WithDecodeOptions(opts jt808.DecodeOptions, skip bool) Option {
+	return Option{F: func(o *Options) {
+		o.DecodeOptions = opts
+		o.SkipDecodeError = skip
+	}}
+}
+
+// WithMaxBodyLength 设置平台下发时单个包 body最大长度, 超过的分包下发, 默认1000.
+// 范围为 1-1023, 其他的值使用默认的1000. 单条主动下发可以使用 ActiveMessage.MaxBodyLength 修改.
+func WithMaxBodyLength(maxBodyLength int) Option {
+	return Option{F: func(o *Options) {
+		o.MaxBodyLength = maxBodyLength
+	}}
+}
+
+// WithProtocolVersionFunc 根据终端手机号指定协议版本(2011或2013), 2011和2013版本的固定头相同 无法从报文中区分.
+// 默认根据终端注册(0x0100)的消息体判断, 判断为2011版本后 该连接的报文都按照2011版本解析.
+// 默认的判断不一定准确: 消息体超过36个字节并且第36个字节是合法的车牌颜色时按照2013版本,
+// 如2011版本的车牌后补0x00的终端会被误判, 这种情况必须使用此函数指定版本.
+// 2019版本根据固定头判断 不受影响, 终端的协议版本见 SessionInfo.ProtocolVersion.
+//
+// 使用示例：
+//
+//	goJt808 := service.New(service.WithProtocolVersionFunc(func(phone string) (consts.ProtocolVersionType, bool) {
+//		_, ok := old2011Terminals[phone]
+//		return consts.JT808Protocol2011, ok
+//	}))
+func WithProtocolVersionFunc(f jt808.ProtocolVersionFunc) Option {
+	return Option{F: func(o *Options) {
+		o.ProtocolVersionFunc = f
+	}}
+}
@@ -1,24 +1,36 @@
 package service
 
 import (
-	"fmt"
+	"bytes"
 	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
 	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 	"log/slog"
 	"time"
 )
 
+// subPackagePreallocLimit 分包body预分配的上限, 分包总数和长度来自终端的报文头 不可信,
+// 超过的部分随着分包的到达再扩容.
+const subPackagePreallocLimit = 16 * 1024
+
 type (
 	packageParse struct {
 		frameReader          *jt808.FrameReader
 		subcontractingRecord map[uint16][][]byte
 		timeoutRecord        map[uint16]*packageComplete
+		metrics              Metrics
+		// decodeOptions 解码选项 默认严格模式
+		decodeOptions jt808.DecodeOptions
+		// skipDecodeError 解码失败时跳过该报文 不返回错误
+		skipDecodeError bool
 	}
 
 	packageComplete struct {
 		createTime time.Time
 		updateTime time.Time
 		initHeader *jt808.Header
+		// data 分包的body依次追加到这里 避免每个分包都分配一次内存
+		data []byte
 	}
 )
 
@@ -27,6 +39,7 @@ func newPackageParse() *packageParse {
 		frameReader:          jt808.NewFrameReader(),
 		subcontractingRecord: make(map[uint16][][]byte),
 		timeoutRecord:        make(map[uint16]*packageComplete),
+		metrics:              nopMetrics{},
 	}
 }
 
@@ -76,12 +89,22 @@ func (p *packageParse) unpack(data []byte) (msgs []*Message, err error) {
 	return msgs, nil
 }
 
-func (p *packageParse) decodeFrame(originalData []byte, msgs []*Message) ([]*Message, error) {
+func (p *packageParse) decodeFrame(frame []byte, msgs []*Message) ([]*Message, error) {
+	// frame 引用读取缓冲区或者粘包缓冲区 下一次读取会复用
+	// 报文会交给 write 协程异步回复 因此拷贝一份 Body 和 TerminalData 都引用这份拷贝
+	originalData := bytes.Clone(frame)
 	jtMsg := jt808.NewJTMessage()
-	if err := jtMsg.Decode(originalData); err != nil {
-		return msgs, fmt.Errorf("%w [%x]", err, originalData)
+	if err := p.decodeOptions.Decode(jtMsg, originalData); err != nil {
+		if p.skipDecodeError {
+			p.metrics.IncDecodeError()
+			slog.Warn("skip decode error",
+				slog.Any("err", err))
+			return msgs, nil
+		}
+		return msgs, err
 	}
 	msg := newTerminalMessage(jtMsg, originalData)
+	p.metrics.IncMessageIn(msg.Command)
 	return append(msgs, msg), nil
 }
 
@@ -110,20 +133,23 @@ func (p *packageParse) completePack(msg *Message) (*Message, bool) {
 			return nil, false
 		}
 
-		// 分包的情况 每一次都确保是新的
-		p.subcontractingRecord[id][seq-1] = make([]byte, len(msg.JTMessage.Body))
-		copy(p.subcontractingRecord[id][seq-1], msg.JTMessage.Body)
+		// 分包的body是读取缓冲区的视图 需要保存一份 追加到该分包的缓冲区中
+		record := p.timeoutRecord[id]
+		start := len(record.data)
+		record.data = append(record.data, msg.JTMessage.Body...)
+		p.subcontractingRecord[id][seq-1] = record.data[start:len(record.data):len(record.data)]
 
-		p.timeoutRecord[id].updateTime = time.Now()
-		receivedSum := 0
+		record.updateTime = time.Now()
+		receivedSum, size := 0, 0
 		for _, data := range p.subcontractingRecord[id] {
 			if len(data) != 0 {
 				receivedSum++
+				size += len(data)
 			}
 		}
 		// 接收的和记录的一样 说明完成了
 		if receivedSum == sum {
-			data := make([]byte, 0, sum*1023)
+			data := make([]byte, 0, size)
 			for i := 0; i < sum; i++ {
 				data = append(data, p.subcontractingRecord[id][i]...)
 			}
@@ -144,6 +170,7 @@ func (p *packageParse) add(id uint16, header *jt808.Header) {
 		createTime: now,
 		updateTime: now,
 		initHeader: header,
+		data:       make([]byte, 0, min(int(header.SubPackageSum)*int(header.Property.BodyDayaLen), subPackagePreallocLimit)),
 	}
 }
 
@@ -157,6 +184,7 @@ func (p *packageParse) deleteTimeoutPackage() {
 	for k, v := range p.timeoutRecord {
 		if now.After(v.createTime) { // x秒内还没有完成的 就删除了
 			p.remove(k)
+			p.metrics.IncSubPackageTimeout(consts.JT808CommandType(k))
 			slog.Warn("timeout",
 				slog.Any("id", k),
 				slog.String("remove", v.initHeader.String()))
@@ -1,10 +1,17 @@
 package service
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol"
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 )
 
 func Test_packageParse_unpack(t *testing.T) {
@@ -111,3 +118,130 @@ func Test_packageParse_unpack(t *testing.T) {
 		})
 	}
 }
+
+func Test_packageParse_completePack(t *testing.T) {
+	jtMsg := jt808.NewJTMessage()
+	data, _ := hex.DecodeString("7e0002000001234567890100008a7e")
+	_ = jtMsg.Decode(data)
+	jtMsg.Header.ReplyID = uint16(consts.T0801MultimediaDataUpload)
+	body := make([]byte, 2500)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	packets := jtMsg.Header.EncodePackets(body)
+
+	p := newPackageParse()
+	// 模拟 reader 复用读取缓冲区 分包的body需要保存一份
+	buf := make([]byte, 1100)
+	var complete *Message
+	for _, i := range []int{0, 2, 1} {
+		n := copy(buf, packets[i])
+		msgs, err := p.parse(buf[:n])
+		if err != nil {
+			t.Fatalf("parse() error = %v", err)
+		}
+		clear(buf)
+		for _, msg := range msgs {
+			if msg.ExtensionFields.SubcontractComplete {
+				complete = msg
+			}
+		}
+	}
+	if complete == nil {
+		t.Fatal("subcontract not complete")
+	}
+	if !bytes.Equal(complete.Body, body) {
+		t.Errorf("complete body = %x\n want %x", complete.Body, body)
+	}
+	if len(p.subcontractingRecord) != 0 || len(p.timeoutRecord) != 0 {
+		t.Errorf("record not remove %d %d", len(p.subcontractingRecord), len(p.timeoutRecord))
+	}
+}
+
+func Test_packageParse_prealloc(t *testing.T) {
+	// 报文头声明的分包总数和长度不可信 预分配不超过上限
+	p := newPackageParse()
+	header := &jt808.Header{SubPackageSum: 65535, Property: &jt808.BodyProperty{BodyDayaLen: 1023}}
+	p.add(1, header)
+	if c := cap(p.timeoutRecord[1].data); c > subPackagePreallocLimit {
+		t.Fatalf("prealloc cap = %d, want <= %d", c, subPackagePreallocLimit)
+	}
+
+	// 超过上限的分包 随着分包到达扩容 合并结果不变
+	jtMsg := jt808.NewJTMessage()
+	data, _ := hex.DecodeString("7e0002000001234567890100008a7e")
+	_ = jtMsg.Decode(data)
+	jtMsg.Header.ReplyID = uint16(consts.T0801MultimediaDataUpload)
+	body := make([]byte, 3*subPackagePreallocLimit)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	p = newPackageParse()
+	var complete *Message
+	for _, packet := range jtMsg.Header.EncodePackets(body) {
+		msgs, err := p.parse(packet)
+		if err != nil {
+			t.Fatalf("parse() error = %v", err)
+		}
+		for _, msg := range msgs {
+			if msg.ExtensionFields.SubcontractComplete {
+				complete = msg
+			}
+		}
+	}
+	if complete == nil || !bytes.Equal(complete.Body, body) {
+		t.Fatal("subcontract body not equal")
+	}
+}
+
+func Test_packageParse_decodeOptions(t *testing.T) {
+	// 校验码错误的心跳 + 转义错误的数据 + 正确的心跳
+	data, _ := hex.DecodeString("7e0002000001234567890100008b7e" + "7e02007d037e" + "7e0002000001234567890100008a7e")
+
+	p := newPackageParse()
+	msgs, err := p.parse(data)
+	var decodeErr *jt808.DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, protocol.ErrCheckCode) || len(msgs) != 0 {
+		t.Fatalf("parse() msgs = %d error = %v", len(msgs), err)
+	}
+	if decodeErr.Expected != 0x8a || decodeErr.Actual != 0x8b {
+		t.Errorf("DecodeError = %+v", decodeErr)
+	}
+
+	p = newPackageParse()
+	p.decodeOptions = jt808.LenientDecodeOptions()
+	p.skipDecodeError = true
+	metrics := NewPrometheusMetrics()
+	p.metrics = metrics
+	msgs, err = p.parse(data)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("parse() msgs = %d error = %v", len(msgs), err)
+	}
+	var sb strings.Builder
+	_, _ = metrics.WriteTo(&sb)
+	if !strings.Contains(sb.String(), "jt808_decode_errors_total 1\n") {
+		t.Errorf("metrics = %s", sb.String())
+	}
+}
+
+func TestService_decodeOptions(t *testing.T) {
+	_, addr := startTestServer(t, WithDecodeOptions(jt808.LenientDecodeOptions(), true))
+	conn := dialTerminal(t, addr)
+	// 校验码错误的心跳 宽松模式正常回复
+	if _, err := conn.Write(mustHex("7e0002000001234567890100008b7e")); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 0 {
+		t.Fatalf("heartbeat result = %d, want 0", result)
+	}
+	// 无法解码的报文跳过 连接不断开
+	if _, err := conn.Write(mustHex("7e02007d037e")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 0 {
+		t.Fatalf("heartbeat result = %d, want 0", result)
+	}
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"log/slog"
+	"net"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/proxyproto"
+)
+
+// ProxyProtocol 解析负载均衡(HAProxy、LVS等)在连接开头发送的 PROXY protocol 头部, 见 WithProxyProtocol.
+// 支持 v1(文本) 和 v2(二进制), 解析后终端的地址为头部中的源地址.
+type ProxyProtocol = proxyproto.Config
+
+// serveProxyConn 在新的协程中读取 PROXY 头部 避免阻塞接收新的连接.
+func (g *GoJT808) serveProxyConn(conn net.Conn, l *Listener) {
+	g.mu.Lock()
+	if g.closed.Load() {
+		g.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	g.wg.Add(1)
+	g.mu.Unlock()
+
+	go func() {
+		defer g.wg.Done()
+		proxy, err := proxyproto.ReadHeader(conn, *l.ProxyProtocol)
+		if err != nil {
+			slog.Warn("proxy protocol",
+				slog.String("address", conn.RemoteAddr().String()),
+				slog.Any("err", err))
+			_ = conn.Close()
+			return
+		}
+		g.serveTCPConn(proxy, l)
+	}()
+}
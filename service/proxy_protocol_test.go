@@ -0,0 +1,41 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestService_proxyProtocol(t *testing.T) {
+	// 头部的解析见 shared/proxyproto 这里只验证接入服务后终端的地址
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithProxyProtocol(ProxyProtocol{Required: true}),
+	)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	header := []byte("PROXY TCP4 203.0.113.7 192.168.0.11 56324 808\r\n")
+	if _, err := conn.Write(append(header, heartbeatPacket...)); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+	info, ok := g.Session(key)
+	if !ok {
+		t.Fatalf("Session(%s) not found", key)
+	}
+	if want := "203.0.113.7:56324"; info.RemoteAddress != want {
+		t.Fatalf("RemoteAddress = %s, want %s", info.RemoteAddress, want)
+	}
+}
+
+func TestService_proxyProtocolRequired(t *testing.T) {
+	_, addr := startTestServer(t, WithProxyProtocol(ProxyProtocol{Required: true}))
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	waitClosed(t, conn)
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// defaultQueueSize 连接中各个队列默认的大小.
+const defaultQueueSize = 10
+
+// OverflowPolicy 终端上传报文和平台主动下发的队列满了的处理方式.
+// 队列满了说明 write 协程处理不过来 如 OnWriteExecutionEvent 太慢或者终端大量上报0x0704.
+// 平台主动下发的队列满了 被丢弃的指令返回 ErrQueueOverflow, 不会阻塞会话管理器.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock 阻塞等待队列有空位(默认) 期间不再读取该终端的数据.
+	// 平台主动下发的情况每个连接在一个单独的协程中按顺序等待 直到放入、取消或者连接关闭.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest 丢弃队列中最早的报文 放入新的.
+	// 终端上传的报文中 正在等待的主动下发的应答不会被丢弃.
+	OverflowDropOldest
+	// OverflowDropNewest 丢弃新的报文.
+	OverflowDropNewest
+	// OverflowDisconnect 断开连接.
+	OverflowDisconnect
+)
+
+func (o OverflowPolicy) String() string {
+	switch o {
+	case OverflowBlock:
+		return "阻塞"
+	case OverflowDropOldest:
+		return "丢弃最早的"
+	case OverflowDropNewest:
+		return "丢弃最新的"
+	case OverflowDisconnect:
+		return "断开连接"
+	}
+	return "未知策略"
+}
+
+type (
+	// QueueOptions 每个连接的队列配置, 见 WithQueueOptions.
+	QueueOptions struct {
+		// UplinkSize 终端上传报文的队列大小 默认10
+		UplinkSize int
+		// ActiveSize 平台主动下发的队列大小 默认10
+		ActiveSize int
+		// Policy 终端上传报文和平台主动下发的队列满了的处理方式 默认阻塞
+		Policy OverflowPolicy
+		// OnOverflowEvent 队列满了的事件 可以为nil 不能阻塞,
+		// 终端上传的在连接的读取协程中执行 平台主动下发的在会话管理器中执行
+		OnOverflowEvent func(overflow QueueOverflow)
+	}
+
+	// QueueOverflow 终端上传报文或平台主动下发的队列满了的事件.
+	QueueOverflow struct {
+		// Key 唯一标识符 终端未加入的时候为空
+		Key string
+		// Address 终端的地址
+		Address string
+		// Active true表示平台主动下发的队列满了
+		Active bool
+		// Command 被丢弃的报文的指令 阻塞的情况为等待放入的报文
+		Command consts.JT808CommandType
+		// Policy 处理方式
+		Policy OverflowPolicy
+		// Sum 该连接累计队列满了的次数
+		Sum uint64
+	}
+)
+
+func (q QueueOptions) uplinkSize() int {
+	if q.UplinkSize > 0 {
+		return q.UplinkSize
+	}
+	return defaultQueueSize
+}
+
+func (q QueueOptions) activeSize() int {
+	if q.ActiveSize > 0 {
+		return q.ActiveSize
+	}
+	return defaultQueueSize
+}
+
+// pushUplink 终端上传的报文放入队列, 队列满了按照 OverflowPolicy 处理.
+// 返回错误表示需要断开连接. 在读取协程中执行.
+func (c *connection) pushUplink(msg *Message) error {
+	select {
+	case c.terminalUplinkMsgChan <- msg:
+		return nil
+	default:
+	}
+	switch c.queue.Policy {
+	case OverflowDropNewest:
+		c.onQueueOverflow(msg)
+		c.endUplinkSpan(msg, "overflow dropped", nil)
+	case OverflowDropOldest:
+		c.dropOldestUplink(msg)
+	case OverflowDisconnect:
+		c.onQueueOverflow(msg)
+		err := errors.Join(ErrQueueOverflow, fmt.Errorf("command=[%s] size=[%d]", msg.Command, cap(c.terminalUplinkMsgChan)))
+		c.endUplinkSpan(msg, "overflow disconnect", err)
+		return err
+	default:
+		c.onQueueOverflow(msg)
+		c.terminalUplinkMsgChan <- msg
+	}
+	return nil
+}
+
+// dropOldestUplink 丢弃队列中最早的报文 放入新的, 正在等待的主动下发的应答不丢弃.
+// 只有读取协程会放入 取出后再按原来的顺序放回去不会超过队列大小.
+func (c *connection) dropOldestUplink(msg *Message) {
+	queued := make([]*Message, 0, cap(c.terminalUplinkMsgChan))
+	for drained := false; !drained; {
+		select {
+		case old := <-c.terminalUplinkMsgChan:
+			queued = append(queued, old)
+		default:
+			drained = true
+		}
+	}
+	dropped := false
+	for _, old := range queued {
+		if !dropped && !c.isPendingReply(old) {
+			dropped = true
+			c.onQueueOverflow(old)
+			c.endUplinkSpan(old, "overflow dropped", nil)
+			continue
+		}
+		c.terminalUplinkMsgChan <- old
+	}
+	if !dropped && len(queued) == cap(c.terminalUplinkMsgChan) && !c.isPendingReply(msg) {
+		// 队列中全部是等待的应答 丢弃新的
+		c.onQueueOverflow(msg)
+		c.endUplinkSpan(msg, "overflow dropped", nil)
+		return
+	}
+	// 有空位直接放入, 全部是等待的应答并且新的也是的情况 阻塞等待 write 协程处理
+	c.terminalUplinkMsgChan <- msg
+}
+
+// isPendingReply 终端上传的报文是否为正在等待的主动下发的应答, 在读取协程中执行.
+// 用户的匹配函数可能和 write 协程同时执行 并发要求见 WithCustomActiveRespondHandlerFunc.
+func (c *connection) isPendingReply(msg *Message) bool {
+	matchFunc, ok := c.activeRespondHandles[msg.Command]
+	if !ok || !msg.hasComplete() {
+		return false
+	}
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for _, activeMsg := range c.pendingReplies {
+		matched := false
+		if c.safeCall("ActiveRespondHandler", msg, func() {
+			matched = matchFunc(activeMsg, msg)
+		}) {
+			return false
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// setPendingReply 记录或删除等待应答的主动下发 activeMsg为nil表示删除, 在 write 协程中执行.
+func (c *connection) setPendingReply(seq uint16, activeMsg *ActiveMessage) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if activeMsg == nil {
+		delete(c.pendingReplies, seq)
+		return
+	}
+	c.pendingReplies[seq] = activeMsg
+}
+
+// pushActive 平台主动下发的指令放入队列, 队列满了按照 OverflowPolicy 处理.
+// 在会话管理器的 run 协程中执行 不能阻塞, 阻塞的情况交给 waitActive 协程等待.
+func (c *connection) pushActive(activeMsg *ActiveMessage) {
+	c.activeBlockedMu.Lock()
+	blocked := len(c.activeBlocked) > 0
+	c.activeBlockedMu.Unlock()
+	if !blocked { // 还有在等待的 放在它们后面 保持下发顺序
+		select {
+		case c.activeMsgChan <- activeMsg:
+			return
+		default:
+		}
+	}
+	c.onActiveQueueOverflow(activeMsg)
+	switch c.queue.Policy {
+	case OverflowDropNewest:
+		activeMsg.replyChan <- c.newActiveOverflowMessage(activeMsg)
+	case OverflowDropOldest:
+		// 只有会话管理器会放入 取出一个后一定可以放入
+		select {
+		case old := <-c.activeMsgChan:
+			old.replyChan <- c.newActiveOverflowMessage(old)
+		default:
+		}
+		c.activeMsgChan <- activeMsg
+	case OverflowDisconnect:
+		activeMsg.replyChan <- c.newActiveOverflowMessage(activeMsg)
+		c.kick("active queue overflow")
+	default:
+		c.activeBlockedMu.Lock()
+		c.activeBlocked = append(c.activeBlocked, activeMsg)
+		if len(c.activeBlocked) == 1 {
+			c.activeWaiting.Add(1)
+			go c.waitActive(activeMsg)
+		}
+		c.activeBlockedMu.Unlock()
+	}
+}
+
+// waitActive 按顺序将等待中的主动下发放入队列, 全部处理完后退出. 每个连接最多一个.
+func (c *connection) waitActive(activeMsg *ActiveMessage) {
+	defer c.activeWaiting.Done()
+	for {
+		select {
+		case c.activeMsgChan <- activeMsg:
+		case <-c.stopChan:
+			activeMsg.replyChan <- newErrMessage(errors.Join(ErrConnectionClosed,
+				fmt.Errorf("key=[%s]", c.key)))
+		case <-activeMsg.context().Done():
+			activeMsg.replyChan <- newErrMessage(errors.Join(activeMsg.context().Err(),
+				fmt.Errorf("key=[%s] command=[%s]", c.key, activeMsg.Command)))
+		}
+		// 删除和判断是否为空在同一个锁内 pushActive 看到空的时候一定没有运行中的 waitActive
+		c.activeBlockedMu.Lock()
+		c.activeBlocked[0] = nil
+		c.activeBlocked = c.activeBlocked[1:]
+		if len(c.activeBlocked) == 0 {
+			c.activeBlocked = nil
+			c.activeBlockedMu.Unlock()
+			return
+		}
+		activeMsg = c.activeBlocked[0]
+		c.activeBlockedMu.Unlock()
+	}
+}
+
+func (c *connection) newActiveOverflowMessage(activeMsg *ActiveMessage) *Message {
+	return newErrMessage(errors.Join(ErrQueueOverflow,
+		fmt.Errorf("key=[%s] command=[%s] size=[%d]", c.key, activeMsg.Command, cap(c.activeMsgChan))))
+}
+
+func (c *connection) onActiveQueueOverflow(activeMsg *ActiveMessage) {
+	sum := c.queueOverflowSum.Add(1)
+	c.metrics.IncQueueOverflow(activeMsg.Command)
+	slog.Debug("active queue overflow",
+		slog.String("key", c.key),
+		slog.String("command", activeMsg.Command.String()),
+		slog.String("policy", c.queue.Policy.String()),
+		slog.Uint64("sum", sum))
+	if c.queue.OnOverflowEvent != nil {
+		c.safeCall("OnOverflowEvent", nil, func() {
+			c.queue.OnOverflowEvent(QueueOverflow{
+				Key:     c.key,
+				Address: c.conn.RemoteAddr().String(),
+				Active:  true,
+				Command: activeMsg.Command,
+				Policy:  c.queue.Policy,
+				Sum:     sum,
+			})
+		})
+	}
+}
+
+func (c *connection) onQueueOverflow(msg *Message) {
+	sum := c.queueOverflowSum.Add(1)
+	c.metrics.IncQueueOverflow(msg.Command)
+	slog.Debug("queue overflow",
+		slog.String("key", c.key),
+		slog.String("command", msg.Command.String()),
+		slog.String("policy", c.queue.Policy.String()),
+		slog.Uint64("sum", sum))
+	if c.queue.OnOverflowEvent != nil {
+		c.safeCall("OnOverflowEvent", msg, func() {
+			c.queue.OnOverflowEvent(QueueOverflow{
+				Key:     c.key,
+				Address: c.conn.RemoteAddr().String(),
+				Command: msg.Command,
+				Policy:  c.queue.Policy,
+				Sum:     sum,
+			})
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// blockingTerminalEvent write 协程中的写事件阻塞 直到 gate 关闭.
+type blockingTerminalEvent struct {
+	*recordingTerminalEvent
+	gate chan struct{}
+}
+
+func (b *blockingTerminalEvent) OnWriteExecutionEvent(_ Message) {
+	<-b.gate
+}
+
+func TestService_queueOverflowDropNewest(t *testing.T) {
+	events := &blockingTerminalEvent{recordingTerminalEvent: newRecordingTerminalEvent(), gate: make(chan struct{})}
+	overflows := make(chan QueueOverflow, 16)
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithQueueOptions(QueueOptions{
+			UplinkSize: 1,
+			Policy:     OverflowDropNewest,
+			OnOverflowEvent: func(overflow QueueOverflow) {
+				overflows <- overflow
+			},
+		}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+	defer close(events.gate)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(bytes.Repeat(heartbeatPacket, 5)); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	// 第一个在 write 协程中阻塞 第二个在队列中 剩下的都丢弃了
+	for i := 0; i < 3; i++ {
+		overflow := waitChan(t, overflows, 2*time.Second)
+		if overflow.Policy != OverflowDropNewest || overflow.Command != consts.T0002HeartBeat {
+			t.Fatalf("overflow = %+v", overflow)
+		}
+	}
+	// 读取协程没有阻塞 仍然可以处理后续的报文
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = waitChan(t, overflows, 2*time.Second)
+	if info, _ := g.Session(key); info.QueueOverflowSum < 4 {
+		t.Fatalf("Session().QueueOverflowSum = %d, want >= 4", info.QueueOverflowSum)
+	}
+}
+
+func TestService_queueOverflowDisconnect(t *testing.T) {
+	events := &blockingTerminalEvent{recordingTerminalEvent: newRecordingTerminalEvent(), gate: make(chan struct{})}
+	_, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithQueueOptions(QueueOptions{UplinkSize: 1, Policy: OverflowDisconnect}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(bytes.Repeat(heartbeatPacket, 5)); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = waitChan(t, events.joined, 2*time.Second)
+	if key := waitChan(t, events.left, 2*time.Second); key != "12345678901" {
+		t.Fatalf("leave key = %s, want 12345678901", key)
+	}
+	close(events.gate)
+
+	// 第一个心跳的应答之后 连接被关闭
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("connection not closed after queue overflow")
+			}
+			return
+		}
+	}
+}
+
+func TestService_activeQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  OverflowPolicy
+		dropped int // 返回 ErrQueueOverflow 的是第几条
+	}{
+		{name: "丢弃最早的", policy: OverflowDropOldest, dropped: 0},
+		{name: "丢弃最新的", policy: OverflowDropNewest, dropped: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &blockingTerminalEvent{recordingTerminalEvent: newRecordingTerminalEvent(), gate: make(chan struct{})}
+			overflows := make(chan QueueOverflow, 16)
+			g, addr := startTestServer(t,
+				WithCustomTerminalEventer(func() TerminalEventer { return events }),
+				WithQueueOptions(QueueOptions{
+					ActiveSize: 1,
+					Policy:     tt.policy,
+					OnOverflowEvent: func(overflow QueueOverflow) {
+						overflows <- overflow
+					},
+				}),
+			)
+			drainStringChan(events.left)
+			drainStringChan(events.joined)
+			defer close(events.gate)
+
+			// 心跳的应答在 write 协程中阻塞
+			conn := dialTerminal(t, addr)
+			if _, err := conn.Write(heartbeatPacket); err != nil {
+				t.Fatalf("Write heartbeat error = %v", err)
+			}
+			key := waitChan(t, events.joined, 2*time.Second)
+
+			activeMsgs := []*ActiveMessage{
+				NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x31}, time.Second),
+				NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x32}, time.Second),
+			}
+			g.sessionManager.dispatch(activeMsgs)
+			reply := waitChan(t, activeMsgs[tt.dropped].replyChan, 2*time.Second)
+			if !errors.Is(reply.ExtensionFields.Err, ErrQueueOverflow) {
+				t.Fatalf("reply err = %v, want %v", reply.ExtensionFields.Err, ErrQueueOverflow)
+			}
+			if overflow := waitChan(t, overflows, 2*time.Second); !overflow.Active || overflow.Policy != tt.policy {
+				t.Fatalf("overflow = %+v", overflow)
+			}
+		})
+	}
+}
+
+func TestService_activeQueueOverflowBlock(t *testing.T) {
+	events := &blockingTerminalEvent{recordingTerminalEvent: newRecordingTerminalEvent(), gate: make(chan struct{})}
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithQueueOptions(QueueOptions{ActiveSize: 1}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	activeMsgs := []*ActiveMessage{
+		NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x31}, time.Second),
+		NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x32}, time.Second),
+	}
+	g.sessionManager.dispatch(activeMsgs)
+	// 等待放入队列的不阻塞会话管理器
+	if _, ok := g.Session(key); !ok {
+		t.Fatal("Session() not found")
+	}
+	// 连接关闭后 队列中的和等待放入的都结束
+	_ = conn.Close()
+	_ = waitChan(t, events.left, 2*time.Second)
+	close(events.gate)
+	for i, activeMsg := range activeMsgs {
+		if reply := waitChan(t, activeMsg.replyChan, 2*time.Second); reply.ExtensionFields.Err == nil {
+			t.Fatalf("reply[%d] err is nil", i)
+		}
+	}
+}
+
+func TestConnection_activeBlockInOrder(t *testing.T) {
+	c := newConnection(connectionParams{
+		metrics: nopMetrics{},
+		queue:   QueueOptions{ActiveSize: 1},
+	})
+	activeMsgs := make([]*ActiveMessage, 5)
+	for i := range activeMsgs {
+		activeMsgs[i] = NewActiveMessage("12345678901", consts.P8300TextInfoDistribution, []byte{0x01, byte(i)}, time.Second)
+		c.pushActive(activeMsgs[i])
+	}
+	// 只有一个协程等待 其余的按顺序排在后面
+	c.activeBlockedMu.Lock()
+	blocked := len(c.activeBlocked)
+	c.activeBlockedMu.Unlock()
+	if blocked != 4 {
+		t.Fatalf("activeBlocked = %d, want 4", blocked)
+	}
+	for i, want := range activeMsgs {
+		if got := waitChan(t, c.activeMsgChan, time.Second); got != want {
+			t.Fatalf("activeMsg[%d] out of order", i)
+		}
+	}
+	c.activeWaiting.Wait()
+	if c.activeBlocked != nil {
+		t.Fatalf("activeBlocked = %d, want nil", len(c.activeBlocked))
+	}
+	if sum := c.queueOverflowSum.Load(); sum != 4 {
+		t.Fatalf("queueOverflowSum = %d, want 4", sum)
+	}
+}
+
+func TestConnection_dropOldestKeepPendingReply(t *testing.T) {
+	c := newConnection(connectionParams{
+		metrics: nopMetrics{},
+		queue:   QueueOptions{UplinkSize: 2, Policy: OverflowDropOldest},
+		activeRespondHandles: map[consts.JT808CommandType]func(*ActiveMessage, *Message) bool{
+			consts.T0001GeneralRespond: func(activeMsg *ActiveMessage, terminalMsg *Message) bool {
+				var t0x0001 model.T0x0001
+				return t0x0001.Parse(terminalMsg.JTMessage) == nil && t0x0001.SerialNumber == activeMsg.ExtensionFields.PlatformSeq
+			},
+		},
+	})
+	activeMsg := NewActiveMessage("12345678901", consts.P8300TextInfoDistribution, nil, time.Second)
+	activeMsg.ExtensionFields.PlatformSeq = 5
+	c.setPendingReply(5, activeMsg)
+
+	newMsg := func(data []byte) *Message {
+		return newTerminalMessage(mustDecodeJTMessage(t, data), data)
+	}
+	reply := newMsg(encodeGeneralRespond(t, 5, consts.P8300TextInfoDistribution, 1))
+	heartbeat := newMsg(heartbeatPacket)
+	latest := newMsg(heartbeatPacket)
+	c.terminalUplinkMsgChan <- reply
+	c.terminalUplinkMsgChan <- heartbeat
+	if err := c.pushUplink(latest); err != nil {
+		t.Fatalf("pushUplink() error = %v", err)
+	}
+	// 等待的应答在最前面 也不会被丢弃
+	if got := <-c.terminalUplinkMsgChan; got != reply {
+		t.Fatalf("first = %s, want reply", got.Command)
+	}
+	if got := <-c.terminalUplinkMsgChan; got != latest {
+		t.Fatalf("second = %s, want latest heartbeat", got.Command)
+	}
+
+	// 队列中全部是等待的应答 丢弃新的
+	other := newMsg(encodeGeneralRespond(t, 5, consts.P8300TextInfoDistribution, 2))
+	c.terminalUplinkMsgChan <- reply
+	c.terminalUplinkMsgChan <- other
+	if err := c.pushUplink(heartbeat); err != nil {
+		t.Fatalf("pushUplink() error = %v", err)
+	}
+	if got := <-c.terminalUplinkMsgChan; got != reply {
+		t.Fatalf("first = %s, want reply", got.Command)
+	}
+	if got := <-c.terminalUplinkMsgChan; got != other {
+		t.Fatalf("second = %s, want other reply", got.Command)
+	}
+	if sum := c.queueOverflowSum.Load(); sum != 2 {
+		t.Fatalf("queueOverflowSum = %d, want 2", sum)
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// RateLimitAction 终端发送的报文超过限流后的处理方式.
+type RateLimitAction int
+
+const (
+	// RateLimitDelay 延迟读取 等到有足够的令牌再继续读取该终端的数据(默认).
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitReplyFail 超出的报文回复通用应答(0x8001)失败 不做处理.
+	RateLimitReplyFail
+	// RateLimitDisconnect 断开连接.
+	RateLimitDisconnect
+)
+
+func (r RateLimitAction) String() string {
+	switch r {
+	case RateLimitDelay:
+		return "延迟读取"
+	case RateLimitReplyFail:
+		return "回复失败"
+	case RateLimitDisconnect:
+		return "断开连接"
+	}
+	return "未知处理方式"
+}
+
+// RateLimit 每个终端的限流配置, 见 WithRateLimit.
+// 使用令牌桶限制报文数量和字节数, 同一个 key 同时只有一个在线的连接, 因此每个连接独立计算.
+type RateLimit struct {
+	// MessagesPerSecond 每秒最多的报文数量(分包的情况每个分包都算) <=0不限制
+	MessagesPerSecond float64
+	// MessageBurst 报文数量的突发上限 默认为 MessagesPerSecond 最少1
+	MessageBurst int
+	// BytesPerSecond 每秒最多的字节数 <=0不限制
+	BytesPerSecond float64
+	// ByteBurst 字节数的突发上限 默认为 BytesPerSecond 最少1023(一次读取的大小)
+	ByteBurst int
+	// Action 超过限流后的处理方式
+	Action RateLimitAction
+	// MaxPendingBytes 还未组成完整报文的缓存最多的字节数 超过断开连接 <=0不限制
+	MaxPendingBytes int
+}
+
+// tokenBucket 令牌桶 仅在连接的读取协程中使用 无需加锁.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, minBurst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(rate, minBurst)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+func (t *tokenBucket) refill(now time.Time) {
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+}
+
+// allow 令牌足够的情况消耗 n 个令牌并返回true.
+func (t *tokenBucket) allow(n float64, now time.Time) bool {
+	t.refill(now)
+	if t.tokens < n {
+		return false
+	}
+	t.tokens -= n
+	return true
+}
+
+// reserve 消耗 n 个令牌(可以透支) 返回需要等待的时间.
+func (t *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	t.refill(now)
+	t.tokens -= n
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
+
+// rateLimiter 一个连接的限流.
+type rateLimiter struct {
+	RateLimit
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	return &rateLimiter{
+		RateLimit: *limit,
+		messages:  newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst, 1),
+		bytes:     newTokenBucket(limit.BytesPerSecond, limit.ByteBurst, 1023),
+	}
+}
+
+// onRateLimit 对一次读取的数据和解析出的报文限流. 在读取协程中执行.
+// 返回没有超过限流的报文和下一次读取前需要等待的时间, 返回错误表示需要断开连接.
+func (c *connection) onRateLimit(msgs []*Message, n int, pending int) ([]*Message, time.Duration, error) {
+	limiter := c.rateLimiter
+	if limiter.MaxPendingBytes > 0 && pending > limiter.MaxPendingBytes {
+		return nil, 0, errors.Join(ErrRateLimited,
+			fmt.Errorf("pending bytes [%d] > [%d]", pending, limiter.MaxPendingBytes))
+	}
+	now := time.Now()
+	if limiter.Action == RateLimitDelay {
+		var wait time.Duration
+		if limiter.bytes != nil {
+			wait = limiter.bytes.reserve(float64(n), now)
+		}
+		if limiter.messages != nil && len(msgs) > 0 {
+			wait = max(wait, limiter.messages.reserve(float64(len(msgs)), now))
+		}
+		return msgs, wait, nil
+	}
+
+	bytesAllowed := limiter.bytes == nil || limiter.bytes.allow(float64(n), now)
+	if !bytesAllowed && limiter.Action == RateLimitDisconnect {
+		return nil, 0, errors.Join(ErrRateLimited, fmt.Errorf("bytes=[%d]", n))
+	}
+	allowed := msgs[:0]
+	for _, msg := range msgs {
+		if bytesAllowed && (limiter.messages == nil || limiter.messages.allow(1, now)) {
+			allowed = append(allowed, msg)
+			continue
+		}
+		if limiter.Action == RateLimitDisconnect {
+			return nil, 0, errors.Join(ErrRateLimited, fmt.Errorf("command=[%s]", msg.Command))
+		}
+		msg.Key = c.key
+		slog.Debug("rate limit",
+			slog.String("key", c.key),
+			slog.String("command", msg.Command.String()),
+			slog.String("action", limiter.Action.String()))
+		msg.Handler = newDefaultHandle(&failReplyHandle{command: msg.Command})
+		if err := c.pushUplink(msg); err != nil {
+			return nil, 0, err
+		}
+	}
+	return allowed, 0, nil
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// readFrames 读取到 count 个完整的报文为止.
+func readFrames(t *testing.T, conn net.Conn, count int) {
+	t.Helper()
+	var data []byte
+	for bytes.Count(data, []byte{0x7e}) < count*2 {
+		data = append(data, readPacket(t, conn, 2*time.Second)...)
+	}
+}
+
+func waitClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("connection not closed")
+			}
+			return
+		}
+	}
+}
+
+func TestService_rateLimitReplyFail(t *testing.T) {
+	_, addr := startTestServer(t, WithRateLimit(RateLimit{
+		MessagesPerSecond: 1,
+		MessageBurst:      1,
+		Action:            RateLimitReplyFail,
+	}))
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 0 {
+		t.Fatalf("first heartbeat result = %d, want 0", result)
+	}
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 1 {
+		t.Fatalf("limited heartbeat result = %d, want 1", result)
+	}
+}
+
+func TestService_rateLimitDisconnect(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	_, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithRateLimit(RateLimit{
+			MessagesPerSecond: 1,
+			MessageBurst:      1,
+			Action:            RateLimitDisconnect,
+		}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	if _, err := conn.Write(bytes.Repeat(heartbeatPacket, 2)); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if key := waitChan(t, events.left, 2*time.Second); key != "12345678901" {
+		t.Fatalf("leave key = %s, want 12345678901", key)
+	}
+	waitClosed(t, conn)
+}
+
+func TestService_rateLimitDelay(t *testing.T) {
+	_, addr := startTestServer(t, WithRateLimit(RateLimit{
+		MessagesPerSecond: 5,
+		MessageBurst:      1,
+	}))
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(bytes.Repeat(heartbeatPacket, 3)); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	// 超出的报文仍然处理 只是延迟下一次读取
+	readFrames(t, conn, 3)
+
+	start := time.Now()
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	readFrames(t, conn, 1)
+	// 透支了2个令牌 需要等待400ms
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("delayed heartbeat elapsed = %s, want >= 250ms", elapsed)
+	}
+}
+
+func TestService_rateLimitMaxPendingBytes(t *testing.T) {
+	_, addr := startTestServer(t, WithRateLimit(RateLimit{MaxPendingBytes: 100}))
+
+	conn := dialTerminal(t, addr)
+	// 只有开头的标识位 一直没有结尾
+	data := append([]byte{0x7e}, bytes.Repeat([]byte{0x01}, 200)...)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	waitClosed(t, conn)
+}
+
+func TestService_maxConnections(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithMaxConnections(1),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	first := dialTerminal(t, addr)
+	if _, err := first.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, first, 2*time.Second)
+	_ = waitChan(t, events.joined, 2*time.Second)
+
+	second := dialTerminal(t, addr)
+	waitClosed(t, second)
+
+	_ = first.Close()
+	_ = waitChan(t, events.left, 2*time.Second)
+	waitFor(t, 2*time.Second, func() bool { return g.connectionSum.Load() == 0 })
+	third := dialTerminal(t, addr)
+	if _, err := third.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, third, 2*time.Second)
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// HandlerPanic 用户回调(Handler、TerminalEventer、中间件等)发生了 panic, 见 WithHandlerPanic.
+type HandlerPanic struct {
+	// Key 唯一标识符 终端未加入的时候为空
+	Key string
+	// Address 终端的地址
+	Address string
+	// Callback 发生 panic 的回调 如 Handler.OnReadExecutionEvent
+	Callback string
+	// Command 正在处理的报文的指令 没有报文的情况为0
+	Command consts.JT808CommandType
+	// Message 正在处理的报文 没有报文的情况(如 OnLeaveEvent)为nil
+	Message *Message
+	// Value recover() 的返回值
+	Value any
+	// Stack panic 时的调用栈
+	Stack []byte
+}
+
+// recoverPanic 在 defer 中使用 恢复用户回调的 panic, 返回前的处理见 onHandlerPanic.
+func (c *connection) recoverPanic(callback string, msg *Message) {
+	if v := recover(); v != nil {
+		c.onHandlerPanic(callback, msg, v)
+	}
+}
+
+// safeCall 执行用户回调 发生 panic 的情况返回true.
+func (c *connection) safeCall(callback string, msg *Message, f func()) (panicked bool) {
+	panicked = true
+	defer func() {
+		if panicked {
+			c.onHandlerPanic(callback, msg, recover())
+		}
+	}()
+	f()
+	return false
+}
+
+func (c *connection) onHandlerPanic(callback string, msg *Message, v any) {
+	reportPanic(HandlerPanic{
+		Key:      c.key,
+		Address:  c.conn.RemoteAddr().String(),
+		Callback: callback,
+		Message:  msg,
+		Value:    v,
+	}, c.onPanicEvent)
+	if c.panicDisconnect {
+		c.kick(fmt.Sprintf("handler panic [%s]", callback))
+	}
+}
+
+// safeCall 执行不属于某个连接的用户回调(如 UDP 的 KeyFunc、DuplicateKeyFunc) 发生 panic 的情况返回true.
+// event 填写 panic 之外的信息.
+func safeCall(event HandlerPanic, onPanic func(p HandlerPanic), f func()) (panicked bool) {
+	panicked = true
+	defer func() {
+		if panicked {
+			event.Value = recover()
+			reportPanic(event, onPanic)
+		}
+	}()
+	f()
+	return false
+}
+
+// reportPanic 记录日志并通知 onPanic, onPanic 本身的 panic 只记录日志.
+func reportPanic(event HandlerPanic, onPanic func(p HandlerPanic)) {
+	event.Stack = debug.Stack()
+	if event.Message != nil {
+		event.Command = event.Message.Command
+	}
+	slog.Error("handler panic",
+		slog.String("key", event.Key),
+		slog.String("address", event.Address),
+		slog.String("callback", event.Callback),
+		slog.String("command", event.Command.String()),
+		slog.Any("panic", event.Value),
+		slog.String("stack", string(event.Stack)))
+	if onPanic != nil {
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					slog.Error("OnHandlerPanic panic",
+						slog.String("key", event.Key),
+						slog.Any("panic", v))
+				}
+			}()
+			onPanic(event)
+		}()
+	}
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+type panicHandler struct {
+	model.T0x0002
+}
+
+func (p *panicHandler) OnReadExecutionEvent(_ *Message) { panic("read boom") }
+
+func (p *panicHandler) OnWriteExecutionEvent(_ Message) {}
+
+func panicHeartbeatHandle() map[consts.JT808CommandType]Handler {
+	return map[consts.JT808CommandType]Handler{
+		consts.T0002HeartBeat: &panicHandler{},
+	}
+}
+
+func TestService_handlerPanicRecover(t *testing.T) {
+	panics := make(chan HandlerPanic, 4)
+	_, addr := startTestServer(t,
+		WithCustomHandleFunc(panicHeartbeatHandle),
+		WithHandlerPanic(func(p HandlerPanic) { panics <- p }, false),
+	)
+
+	conn := dialTerminal(t, addr)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write(heartbeatPacket); err != nil {
+			t.Fatalf("Write heartbeat error = %v", err)
+		}
+		// panic 之后仍然正常回复
+		if result := readGeneralRespondResult(t, conn); result != 0 {
+			t.Fatalf("heartbeat result = %d, want 0", result)
+		}
+		p := waitChan(t, panics, 2*time.Second)
+		if p.Callback != "Handler.OnReadExecutionEvent" || p.Command != consts.T0002HeartBeat ||
+			p.Value != "read boom" || p.Message == nil || len(p.Stack) == 0 {
+			t.Fatalf("HandlerPanic = %+v", p)
+		}
+		if p.Key != "12345678901" {
+			t.Fatalf("HandlerPanic.Key = %s, want 12345678901", p.Key)
+		}
+	}
+}
+
+func TestService_handlerPanicDisconnect(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	_, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithCustomHandleFunc(panicHeartbeatHandle),
+		WithHandlerPanic(nil, true),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if key := waitChan(t, events.left, 2*time.Second); key != "12345678901" {
+		t.Fatalf("leave key = %s, want 12345678901", key)
+	}
+	waitClosed(t, conn)
+}
+
+// panicAuthenticator 注册和鉴权都会 panic.
+type panicAuthenticator struct{}
+
+func (panicAuthenticator) Register(_ *Message, _ *model.T0x0100) (RegisterResult, string) {
+	panic("register boom")
+}
+
+func (panicAuthenticator) Auth(_ *Message, _ *model.T0x0102) bool { panic("auth boom") }
+
+func TestService_authenticatorPanic(t *testing.T) {
+	panics := make(chan HandlerPanic, 4)
+	_, addr := startTestServer(t,
+		WithAuthenticator(panicAuthenticator{}),
+		WithHandlerPanic(func(p HandlerPanic) { panics <- p }, false),
+	)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(encodeRegisterPacket(t, 1)); err != nil {
+		t.Fatalf("Write 0x0100 error = %v", err)
+	}
+	if got := readRegisterRespond(t, conn); RegisterResult(got.Result) != RegisterTerminalNotFound || got.AuthCode != "" {
+		t.Fatalf("register result = %s auth code = %s", RegisterResult(got.Result), got.AuthCode)
+	}
+	if p := waitChan(t, panics, 2*time.Second); p.Callback != "Authenticator.Register" || p.Value != "register boom" {
+		t.Fatalf("HandlerPanic = %+v", p)
+	}
+
+	if _, err := conn.Write(encodeAuthPacket(t, "code", 2)); err != nil {
+		t.Fatalf("Write 0x0102 error = %v", err)
+	}
+	if got := readGeneralRespondResult(t, conn); got != 1 {
+		t.Fatalf("auth result = %d, want 1", got)
+	}
+	if p := waitChan(t, panics, 2*time.Second); p.Callback != "Authenticator.Auth" || p.Value != "auth boom" {
+		t.Fatalf("HandlerPanic = %+v", p)
+	}
+}
+
+func TestService_keyFuncPanic(t *testing.T) {
+	panics := make(chan HandlerPanic, 4)
+	g, addr := startTestServer(t,
+		WithKeyFunc(func(_ *Message) (string, bool) { panic("key boom") }),
+		WithHandlerPanic(func(p HandlerPanic) { panics <- p }, false),
+	)
+
+	// 按key无效处理 不能加入 读取协程继续工作 下一个报文再次尝试加入
+	conn := dialTerminal(t, addr)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write(heartbeatPacket); err != nil {
+			t.Fatalf("Write heartbeat error = %v", err)
+		}
+		if p := waitChan(t, panics, 2*time.Second); p.Callback != "KeyFunc" || p.Value != "key boom" || p.Message == nil {
+			t.Fatalf("HandlerPanic = %+v", p)
+		}
+	}
+	if got := g.OnlineCount(); got != 0 {
+		t.Fatalf("OnlineCount() = %d, want 0", got)
+	}
+}
+
+func TestService_udpKeyFuncPanic(t *testing.T) {
+	panics := make(chan HandlerPanic, 4)
+	var calls atomic.Int32
+	events := newRecordingTerminalEvent()
+	_, addr := startUDPTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithKeyFunc(func(msg *Message) (string, bool) {
+			if calls.Add(1) == 1 {
+				panic("udp key boom")
+			}
+			return msg.JTMessage.Header.TerminalPhoneNo, true
+		}),
+		WithHandlerPanic(func(p HandlerPanic) { panics <- p }, false),
+	)
+
+	// UDP 读取协程中的 panic 使用终端地址区分 服务继续处理
+	conn := dialUDPTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	p := waitChan(t, panics, 2*time.Second)
+	if p.Callback != "KeyFunc" || p.Value != "udp key boom" || p.Address != conn.LocalAddr().String() {
+		t.Fatalf("HandlerPanic = %+v", p)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 0 {
+		t.Fatalf("heartbeat result = %d, want 0", result)
+	}
+	if key := waitChan(t, events.joined, 2*time.Second); key != "12345678901" {
+		t.Fatalf("join key = %s, want 12345678901", key)
+	}
+}
+
+func TestService_duplicateKeyFuncPanic(t *testing.T) {
+	panics := make(chan HandlerPanic, 4)
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithDuplicateKeyFunc(func(_ string, _ SessionInfo, _ *Message) DuplicateKeyPolicy {
+			panic("duplicate boom")
+		}),
+		WithHandlerPanic(func(p HandlerPanic) { panics <- p }, false),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	oldConn := dialTerminal(t, addr)
+	if _, err := oldConn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, oldConn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	// 按 DuplicateKeyRejectNew 处理 会话管理继续工作
+	newConn := dialTerminal(t, addr)
+	if _, err := newConn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	waitClosed(t, newConn)
+	p := waitChan(t, panics, 2*time.Second)
+	if p.Callback != "DuplicateKeyFunc" || p.Value != "duplicate boom" || p.Key != key ||
+		p.Address != newConn.LocalAddr().String() {
+		t.Fatalf("HandlerPanic = %+v", p)
+	}
+	if info, ok := g.Session(key); !ok || info.RemoteAddress != oldConn.LocalAddr().String() {
+		t.Fatalf("Session() = %+v, want old %s", info, oldConn.LocalAddr())
+	}
+}
+
+func TestService_offlineMessageEventPanic(t *testing.T) {
+	panics := make(chan HandlerPanic, 4)
+	events := newRecordingTerminalEvent()
+	queue := NewMemoryOfflineQueue()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithOfflineQueue(queue, time.Hour, func(_ *OfflineMessage, _ *Message) {
+			panic("offline boom")
+		}),
+		WithHandlerPanic(func(p HandlerPanic) { panics <- p }, false),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	key := "12345678901"
+	_ = g.SendActiveMessage(NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x31}, 5*time.Second))
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	frameReader := jt808.NewFrameReader()
+	for replied := false; !replied; {
+		for _, frame := range frameReader.ReadFrames(readPacket(t, conn, 2*time.Second)) {
+			msg := decodeFirstMessage(t, frame)
+			if consts.JT808CommandType(msg.Header.ID) == consts.P8300TextInfoDistribution {
+				resp := encodeGeneralRespond(t, msg.Header.SerialNumber, consts.P8300TextInfoDistribution, 2)
+				if _, err := conn.Write(resp); err != nil {
+					t.Fatalf("Write 0x0001 error = %v", err)
+				}
+				replied = true
+			}
+		}
+	}
+	p := waitChan(t, panics, 2*time.Second)
+	if p.Callback != "OnOfflineMessageEvent" || p.Value != "offline boom" || p.Key != key {
+		t.Fatalf("HandlerPanic = %+v", p)
+	}
+	if got, _ := queue.Peek(key); len(got) != 0 {
+		t.Fatalf("Peek() after reply = %d, want 0", len(got))
+	}
+}
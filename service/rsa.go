@@ -0,0 +1,66 @@
+package service
+
+import (
+	"log/slog"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// onDecrypt 终端上传的消息体是RSA加密的情况 使用平台私钥解密, 分包的情况在合并完成后解密.
+// 解密失败的报文回复通用应答失败 不再处理, 返回错误表示需要断开连接(队列满了). 在读取协程中执行.
+func (c *connection) onDecrypt(msg *Message) (bool, error) {
+	if msg.JTMessage.Header.Property.EncryptMethod == 0 || !msg.hasComplete() {
+		return true, nil
+	}
+	err := msg.JTMessage.Decrypt(c.rsaPrivateKey)
+	if err == nil {
+		return true, nil
+	}
+	slog.Warn("decrypt",
+		slog.String("key", c.key),
+		slog.String("command", msg.Command.String()),
+		slog.Any("err", err))
+	c.endUplinkSpan(msg, "decrypt fail", err)
+	msg.Handler = newDefaultHandle(&failReplyHandle{command: msg.Command})
+	return false, c.pushUplink(msg)
+}
+
+// onTerminalPublicKey 终端上传了RSA公钥(0x0A00) 保存到连接中, 之后平台下发的消息体都使用该公钥加密.
+// 只有开启了RSA(设置了平台私钥) 并且终端已经鉴权通过的情况才接受, 不合法的公钥直接忽略.
+func (c *connection) onTerminalPublicKey(msg *Message) {
+	if msg.Command != consts.T0A00TerminalRSAPublicKey || !msg.hasComplete() {
+		return
+	}
+	if c.rsaPrivateKey == nil || (c.authenticator != nil && !c.authenticated) {
+		slog.Warn("terminal rsa public key ignored",
+			slog.String("key", c.key),
+			slog.Bool("rsa", c.rsaPrivateKey != nil),
+			slog.Bool("authenticated", c.authenticated))
+		return
+	}
+	t0x0a00 := &model.T0x0A00{}
+	if err := t0x0a00.Parse(msg.JTMessage); err != nil {
+		slog.Warn("terminal rsa public key",
+			slog.String("key", c.key),
+			slog.Any("err", err))
+		return
+	}
+	pub, err := t0x0a00.PublicKey()
+	if err != nil {
+		slog.Warn("terminal rsa public key",
+			slog.String("key", c.key),
+			slog.Any("err", err))
+		return
+	}
+	c.terminalPublicKey.Store(pub)
+}
+
+// encodePackets 编码平台下发的报文, 终端上传过RSA公钥的情况加密消息体.
+// header 是多次下发共用的 每次都设置单个包的最大长度.
+func (c *connection) encodePackets(header *jt808.Header, body []byte, maxBodyLength int) ([][]byte, error) {
+	header.Property.EncryptMethod = 0
+	header.MaxBodyLength = maxBodyLength
+	return header.EncodeEncryptedPackets(c.terminalPublicKey.Load(), body)
+}
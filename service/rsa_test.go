@@ -0,0 +1,170 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func generateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	return priv
+}
+
+// encodeEncryptedTerminalPacket 终端使用平台的公钥加密消息体.
+func encodeEncryptedTerminalPacket(t *testing.T, pub *rsa.PublicKey, command consts.JT808CommandType, body []byte) []byte {
+	t.Helper()
+	header := mustDecodeJTMessage(t, heartbeatPacket).Header
+	header.ReplyID = uint16(command)
+	packets, err := header.EncodeEncryptedPackets(pub, body)
+	if err != nil {
+		t.Fatalf("EncodeEncryptedPackets() error = %v", err)
+	}
+	return packets[0]
+}
+
+// readEncryptedPacket 终端使用自己的私钥解密平台下发的消息体.
+func readEncryptedPacket(t *testing.T, conn net.Conn, priv *rsa.PrivateKey) *jt808.JTMessage {
+	t.Helper()
+	platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+	if platformMsg.Header.Property.EncryptMethod != jt808.EncryptMethodRSA {
+		t.Fatalf("EncryptMethod = %d, want %d", platformMsg.Header.Property.EncryptMethod, jt808.EncryptMethodRSA)
+	}
+	if err := platformMsg.Decrypt(priv); err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	return platformMsg
+}
+
+func TestService_rsa(t *testing.T) {
+	platformKey := generateRSAKey(t)
+	terminalKey := generateRSAKey(t)
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithRSAPrivateKey(platformKey),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	// 加密的心跳 平台解密后正常回复 终端还没有上传公钥 回复不加密
+	if _, err := conn.Write(encodeEncryptedTerminalPacket(t, &platformKey.PublicKey, consts.T0002HeartBeat, nil)); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 0 {
+		t.Fatalf("heartbeat result = %d, want 0", result)
+	}
+	_ = waitChan(t, events.joined, 2*time.Second)
+
+	// 使用错误的公钥加密 无法解密 回复失败
+	if _, err := conn.Write(encodeEncryptedTerminalPacket(t, &terminalKey.PublicKey, consts.T0002HeartBeat, []byte{0x01})); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 1 {
+		t.Fatalf("heartbeat result = %d, want 1", result)
+	}
+
+	// 终端上传公钥后 平台下发的都加密
+	t0x0a00, err := model.NewT0x0A00(&terminalKey.PublicKey)
+	if err != nil {
+		t.Fatalf("NewT0x0A00() error = %v", err)
+	}
+	body := t0x0a00.Encode()
+	if _, err := conn.Write(encodeEncryptedTerminalPacket(t, &platformKey.PublicKey, consts.T0A00TerminalRSAPublicKey, body)); err != nil {
+		t.Fatalf("Write 0x0A00 error = %v", err)
+	}
+	p8001 := &model.P0x8001{}
+	if err := p8001.Parse(readEncryptedPacket(t, conn, terminalKey)); err != nil || p8001.Result != 0 {
+		t.Fatalf("0x0A00 reply = %+v, err = %v", p8001, err)
+	}
+
+	go func() {
+		platformMsg := readEncryptedPacket(t, conn, terminalKey)
+		if platformMsg.Header.ID != uint16(consts.P8A00PlatformRSAPublicKey) {
+			t.Errorf("active command = %x", platformMsg.Header.ID)
+		}
+		p8a00 := &model.P0x8A00{}
+		if err := p8a00.Parse(platformMsg); err != nil {
+			t.Errorf("0x8A00 Parse() err = %v", err)
+		}
+		if pub, err := p8a00.PublicKey(); err != nil || !pub.Equal(&platformKey.PublicKey) {
+			t.Errorf("0x8A00 = %+v, err = %v", p8a00, err)
+		}
+		resp := (&model.T0x0001{
+			SerialNumber: platformMsg.Header.SerialNumber,
+			ID:           platformMsg.Header.ID,
+		}).Encode()
+		if _, err := conn.Write(encodeEncryptedTerminalPacket(t, &platformKey.PublicKey, consts.T0001GeneralRespond, resp)); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}()
+	p8a00, err := model.NewP0x8A00(&platformKey.PublicKey)
+	if err != nil {
+		t.Fatalf("NewP0x8A00() error = %v", err)
+	}
+	activeBody := p8a00.Encode()
+	reply := g.SendActiveMessage(NewActiveMessage("12345678901", consts.P8A00PlatformRSAPublicKey, activeBody, 2*time.Second))
+	if reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+	}
+	// 记录的是加密前的数据
+	if !bytes.Equal(reply.ExtensionFields.PlatformData, activeBody) {
+		t.Fatalf("PlatformData = %x, want %x", reply.ExtensionFields.PlatformData, activeBody)
+	}
+}
+
+func TestService_rsaIgnorePublicKey(t *testing.T) {
+	terminalKey := generateRSAKey(t)
+	valid, err := model.NewT0x0A00(&terminalKey.PublicKey)
+	if err != nil {
+		t.Fatalf("NewT0x0A00() error = %v", err)
+	}
+	// n只有11个字节 直接用来加密会 除0 panic
+	short := &model.T0x0A00{E: 65537, N: []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}}
+	tests := []struct {
+		name string
+		opts []Option
+		body []byte
+	}{
+		{name: "不合法的公钥", opts: []Option{WithRSAPrivateKey(generateRSAKey(t))}, body: short.Encode()},
+		{name: "没有开启RSA", body: valid.Encode()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, addr := startTestServer(t, tt.opts...)
+			conn := dialTerminal(t, addr)
+			if _, err := conn.Write(encodeTerminalPacket(t, consts.T0A00TerminalRSAPublicKey, tt.body, 1)); err != nil {
+				t.Fatalf("Write 0x0A00 error = %v", err)
+			}
+			_ = readPacket(t, conn, 2*time.Second)
+
+			// 公钥没有保存 平台下发的不加密
+			go func() {
+				platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+				if platformMsg.Header.Property.EncryptMethod != 0 {
+					t.Errorf("EncryptMethod = %d, want 0", platformMsg.Header.Property.EncryptMethod)
+				}
+				resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P8300TextInfoDistribution, 2)
+				if _, err := conn.Write(resp); err != nil {
+					t.Errorf("Write 0x0001 error = %v", err)
+				}
+			}()
+			reply := g.SendActiveMessage(NewActiveMessage("12345678901", consts.P8300TextInfoDistribution, []byte{0x01, 0x31}, 2*time.Second))
+			if reply.ExtensionFields.Err != nil {
+				t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package service
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"io"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cuteLittleDevil/go-jt808/protocol/model"
@@ -14,61 +21,356 @@ import (
 type GoJT808 struct {
 	opts *Options
 	*sessionManager
+
+	// mu 保护 listeners 和 connections.
+	mu sync.Mutex
+	// listeners 正在运行的监听 关闭时停止接收新的连接.
+	listeners []io.Closer
+	// connections 当前所有的终端连接.
+	connections map[*connection]struct{}
+	// wg 等待监听协程和所有连接协程退出.
+	wg sync.WaitGroup
+	// closed 服务是否已经开始关闭.
+	closed atomic.Bool
+	// activeMu 保证开始关闭后不会再增加 active.
+	activeMu sync.RWMutex
+	// connectionSum 当前的连接数量 用于限制最大连接数.
+	connectionSum atomic.Int32
+	// active 等待正在进行的主动下发返回结果.
+	active sync.WaitGroup
+	// shutdownOnce 保证关闭流程只执行一次.
+	shutdownOnce sync.Once
+	// shutdownCompleteChan 关闭流程完成后关闭.
+	shutdownCompleteChan chan struct{}
 }
 
 // New 创建 JT808 服务实例并初始化会话管理器.
 func New(opts ...Option) *GoJT808 {
 	options := newOptions(opts)
 	g := &GoJT808{
-		opts: options,
+		opts:                 options,
+		connections:          make(map[*connection]struct{}),
+		shutdownCompleteChan: make(chan struct{}),
 	}
 	keyFunc := g.opts.KeyFunc
 	g.sessionManager = newSessionManager(keyFunc)
+	g.sessionManager.duplicateKeyFunc = g.opts.DuplicateKeyFunc
+	g.sessionManager.metrics = g.opts.Metrics
+	g.sessionManager.onPanicEvent = g.opts.OnHandlerPanic
+	if g.opts.OfflineQueue != nil {
+		g.sessionManager.offline = newOfflineOptions(g.opts.OfflineQueue,
+			g.opts.OfflineTTL, g.opts.OnOfflineMessageEvent)
+	}
+	g.sessionManager.cluster = g.opts.Cluster
 	go g.sessionManager.run()
 	return g
 }
 
-// Run 启动 TCP 服务并持续接收终端连接.
+// Run 启动服务并持续接收终端连接.
+// Network 为 udp/udp4/udp6 时启动 UDP 服务, 其余情况启动 TCP 服务.
+// 设置了 WithListeners 的情况同时监听多个地址, 共用一个会话管理.
+// 需要停止服务的情况使用 RunContext 和 Shutdown.
 func (g *GoJT808) Run() {
-	addr, err := net.ResolveTCPAddr(g.opts.Network, g.opts.Addr)
+	_ = g.RunContext(context.Background())
+}
+
+// RunContext 启动服务并持续接收终端连接, 直到 ctx 取消或者调用 Shutdown.
+//
+// ctx 取消时会执行 Shutdown(context.Background()), 即等待已下发的主动消息完成(或超时)后再关闭.
+// 监听失败(任意一个地址)时关闭已经开始的监听并立即返回错误, 否则在关闭流程全部完成后返回 nil.
+func (g *GoJT808) RunContext(ctx context.Context) error {
+	listeners := g.opts.listeners()
+	serves := make([]func(), 0, len(listeners))
+	for _, l := range listeners {
+		serve, err := g.listen(l)
+		if err != nil {
+			g.closeListeners(serves)
+			return err
+		}
+		serves = append(serves, serve)
+	}
+	if cluster := g.opts.Cluster; cluster != nil {
+		if err := cluster.Transport.Serve(g.serveForward); err != nil {
+			g.closeListeners(serves)
+			return err
+		}
+		// 和监听一起在 Shutdown 时关闭
+		g.mu.Lock()
+		g.listeners = append(g.listeners, cluster.Transport)
+		g.mu.Unlock()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = g.Shutdown(context.Background())
+		case <-g.shutdownCompleteChan:
+		}
+	}()
+	for _, serve := range serves {
+		go serve()
+	}
+	<-g.shutdownCompleteChan
+	return nil
+}
+
+// closeListeners 部分地址监听失败的情况 关闭已经开始的监听.
+func (g *GoJT808) closeListeners(serves []func()) {
+	g.mu.Lock()
+	for _, listener := range g.listeners {
+		_ = listener.Close()
+	}
+	g.listeners = nil
+	g.mu.Unlock()
+	// 监听已经关闭 立即返回
+	for _, serve := range serves {
+		serve()
+	}
+}
+
+// Shutdown 优雅关闭服务, 按顺序执行：
+//  1. 停止接收新的连接, 新的 SendActiveMessage 直接返回 ErrServerClosed
+//  2. 等待正在进行的 SendActiveMessage 完成, 最多等到 ctx 结束
+//  3. 关闭所有终端连接, 每个会话都会触发 OnLeaveEvent
+//  4. 等待所有连接协程、会话管理器协程和集群转发、离线指令下发的协程退出
+//
+// ctx 提前结束的情况仍会关闭所有连接并等待协程退出, 返回 ctx.Err().
+// 如果不需要等待主动下发完成 可以传入已经取消的 ctx.
+func (g *GoJT808) Shutdown(ctx context.Context) error {
+	var err error
+	g.shutdownOnce.Do(func() {
+		g.activeMu.Lock()
+		g.closed.Store(true)
+		g.activeMu.Unlock()
+		g.mu.Lock()
+		for _, listener := range g.listeners {
+			_ = listener.Close()
+		}
+		g.mu.Unlock()
+
+		err = g.waitActiveComplete(ctx)
+
+		g.mu.Lock()
+		for c := range g.connections {
+			_ = c.conn.Close()
+		}
+		g.mu.Unlock()
+
+		g.wg.Wait()
+		g.sessionManager.stop()
+		close(g.shutdownCompleteChan)
+	})
+	select {
+	case <-g.shutdownCompleteChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *GoJT808) waitActiveComplete(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listen 根据协议开始监听, 返回持续接收连接的函数.
+func (g *GoJT808) listen(l *Listener) (func(), error) {
+	var (
+		listener io.Closer
+		serve    func()
+	)
+	switch l.network() {
+	case "udp", "udp4", "udp6":
+		if l.TLSConfig != nil || l.ProxyProtocol != nil {
+			slog.Warn("tls and proxy protocol are not supported on udp, ignored",
+				slog.String("addr", l.Addr),
+				slog.String("network", l.Network))
+		}
+		in, err := g.listenUDP(l)
+		if err != nil {
+			return nil, err
+		}
+		listener = in
+		udpServer := newUDPServer(in, g.opts.KeyFunc, g.opts.DecodeOptions, func(conn net.Conn) {
+			g.serveConn(conn, l)
+		})
+		udpServer.onPanicEvent = g.opts.OnHandlerPanic
+		if g.opts.MaxConnections > 0 {
+			udpServer.maxSessions = g.opts.MaxConnections
+		}
+		serve = udpServer.run
+	default:
+		in, err := g.listenTCP(l)
+		if err != nil {
+			return nil, err
+		}
+		listener = in
+		serve = func() { g.acceptTCP(in, l) }
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed.Load() {
+		_ = listener.Close()
+		return nil, ErrServerClosed
+	}
+	g.listeners = append(g.listeners, listener)
+	g.wg.Add(1)
+	return func() {
+		defer g.wg.Done()
+		serve()
+	}, nil
+}
+
+func (g *GoJT808) listenTCP(l *Listener) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr(l.network(), l.Addr)
 	if err != nil {
 		slog.Error("resolve tcp addr error",
-			slog.String("addr", g.opts.Addr),
-			slog.String("network", g.opts.Network),
+			slog.String("addr", l.Addr),
+			slog.String("network", l.network()),
 			slog.Any("err", err))
 	}
 
-	in, err := net.ListenTCP(g.opts.Network, addr)
+	in, err := net.ListenTCP(l.network(), addr)
 	if err != nil {
 		slog.Error("tcp listen fail",
 			slog.Any("addr", addr),
 			slog.Any("err", err))
-		return
+		return nil, err
 	}
+	return in, nil
+}
 
+func (g *GoJT808) acceptTCP(in *net.TCPListener, l *Listener) {
 	for {
 		conn, err := in.AcceptTCP()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			slog.Warn("accept fail",
 				slog.Any("err", err))
 			continue
 		}
-		client := newConnection(connectionParams{
-			conn:                   conn,
-			handles:                g.createCommandHandle(),
-			activeRespondHandles:   g.createActiveRespondHandle(),
-			terminalEvent:          g.opts.CustomTerminalEventerFunc(),
-			filter:                 g.opts.FilterSubcontract,
-			onTerminalTimeoutEvent: g.opts.OnTerminalTimeoutEvent,
-			timeout: TerminalTimeout{
-				ConnectionStartTime: time.Now(),
-				Address:             conn.RemoteAddr().String(),
-				IdleTimeout:         g.opts.IdleTimeout,
-			},
-			onJoinEvent:  g.sessionManager.join,
-			onLeaveEvent: g.sessionManager.leave,
-		})
-		go client.run()
+		if l.ProxyProtocol != nil {
+			g.serveProxyConn(conn, l)
+			continue
+		}
+		g.serveTCPConn(conn, l)
+	}
+}
+
+// serveTCPConn 设置了TLS的情况 使用TLS连接.
+func (g *GoJT808) serveTCPConn(conn net.Conn, l *Listener) {
+	if l.TLSConfig != nil {
+		conn = tls.Server(conn, l.TLSConfig)
+	}
+	g.serveConn(conn, l)
+}
+
+func (g *GoJT808) listenUDP(l *Listener) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr(l.network(), l.Addr)
+	if err != nil {
+		slog.Error("resolve udp addr error",
+			slog.String("addr", l.Addr),
+			slog.String("network", l.network()),
+			slog.Any("err", err))
+	}
+
+	in, err := net.ListenUDP(l.network(), addr)
+	if err != nil {
+		slog.Error("udp listen fail",
+			slog.Any("addr", addr),
+			slog.Any("err", err))
+		return nil, err
+	}
+	return in, nil
+}
+
+// serveConn 为一个终端连接(TCP连接或UDP虚拟连接)创建会话并开始处理.
+func (g *GoJT808) serveConn(conn net.Conn, l *Listener) {
+	if !g.acquireConnection() {
+		slog.Warn("max connections",
+			slog.Int("max", g.opts.MaxConnections),
+			slog.String("address", conn.RemoteAddr().String()))
+		_ = conn.Close()
+		return
+	}
+	client := newConnection(connectionParams{
+		conn:                   conn,
+		handles:                l.commandHandle(g.createCommandHandle()),
+		activeRespondHandles:   g.createActiveRespondHandle(),
+		terminalEvent:          l.terminalEventer(g.opts),
+		filter:                 g.opts.FilterSubcontract,
+		authenticator:          g.opts.Authenticator,
+		joinPolicy:             g.opts.JoinPolicy,
+		retransmit:             g.opts.Retransmit,
+		metrics:                g.opts.Metrics,
+		tracer:                 g.opts.Tracer,
+		queue:                  g.opts.Queue,
+		rateLimit:              g.opts.RateLimit,
+		certificateKeyFunc:     g.opts.CertificateKeyFunc,
+		rsaPrivateKey:          g.opts.RSAPrivateKey,
+		decodeOptions:          g.opts.DecodeOptions,
+		skipDecodeError:        g.opts.SkipDecodeError,
+		maxBodyLength:          g.opts.MaxBodyLength,
+		protocolVersionFunc:    g.opts.ProtocolVersionFunc,
+		middlewares:            g.opts.Middlewares,
+		activeMiddlewares:      g.opts.ActiveMiddlewares,
+		onPanicEvent:           g.opts.OnHandlerPanic,
+		panicDisconnect:        g.opts.PanicDisconnect,
+		onTerminalTimeoutEvent: g.opts.OnTerminalTimeoutEvent,
+		timeout: TerminalTimeout{
+			ConnectionStartTime: time.Now(),
+			Address:             conn.RemoteAddr().String(),
+			IdleTimeout:         g.opts.IdleTimeout,
+		},
+		onJoinEvent:  g.sessionManager.join,
+		onLeaveEvent: g.sessionManager.leave,
+	})
+
+	g.mu.Lock()
+	if g.closed.Load() {
+		g.mu.Unlock()
+		g.connectionSum.Add(-1)
+		_ = conn.Close()
+		return
+	}
+	g.connections[client] = struct{}{}
+	g.wg.Add(1)
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			g.mu.Lock()
+			delete(g.connections, client)
+			g.mu.Unlock()
+			g.connectionSum.Add(-1)
+			g.wg.Done()
+		}()
+		client.run()
+	}()
+}
+
+// acquireConnection 占用一个连接数, 设置了最大连接数并且已经达到的情况返回false.
+func (g *GoJT808) acquireConnection() bool {
+	limit := int32(g.opts.MaxConnections)
+	for {
+		sum := g.connectionSum.Load()
+		if limit > 0 && sum >= limit {
+			return false
+		}
+		if g.connectionSum.CompareAndSwap(sum, sum+1) {
+			return true
+		}
 	}
 }
 
@@ -87,9 +389,120 @@ func (g *GoJT808) Run() {
 //   - 失败时：ExtensionFields.Err 携带具体失败原因，例如：
 //   - ErrNotExistKey：终端不在线或 Key 不存在
 //   - ErrWriteDataOverTime：下发超时
+//   - ErrConnectionClosed：等待应答期间连接关闭
+//   - ErrServerClosed：服务已经关闭
+//   - ErrOfflineMessageQueued：终端不在线 已保存为离线指令(开启 WithOfflineQueue 时)
 //   - 其他网络错误
 func (g *GoJT808) SendActiveMessage(activeMsg *ActiveMessage) *Message {
-	return g.sessionManager.write(activeMsg)
+	return g.SendActiveMessageContext(context.Background(), activeMsg)
+}
+
+// SendActiveMessageContext 和 SendActiveMessage 一致, 增加了 ctx 用于取消.
+//
+// ctx 结束时立即返回, ExtensionFields.Err 为 ctx.Err(),
+// 同时终端连接中等待应答的记录会被移除, 不会再触发超时回调.
+// 超时时间仍以 OverTimeDuration 和 ctx 中先到的为准.
+func (g *GoJT808) SendActiveMessageContext(ctx context.Context, activeMsg *ActiveMessage) *Message {
+	return g.sendActiveMessages(ctx, []*ActiveMessage{activeMsg})[0]
+}
+
+// SendActiveMessageAsync 异步下发主动消息, 不阻塞调用方.
+// 返回的通道在得到结果后写入一次并关闭, 结果和 SendActiveMessage 一致.
+// ctx 结束时不再等待终端应答, 结果的 ExtensionFields.Err 为 ctx.Err(), 见 SendActiveMessageContext.
+func (g *GoJT808) SendActiveMessageAsync(ctx context.Context, activeMsg *ActiveMessage) <-chan *Message {
+	resultChan := make(chan *Message, 1)
+	go func() {
+		defer close(resultChan)
+		resultChan <- g.sendActiveMessages(ctx, []*ActiveMessage{activeMsg})[0]
+	}()
+	return resultChan
+}
+
+// Broadcast 将同一条指令并发下发给多个终端, 并等待全部结果.
+//
+// 所有指令一次性分配到各终端会话, 各终端并发下发和等待应答, 超时时间默认3秒.
+// ctx 结束时不再等待剩余终端的应答, 这些终端的 ExtensionFields.Err 为 ctx.Err().
+// 返回值 key -> 应答结果, 重复的 key 只下发一次.
+func (g *GoJT808) Broadcast(ctx context.Context, keys []string, command consts.JT808CommandType,
+	body []byte) map[string]*Message {
+	activeMsgs := make([]*ActiveMessage, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		activeMsgs = append(activeMsgs, NewActiveMessage(key, command, body, 0))
+	}
+
+	replies := g.sendActiveMessages(ctx, activeMsgs)
+	results := make(map[string]*Message, len(activeMsgs))
+	for i, activeMsg := range activeMsgs {
+		results[activeMsg.Key] = replies[i]
+	}
+	return results
+}
+
+// sendActiveMessages 批量下发并按顺序返回每一条的结果.
+func (g *GoJT808) sendActiveMessages(ctx context.Context, activeMsgs []*ActiveMessage) []*Message {
+	replies := make([]*Message, len(activeMsgs))
+	g.activeMu.RLock()
+	if g.closed.Load() {
+		g.activeMu.RUnlock()
+		for i := range replies {
+			replies[i] = newErrMessage(ErrServerClosed)
+		}
+		return replies
+	}
+	g.active.Add(len(activeMsgs))
+	g.activeMu.RUnlock()
+
+	for _, activeMsg := range activeMsgs {
+		activeMsg.ctx, activeMsg.span = g.opts.Tracer.Start(ctx, SpanActive,
+			Attribute{Key: AttrKey, Value: activeMsg.Key},
+			commandAttr(AttrCommand, activeMsg.Command))
+	}
+	g.sessionManager.dispatch(activeMsgs)
+	for i, activeMsg := range activeMsgs {
+		select {
+		case replies[i] = <-activeMsg.replyChan:
+		case <-ctx.Done():
+			select {
+			case replies[i] = <-activeMsg.replyChan:
+			default:
+				replies[i] = newErrMessage(errors.Join(ctx.Err(),
+					fmt.Errorf("key=[%s] command=[%s]", activeMsg.Key, activeMsg.Command)))
+			}
+		}
+		if replies[i].Command != 0 {
+			activeMsg.span.SetAttributes(commandAttr(AttrReplyCommand, replies[i].Command))
+		}
+		activeMsg.span.End(replies[i].ExtensionFields.Err)
+		g.active.Done()
+	}
+	return replies
+}
+
+// Sessions 返回全部在线终端的会话信息, 按 key 排序.
+func (g *GoJT808) Sessions() []SessionInfo {
+	return g.sessionManager.sessions()
+}
+
+// Session 返回指定 key 的在线终端会话信息, 不在线的情况返回 false.
+func (g *GoJT808) Session(key string) (SessionInfo, bool) {
+	return g.sessionManager.session(key)
+}
+
+// OnlineCount 返回在线终端数量.
+func (g *GoJT808) OnlineCount() int {
+	return g.sessionManager.count()
+}
+
+// Kick 断开指定 key 的终端连接, reason 会记录在日志中.
+// 断开后执行正常的下线流程, 即从会话中移除并触发 OnLeaveEvent.
+// 终端不在线的情况返回 ErrNotExistKey.
+func (g *GoJT808) Kick(key string, reason string) error {
+	return g.sessionManager.kick(key, reason)
 }
 
 func (g *GoJT808) createCommandHandle() map[consts.JT808CommandType]Handler {
@@ -126,6 +539,7 @@ func (g *GoJT808) createDefaultHandle() map[consts.JT808CommandType]Handler {
 		consts.T0805CameraShootImmediately:    newDefaultHandle(&model.T0x0805{}),
 		consts.T0800MultimediaEventInfoUpload: newDefaultHandle(&model.T0x0800{}),
 		consts.T0801MultimediaDataUpload:      newDefaultHandle(&model.T0x0801{}),
+		consts.T0A00TerminalRSAPublicKey:      newDefaultHandle(&model.T0x0A00{}),
 
 		// 平台下发的
 		consts.P8003ReissueSubcontractingRequest: newDefaultHandle(&model.P0x8003{}),
@@ -136,6 +550,7 @@ func (g *GoJT808) createDefaultHandle() map[consts.JT808CommandType]Handler {
 		consts.P8300TextInfoDistribution:         newDefaultHandle(&model.P0x8300{}),
 		consts.P8302QuestionDistribution:         newDefaultHandle(&model.P0x8302{}),
 		consts.P8801CameraShootImmediateCommand:  newDefaultHandle(&model.P0x8801{}),
+		consts.P8A00PlatformRSAPublicKey:         newDefaultHandle(&model.P0x8A00{}),
 
 		// JT1078相关的
 		consts.P9003QueryTerminalAudioVideoProperties: newDefaultHandle(&model.P0x9003{}),
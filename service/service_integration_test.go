@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"net"
@@ -411,3 +412,217 @@ func TestMakeSerialMatchHandler(t *testing.T) {
 		t.Fatal("expected serial mismatch")
 	}
 }
+
+// replaceTerminalEvent 在 recordingTerminalEvent 的基础上记录替换事件.
+type replaceTerminalEvent struct {
+	*recordingTerminalEvent
+	replaced chan SessionInfo
+}
+
+func (r *replaceTerminalEvent) OnReplaceEvent(_ string, old SessionInfo) {
+	r.replaced <- old
+}
+
+func TestService_duplicateKeyPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		opt         Option
+		wantReplace bool
+	}{
+		{name: "默认拒绝新连接", opt: Option{F: func(_ *Options) {}}, wantReplace: false},
+		{name: "替换旧连接", opt: WithDuplicateKeyPolicy(DuplicateKeyReplaceOld), wantReplace: true},
+		{name: "自定义策略", opt: WithDuplicateKeyFunc(func(key string, old SessionInfo, _ *Message) DuplicateKeyPolicy {
+			if key == old.Key {
+				return DuplicateKeyReplaceOld
+			}
+			return DuplicateKeyRejectNew
+		}), wantReplace: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &replaceTerminalEvent{
+				recordingTerminalEvent: newRecordingTerminalEvent(),
+				replaced:               make(chan SessionInfo, 1),
+			}
+			g, addr := startTestServer(t,
+				WithCustomTerminalEventer(func() TerminalEventer { return events }),
+				tt.opt,
+			)
+			drainStringChan(events.left)
+			drainStringChan(events.joined)
+
+			oldConn := dialTerminal(t, addr)
+			if _, err := oldConn.Write(heartbeatPacket); err != nil {
+				t.Fatalf("Write heartbeat error = %v", err)
+			}
+			_ = readPacket(t, oldConn, 2*time.Second)
+			key := waitChan(t, events.joined, 2*time.Second)
+
+			newConn := dialTerminal(t, addr)
+			if _, err := newConn.Write(heartbeatPacket); err != nil {
+				t.Fatalf("Write heartbeat error = %v", err)
+			}
+			_ = waitChan(t, events.joined, 2*time.Second)
+			// 被关闭的连接都会触发离开事件
+			_ = waitChan(t, events.left, 2*time.Second)
+
+			info, ok := g.Session(key)
+			if !ok {
+				t.Fatal("Session() not found")
+			}
+			if !tt.wantReplace {
+				if info.RemoteAddress != oldConn.LocalAddr().String() {
+					t.Fatalf("session address = %s, want old %s", info.RemoteAddress, oldConn.LocalAddr())
+				}
+				return
+			}
+
+			old := waitChan(t, events.replaced, 2*time.Second)
+			if old.RemoteAddress != oldConn.LocalAddr().String() {
+				t.Fatalf("replaced address = %s, want %s", old.RemoteAddress, oldConn.LocalAddr())
+			}
+			if info.RemoteAddress != newConn.LocalAddr().String() {
+				t.Fatalf("session address = %s, want new %s", info.RemoteAddress, newConn.LocalAddr())
+			}
+			_ = readPacket(t, newConn, 2*time.Second) // 新连接的0x8001
+
+			go func() {
+				platformMsg := decodeFirstMessage(t, readPacket(t, newConn, 2*time.Second))
+				resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P8300TextInfoDistribution, 2)
+				if _, err := newConn.Write(resp); err != nil {
+					t.Errorf("Write 0x0001 error = %v", err)
+				}
+			}()
+			reply := g.SendActiveMessage(NewActiveMessage(key, consts.P8300TextInfoDistribution,
+				[]byte{0x01, 0x31}, time.Second))
+			if reply.ExtensionFields.Err != nil {
+				t.Fatalf("SendActiveMessage() after replace err = %v", reply.ExtensionFields.Err)
+			}
+		})
+	}
+}
+
+func TestService_sendActiveMessageAsyncAndBroadcast(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	replyGeneral := func(cmd consts.JT808CommandType) {
+		platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, cmd, 2)
+		if _, err := conn.Write(resp); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}
+
+	resultChan := g.SendActiveMessageAsync(context.Background(),
+		NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x31}, time.Second))
+	replyGeneral(consts.P8300TextInfoDistribution)
+	if reply := waitChan(t, resultChan, 2*time.Second); reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessageAsync() err = %v", reply.ExtensionFields.Err)
+	}
+	if _, ok := <-resultChan; ok {
+		t.Fatal("result chan should be closed")
+	}
+
+	go replyGeneral(consts.P8300TextInfoDistribution)
+	results := g.Broadcast(context.Background(), []string{key, "missing", key},
+		consts.P8300TextInfoDistribution, []byte{0x01, 0x32})
+	if len(results) != 2 {
+		t.Fatalf("Broadcast() results = %d, want 2", len(results))
+	}
+	if err := results[key].ExtensionFields.Err; err != nil {
+		t.Fatalf("Broadcast()[%s] err = %v", key, err)
+	}
+	if err := results["missing"].ExtensionFields.Err; !errors.Is(err, ErrNotExistKey) {
+		t.Fatalf("Broadcast()[missing] err = %v, want %v", err, ErrNotExistKey)
+	}
+
+	// 终端不应答 ctx 结束后不再等待
+	go func() {
+		_ = readPacket(t, conn, 2*time.Second)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results = g.Broadcast(ctx, []string{key}, consts.P8300TextInfoDistribution, []byte{0x01, 0x33})
+	if err := results[key].ExtensionFields.Err; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Broadcast() with ctx err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestService_activeMessageRetransmit(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithRetransmitPolicy(RetransmitPolicy{Count: 2}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	// 第一次下发不应答 重传的流水号和第一次一致 应答重传后的
+	replyChan := make(chan *Message, 1)
+	go func() {
+		replyChan <- g.SendActiveMessage(NewActiveMessage(key, consts.P8300TextInfoDistribution,
+			[]byte{0x01, 0x31}, 100*time.Millisecond))
+	}()
+	first := readPacket(t, conn, time.Second)
+	retransmit := readPacket(t, conn, time.Second)
+	if string(first) != string(retransmit) {
+		t.Fatalf("retransmit data = %x, want %x", retransmit, first)
+	}
+	platformMsg := decodeFirstMessage(t, retransmit)
+	resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P8300TextInfoDistribution, 2)
+	if _, err := conn.Write(resp); err != nil {
+		t.Fatalf("Write 0x0001 error = %v", err)
+	}
+	if reply := waitChan(t, replyChan, time.Second); reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+	}
+
+	// 全部重传都不应答 T0=100ms T1=100ms T2=200ms
+	activeMsg := NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x32}, 100*time.Millisecond)
+	go func() {
+		replyChan <- g.SendActiveMessage(activeMsg)
+	}()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_ = readPacket(t, conn, time.Second)
+	}
+	reply := waitChan(t, replyChan, time.Second)
+	if !errors.Is(reply.ExtensionFields.Err, ErrWriteDataOverTime) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrWriteDataOverTime)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("overtime elapsed = %v, want >= 400ms", elapsed)
+	}
+
+	// ActiveMessage 的策略优先 不重传
+	activeMsg = NewActiveMessage(key, consts.P8300TextInfoDistribution, []byte{0x01, 0x33}, 100*time.Millisecond)
+	activeMsg.Retransmit = &RetransmitPolicy{}
+	reply = g.SendActiveMessage(activeMsg)
+	if !errors.Is(reply.ExtensionFields.Err, ErrWriteDataOverTime) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrWriteDataOverTime)
+	}
+	_ = readPacket(t, conn, time.Second)
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("unexpected retransmit %d bytes", n)
+	}
+}
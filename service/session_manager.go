@@ -3,9 +3,14 @@ package service
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
 )
 
 type sessionOperationFunc func(record map[string]*session)
@@ -14,14 +19,54 @@ type (
 	sessionManager struct {
 		operationFuncChan chan sessionOperationFunc
 		keyFunc           func(message *Message) (string, bool)
+		// duplicateKeyFunc key已经存在时的处理策略 为nil时拒绝新的连接.
+		duplicateKeyFunc func(key string, old SessionInfo, message *Message) DuplicateKeyPolicy
+		// metrics 监控指标 记录在线的终端数量.
+		metrics Metrics
+		// offline 离线指令相关 为nil时不保存离线指令.
+		offline *offlineOptions
+		// onPanicEvent 不属于某个连接的用户回调(DuplicateKeyFunc、离线指令结果)发生 panic 的事件.
+		onPanicEvent func(p HandlerPanic)
+		// cluster 集群配置 为nil时只处理本节点的终端.
+		cluster *Cluster
+		// stopChan 关闭后 run 协程处理完剩余的操作后退出.
+		stopChan chan struct{}
+		// runCompleteChan run 协程退出后关闭.
+		runCompleteChan chan struct{}
+		// background 转发和离线指令下发等后台协程 stop 时等待全部退出.
+		background sync.WaitGroup
+		// mu 保证停止后不会再提交新的操作.
+		mu      sync.RWMutex
+		stopped bool
 	}
 
 	session struct {
+		// header 加入时报文的固定头副本 不会被修改
 		header *jt808.Header
 		// 加入时间
 		joinTime time.Time
-		// 数据发送到终端
-		activeMsgChan chan<- *ActiveMessage
+		// conn 终端连接 数据通过 conn.activeMsgChan 发送到终端
+		conn *connection
+	}
+
+	// SessionInfo 终端会话的快照信息.
+	SessionInfo struct {
+		// Key 唯一标识符 默认手机号
+		Key string `json:"key"`
+		// Header 终端加入时报文的固定头 副本 修改不影响会话.
+		Header jt808.Header `json:"header"`
+		// JoinTime 加入时间
+		JoinTime time.Time `json:"joinTime"`
+		// RemoteAddress 终端的地址 格式如127.0.0.1:58994
+		RemoteAddress string `json:"remoteAddress"`
+		// ProtocolVersion 协议版本 2011和2013版本见 WithProtocolVersionFunc
+		ProtocolVersion consts.ProtocolVersionType `json:"protocolVersion"`
+		// LastPacketTime 收到最后一个报文的时间
+		LastPacketTime time.Time `json:"lastPacketTime"`
+		// PendingActiveSum 正在等待终端应答的主动下发数量
+		PendingActiveSum int `json:"pendingActiveSum"`
+		// QueueOverflowSum 终端上传报文的队列满了的次数
+		QueueOverflowSum uint64 `json:"queueOverflowSum"`
 	}
 )
 
@@ -29,64 +74,296 @@ func newSessionManager(keyFunc func(message *Message) (string, bool)) *sessionMa
 	return &sessionManager{
 		operationFuncChan: make(chan sessionOperationFunc, 10),
 		keyFunc:           keyFunc,
+		metrics:           nopMetrics{},
+		stopChan:          make(chan struct{}),
+		runCompleteChan:   make(chan struct{}),
 	}
 }
 
 func (s *sessionManager) run() {
+	defer close(s.runCompleteChan)
 	record := make(map[string]*session, 1000)
-	for opFunc := range s.operationFuncChan {
-		opFunc(record)
+	var expireChan <-chan time.Time
+	if s.offline != nil {
+		go s.offline.runIO()
+		defer s.offline.closeIO()
+		ticker := time.NewTicker(s.offline.expireInterval())
+		defer ticker.Stop()
+		expireChan = ticker.C
+	}
+	for {
+		select {
+		case <-expireChan:
+			s.expireOffline()
+		case <-s.stopChan:
+			for {
+				select {
+				case opFunc := <-s.operationFuncChan:
+					opFunc(record)
+				default:
+					clear(record)
+					return
+				}
+			}
+		case opFunc := <-s.operationFuncChan:
+			opFunc(record)
+		}
+	}
+}
+
+// stop 停止会话管理器 并等待 run 协程退出.
+func (s *sessionManager) stop() {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopChan)
 	}
+	s.mu.Unlock()
+	<-s.runCompleteChan
+	// 后台协程只在 run 和 runIO 协程中创建 此时已经不会再增加
+	s.background.Wait()
+}
+
+// goBackground 启动一个 stop 时需要等待的后台协程.
+func (s *sessionManager) goBackground(f func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+}
+
+// submit 提交一个操作到 run 协程, 会话管理器已经停止的情况返回false.
+func (s *sessionManager) submit(opFunc sessionOperationFunc) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stopped {
+		return false
+	}
+	s.operationFuncChan <- opFunc
+	return true
 }
 
 // join 将终端会话注册到会话管理器中.
-func (s *sessionManager) join(message *Message, activeChan chan<- *ActiveMessage) (string, error) {
-	key, ok := s.keyFunc(message)
-	if !ok {
+func (s *sessionManager) join(message *Message, c *connection) (string, error) {
+	var (
+		key string
+		ok  bool
+	)
+	if c.safeCall("KeyFunc", message, func() {
+		key, ok = s.keyFunc(message)
+	}) || !ok {
 		return "", _errKeyInvalid
 	}
-	ch := make(chan error)
-	defer close(ch)
-	s.operationFuncChan <- func(record map[string]*session) {
+	if err := c.verifyCertificateKey(key); err != nil {
+		return key, err
+	}
+	type result struct {
+		replaced *SessionInfo
+		err      error
+	}
+	ch := make(chan result, 1)
+	ok = s.submit(func(record map[string]*session) {
+		var replaced *SessionInfo
 		if v, ok := record[key]; ok {
-			ch <- errors.Join(fmt.Errorf("key[%s] join time[%s]",
-				key, v.joinTime.Format(time.RFC3339)), _errKeyExist)
-			return
+			if s.duplicateKeyFunc == nil {
+				ch <- result{err: errors.Join(fmt.Errorf("key[%s] join time[%s]",
+					key, v.joinTime.Format(time.RFC3339)), _errKeyExist)}
+				return
+			}
+			old := v.info(key)
+			policy := DuplicateKeyRejectNew
+			safeCall(HandlerPanic{
+				Key:      key,
+				Address:  c.conn.RemoteAddr().String(),
+				Callback: "DuplicateKeyFunc",
+				Message:  message,
+			}, s.onPanicEvent, func() {
+				policy = s.duplicateKeyFunc(key, old, message)
+			})
+			if policy != DuplicateKeyReplaceOld {
+				ch <- result{err: errors.Join(fmt.Errorf("key[%s] join time[%s] policy[%s]",
+					key, v.joinTime.Format(time.RFC3339), policy), _errKeyExist)}
+				return
+			}
+			// 旧连接关闭后执行正常的下线流程 leave时发现会话已经属于新连接 不会删除
+			v.conn.kick(fmt.Sprintf("replaced by new connection [%s]", c.conn.RemoteAddr()))
+			replaced = &old
 		}
 		record[key] = &session{
-			header:        message.Header,
-			joinTime:      time.Now(),
-			activeMsgChan: activeChan,
+			header:   message.Header.Clone(),
+			joinTime: time.Now(),
+			conn:     c,
 		}
-		ch <- nil
+		s.metrics.SetOnlineSessions(len(record))
+		s.popOffline(key)
+		ch <- result{replaced: replaced}
+	})
+	if !ok {
+		return key, ErrServerClosed
+	}
+	r := <-ch
+	c.replacedSession = r.replaced
+	if r.err == nil && s.cluster != nil {
+		s.register(key)
 	}
-	return key, <-ch
+	return key, r.err
 }
 
 // leave 将指定 key 的终端会话从会话管理器中移除.
-func (s *sessionManager) leave(key string) {
-	ch := make(chan struct{})
-	s.operationFuncChan <- func(record map[string]*session) {
-		defer close(ch)
-		delete(record, key)
+// 会话已经被新的连接替换的情况 不做处理.
+func (s *sessionManager) leave(key string, c *connection) {
+	ch := make(chan bool, 1)
+	if ok := s.submit(func(record map[string]*session) {
+		if v, ok := record[key]; ok && v.conn == c {
+			delete(record, key)
+			s.metrics.SetOnlineSessions(len(record))
+			ch <- true
+			return
+		}
+		ch <- false
+	}); ok {
+		if deleted := <-ch; deleted && s.cluster != nil {
+			s.unregister(key)
+		}
 	}
-	<-ch
 }
 
 // write 将主动消息分配到目标终端会话并返回应答结果.
 func (s *sessionManager) write(activeMsg *ActiveMessage) *Message {
-	replyChan := make(chan *Message)
-	defer close(replyChan)
-	s.operationFuncChan <- func(record map[string]*session) {
-		key := activeMsg.Key
+	s.dispatch([]*ActiveMessage{activeMsg})
+	return <-activeMsg.replyChan
+}
+
+// dispatch 一次性将多条主动消息分配到目标终端会话, 只经过会话管理器一次.
+// 每条消息的应答结果写入各自的 replyChan(缓冲为1), 不会阻塞会话管理器.
+func (s *sessionManager) dispatch(activeMsgs []*ActiveMessage) {
+	for _, activeMsg := range activeMsgs {
+		activeMsg.replyChan = make(chan *Message, 1)
+	}
+	ok := s.submit(func(record map[string]*session) {
+		for _, activeMsg := range activeMsgs {
+			s.dispatchLocal(record, activeMsg, true)
+		}
+	})
+	if !ok {
+		for _, activeMsg := range activeMsgs {
+			activeMsg.replyChan <- newErrMessage(ErrServerClosed)
+		}
+	}
+}
+
+// dispatchLocal 将主动消息分配到本节点的终端会话, 在 run 协程中执行.
+// 终端的主动下发队列满了按照 OverflowPolicy 处理.
+// 本节点没有该终端的情况 forward 为true且开启了集群时转发到终端所在的节点.
+func (s *sessionManager) dispatchLocal(record map[string]*session, activeMsg *ActiveMessage, forward bool) {
+	key := activeMsg.Key
+	if v, ok := record[key]; ok {
+		// 每次下发使用独立的副本 write 协程会修改流水号等字段
+		activeMsg.header = v.header.Clone()
+		// 不能阻塞会话管理器 单个终端处理不过来时不影响其他终端
+		v.conn.pushActive(activeMsg)
+		return
+	}
+	if forward && s.cluster != nil && !activeMsg.forwarded {
+		s.goBackground(func() { s.forward(activeMsg) })
+		return
+	}
+	if activeMsg.offline != nil {
+		// 下发离线指令前终端又离线了 指令仍然保存着 等下次加入
+		activeMsg.replyChan <- newErrMessage(errors.Join(ErrOfflineMessageQueued,
+			fmt.Errorf("key=[%s] id=[%s]", key, activeMsg.offline.ID)))
+		return
+	}
+	if s.offline != nil && !activeMsg.forwarded {
+		s.pushOffline(activeMsg)
+		return
+	}
+	activeMsg.replyChan <- newErrMessage(errors.Join(ErrNotExistKey,
+		fmt.Errorf("key=[%s] sum=[%d] ", key, len(record))))
+}
+
+// sessions 返回全部在线终端的会话信息 按key排序.
+func (s *sessionManager) sessions() []SessionInfo {
+	ch := make(chan []SessionInfo, 1)
+	if ok := s.submit(func(record map[string]*session) {
+		infos := make([]SessionInfo, 0, len(record))
+		for key, v := range record {
+			infos = append(infos, v.info(key))
+		}
+		ch <- infos
+	}); !ok {
+		return nil
+	}
+	infos := <-ch
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return infos
+}
+
+// session 返回指定 key 的终端会话信息.
+func (s *sessionManager) session(key string) (SessionInfo, bool) {
+	type result struct {
+		info SessionInfo
+		ok   bool
+	}
+	ch := make(chan result, 1)
+	if ok := s.submit(func(record map[string]*session) {
 		if v, ok := record[key]; ok {
-			activeMsg.header = v.header
-			activeMsg.replyChan = replyChan
-			v.activeMsgChan <- activeMsg
+			ch <- result{info: v.info(key), ok: true}
 			return
 		}
-		replyChan <- newErrMessage(errors.Join(ErrNotExistKey,
-			fmt.Errorf("key=[%s] sum=[%d] ", key, len(record))))
+		ch <- result{}
+	}); !ok {
+		return SessionInfo{}, false
+	}
+	r := <-ch
+	return r.info, r.ok
+}
+
+// count 返回在线终端数量.
+func (s *sessionManager) count() int {
+	ch := make(chan int, 1)
+	if ok := s.submit(func(record map[string]*session) {
+		ch <- len(record)
+	}); !ok {
+		return 0
+	}
+	return <-ch
+}
+
+// kick 断开指定 key 的终端连接, 随后由连接执行正常的下线流程.
+func (s *sessionManager) kick(key string, reason string) error {
+	ch := make(chan error, 1)
+	if ok := s.submit(func(record map[string]*session) {
+		if v, ok := record[key]; ok {
+			v.conn.kick(reason)
+			ch <- nil
+			return
+		}
+		ch <- errors.Join(ErrNotExistKey, fmt.Errorf("key=[%s] sum=[%d] ", key, len(record)))
+	}); !ok {
+		return ErrServerClosed
+	}
+	return <-ch
+}
+
+func (s *session) info(key string) SessionInfo {
+	info := SessionInfo{
+		Key:              key,
+		Header:           *s.header.Clone(),
+		JoinTime:         s.joinTime,
+		RemoteAddress:    s.conn.conn.RemoteAddr().String(),
+		ProtocolVersion:  consts.ProtocolVersionType(s.conn.protocolVersion.Load()),
+		PendingActiveSum: int(atomic.LoadInt32(&s.conn.activeUnfinishedSum)),
+		QueueOverflowSum: s.conn.queueOverflowSum.Load(),
+	}
+	if last := s.conn.lastPacketTime.Load(); last > 0 {
+		info.LastPacketTime = time.Unix(0, last)
+	}
+	if info.ProtocolVersion == 0 {
+		info.ProtocolVersion = s.header.ProtocolVersion
 	}
-	return <-replyChan
+	return info
 }
@@ -45,7 +45,8 @@ func TestSessionManager_writeNotExistAndRoundTrip(t *testing.T) {
 
 	activeChan := make(chan *ActiveMessage, 1)
 	msg := newTerminalMessage(mustDecodeJTMessage(t, heartbeatPacket), heartbeatPacket)
-	key, err := sm.join(msg, activeChan)
+	c := &connection{activeMsgChan: activeChan}
+	key, err := sm.join(msg, c)
 	if err != nil {
 		t.Fatalf("join() error = %v", err)
 	}
@@ -54,7 +55,7 @@ func TestSessionManager_writeNotExistAndRoundTrip(t *testing.T) {
 	}
 
 	// 重复加入应失败
-	if _, err := sm.join(msg, make(chan *ActiveMessage, 1)); !errors.Is(err, _errKeyExist) {
+	if _, err := sm.join(msg, &connection{activeMsgChan: make(chan *ActiveMessage, 1)}); !errors.Is(err, _errKeyExist) {
 		t.Fatalf("second join() error = %v, want %v", err, _errKeyExist)
 	}
 
@@ -77,7 +78,7 @@ func TestSessionManager_writeNotExistAndRoundTrip(t *testing.T) {
 		t.Fatalf("write() command = %s, want %s", got.Command, consts.T0001GeneralRespond)
 	}
 
-	sm.leave(key)
+	sm.leave(key, c)
 	reply = sm.write(NewActiveMessage(key, consts.P8201QueryLocation, nil, time.Second))
 	if !errors.Is(reply.ExtensionFields.Err, ErrNotExistKey) {
 		t.Fatalf("after leave write() err = %v, want %v", reply.ExtensionFields.Err, ErrNotExistKey)
@@ -91,7 +92,61 @@ func TestSessionManager_invalidKey(t *testing.T) {
 	go sm.run()
 
 	msg := newTerminalMessage(mustDecodeJTMessage(t, heartbeatPacket), heartbeatPacket)
-	if _, err := sm.join(msg, make(chan *ActiveMessage, 1)); !errors.Is(err, _errKeyInvalid) {
+	if _, err := sm.join(msg, &connection{activeMsgChan: make(chan *ActiveMessage, 1)}); !errors.Is(err, _errKeyInvalid) {
 		t.Fatalf("join() error = %v, want %v", err, _errKeyInvalid)
 	}
 }
+
+func TestSessionManager_dispatchStuckTerminal(t *testing.T) {
+	var nextKey string
+	sm := newSessionManager(func(_ *Message) (string, bool) {
+		return nextKey, true
+	})
+	go sm.run()
+
+	msg := newTerminalMessage(mustDecodeJTMessage(t, heartbeatPacket), heartbeatPacket)
+	// stuck 的下发队列满了 一直不处理
+	stuck := newConnection(connectionParams{
+		metrics: nopMetrics{},
+		queue:   QueueOptions{ActiveSize: 1, Policy: OverflowDropNewest},
+	})
+	stuck.activeMsgChan <- NewActiveMessage("stuck", consts.P8201QueryLocation, nil, time.Second)
+	nextKey = "stuck"
+	if _, err := sm.join(msg, stuck); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	normal := &connection{activeMsgChan: make(chan *ActiveMessage, 1)}
+	nextKey = "normal"
+	if _, err := sm.join(msg, normal); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	go func() {
+		for active := range normal.activeMsgChan {
+			active.replyChan <- &Message{Command: consts.T0001GeneralRespond}
+		}
+	}()
+	defer close(normal.activeMsgChan)
+
+	activeMsgs := []*ActiveMessage{
+		NewActiveMessage("stuck", consts.P8201QueryLocation, nil, time.Second),
+		NewActiveMessage("normal", consts.P8201QueryLocation, nil, time.Second),
+	}
+	// stuck 在前面 会话管理器阻塞的话 normal 收不到
+	sm.dispatch(activeMsgs)
+	select {
+	case reply := <-activeMsgs[1].replyChan:
+		if reply.ExtensionFields.Err != nil || reply.Command != consts.T0001GeneralRespond {
+			t.Fatalf("normal reply = %+v", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("normal terminal blocked by stuck terminal")
+	}
+	select {
+	case reply := <-activeMsgs[0].replyChan:
+		if !errors.Is(reply.ExtensionFields.Err, ErrQueueOverflow) {
+			t.Fatalf("stuck reply err = %v, want %v", reply.ExtensionFields.Err, ErrQueueOverflow)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stuck terminal reply timeout")
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func TestService_sessionQueryAndKick(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	if got := g.OnlineCount(); got != 0 {
+		t.Fatalf("OnlineCount() = %d, want 0", got)
+	}
+	if _, ok := g.Session("12345678901"); ok {
+		t.Fatal("Session() found before join")
+	}
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	if got := g.OnlineCount(); got != 1 {
+		t.Fatalf("OnlineCount() = %d, want 1", got)
+	}
+	info, ok := g.Session(key)
+	if !ok {
+		t.Fatal("Session() not found after join")
+	}
+	if info.Key != key {
+		t.Fatalf("Session().Key = %s, want %s", info.Key, key)
+	}
+	if info.RemoteAddress != conn.LocalAddr().String() {
+		t.Fatalf("Session().RemoteAddress = %s, want %s", info.RemoteAddress, conn.LocalAddr().String())
+	}
+	if info.ProtocolVersion != consts.JT808Protocol2013 {
+		t.Fatalf("Session().ProtocolVersion = %s, want %s", info.ProtocolVersion, consts.JT808Protocol2013)
+	}
+	if info.JoinTime.IsZero() || info.Header.TerminalPhoneNo == "" {
+		t.Fatalf("Session() join time or header not set: %+v", info)
+	}
+	// 加入报文的固定头是副本 平台回复心跳时修改的流水号和回复ID不影响会话
+	if info.Header.ReplyID != 0 || info.Header.PlatformSerialNumber != 0 {
+		t.Fatalf("Session().Header modified by reply: %s", &info.Header)
+	}
+	info.Header.Property.EncryptMethod = 1
+	if again, _ := g.Session(key); again.Header.Property.EncryptMethod != 0 {
+		t.Fatalf("Session().Header shared: %s", &again.Header)
+	}
+	waitFor(t, time.Second, func() bool {
+		info, _ = g.Session(key)
+		return !info.LastPacketTime.IsZero()
+	})
+
+	sessions := g.Sessions()
+	if len(sessions) != 1 || sessions[0].Key != key {
+		t.Fatalf("Sessions() = %+v, want one session %s", sessions, key)
+	}
+
+	if err := g.Kick("missing", "test"); !errors.Is(err, ErrNotExistKey) {
+		t.Fatalf("Kick(missing) error = %v, want %v", err, ErrNotExistKey)
+	}
+	if err := g.Kick(key, "test"); err != nil {
+		t.Fatalf("Kick() error = %v", err)
+	}
+	if got := waitChan(t, events.left, 2*time.Second); got != key {
+		t.Fatalf("leave key = %s, want %s", got, key)
+	}
+	waitFor(t, time.Second, func() bool {
+		return g.OnlineCount() == 0
+	})
+}
+
+func TestService_sendActiveMessageContextCancel(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	replyChan := make(chan *Message, 1)
+	go func() {
+		replyChan <- g.SendActiveMessageContext(ctx,
+			NewActiveMessage(key, consts.P9101RealTimeAudioVideoRequest, nil, 10*time.Second))
+	}()
+	_ = readPacket(t, conn, 2*time.Second) // 终端收到了下发 但是不应答
+	waitFor(t, time.Second, func() bool {
+		info, _ := g.Session(key)
+		return info.PendingActiveSum == 1
+	})
+
+	cancel()
+	reply := waitChan(t, replyChan, time.Second)
+	if !errors.Is(reply.ExtensionFields.Err, context.Canceled) {
+		t.Fatalf("SendActiveMessageContext() err = %v, want %v", reply.ExtensionFields.Err, context.Canceled)
+	}
+	// 取消后连接中的记录立即释放 不需要等到10秒超时
+	waitFor(t, time.Second, func() bool {
+		info, _ := g.Session(key)
+		return info.PendingActiveSum == 0
+	})
+
+	// 已经取消的 ctx 不会再下发到终端
+	reply = g.SendActiveMessageContext(ctx, NewActiveMessage(key, consts.P8201QueryLocation, nil, time.Second))
+	if !errors.Is(reply.ExtensionFields.Err, context.Canceled) {
+		t.Fatalf("cancelled SendActiveMessageContext() err = %v, want %v", reply.ExtensionFields.Err, context.Canceled)
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// startContextTestServer 使用 RunContext 启动服务, 返回值 runErr 在 RunContext 返回后可读.
+func startContextTestServer(t *testing.T, ctx context.Context, opts ...Option) (*GoJT808, string, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	g := New(append([]Option{WithHostPorts(addr)}, opts...)...)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- g.RunContext(ctx)
+	}()
+	waitFor(t, 2*time.Second, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return len(g.listeners) == 1
+	})
+	return g, addr, runErr
+}
+
+func joinTestTerminal(t *testing.T, addr string, events *recordingTerminalEvent) net.Conn {
+	t.Helper()
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	_ = waitChan(t, events.joined, 2*time.Second)
+	return conn
+}
+
+func TestService_shutdownClosesSessions(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr, runErr := startContextTestServer(t, context.Background(),
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	_ = joinTestTerminal(t, addr, events)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if key := waitChan(t, events.left, time.Second); key != "12345678901" {
+		t.Fatalf("leave key = %s, want 12345678901", key)
+	}
+	if err := waitChan(t, runErr, time.Second); err != nil {
+		t.Fatalf("RunContext() error = %v", err)
+	}
+	if len(g.connections) != 0 {
+		t.Fatalf("connections = %d, want 0", len(g.connections))
+	}
+
+	reply := g.SendActiveMessage(NewActiveMessage("12345678901", consts.P8201QueryLocation, nil, time.Second))
+	if !errors.Is(reply.ExtensionFields.Err, ErrServerClosed) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrServerClosed)
+	}
+	if c, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+		_ = c.Close()
+		t.Fatal("expected dial to fail after shutdown")
+	}
+	// 多次调用直接返回
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatalf("second Shutdown() error = %v", err)
+	}
+}
+
+func TestService_shutdownDrainsActiveMessage(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr, _ := startContextTestServer(t, context.Background(),
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	conn := joinTestTerminal(t, addr, events)
+
+	replyChan := make(chan *Message, 1)
+	go func() {
+		replyChan <- g.SendActiveMessage(NewActiveMessage("12345678901", consts.P8201QueryLocation, nil, 2*time.Second))
+	}()
+	platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- g.Shutdown(ctx)
+	}()
+
+	// 关闭流程开始后 终端仍可以应答还在等待中的主动下发
+	time.Sleep(50 * time.Millisecond)
+	if _, err := conn.Write(encodeLocationQueryRespond(t, platformMsg.Header.SerialNumber, 2)); err != nil {
+		t.Fatalf("Write 0x0201 error = %v", err)
+	}
+	if reply := waitChan(t, replyChan, 2*time.Second); reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage() err = %v", reply.ExtensionFields.Err)
+	}
+	if err := waitChan(t, shutdownErr, 2*time.Second); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+}
+
+func TestService_shutdownDeadlineClosesPendingActiveMessage(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	ctx, cancel := context.WithCancel(context.Background())
+	g, addr, runErr := startContextTestServer(t, ctx,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	conn := joinTestTerminal(t, addr, events)
+
+	replyChan := make(chan *Message, 1)
+	go func() {
+		replyChan <- g.SendActiveMessage(NewActiveMessage("12345678901", consts.P8201QueryLocation, nil, 10*time.Second))
+	}()
+	_ = readPacket(t, conn, 2*time.Second)
+
+	expired, expiredCancel := context.WithCancel(context.Background())
+	expiredCancel()
+	if err := g.Shutdown(expired); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Shutdown() error = %v, want %v", err, context.Canceled)
+	}
+	reply := waitChan(t, replyChan, time.Second)
+	if !errors.Is(reply.ExtensionFields.Err, ErrConnectionClosed) {
+		t.Fatalf("SendActiveMessage() err = %v, want %v", reply.ExtensionFields.Err, ErrConnectionClosed)
+	}
+
+	cancel()
+	if err := waitChan(t, runErr, time.Second); err != nil {
+		t.Fatalf("RunContext() error = %v", err)
+	}
+}
+
+func TestService_runContextCancel(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	ctx, cancel := context.WithCancel(context.Background())
+	_, addr, runErr := startContextTestServer(t, ctx,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+	_ = joinTestTerminal(t, addr, events)
+
+	cancel()
+	if err := waitChan(t, runErr, 2*time.Second); err != nil {
+		t.Fatalf("RunContext() error = %v", err)
+	}
+	if key := waitChan(t, events.left, time.Second); key != "12345678901" {
+		t.Fatalf("leave key = %s, want 12345678901", key)
+	}
+}
+
+func TestService_shutdownWaitsOfflineDelivery(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	queue := &countingOfflineQueue{MemoryOfflineQueue: NewMemoryOfflineQueue(), gate: make(chan struct{})}
+	g, addr, runErr := startContextTestServer(t, context.Background(),
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithOfflineQueue(queue, time.Hour, nil),
+	)
+	_ = joinTestTerminal(t, addr, events)
+	waitFor(t, time.Second, func() bool { return queue.peeks.Load() == 1 })
+
+	// 离线指令下发协程还没有退出 Shutdown 等待它完成
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown() returned before offline delivery exit, err = %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(queue.gate)
+	if err := waitChan(t, done, 2*time.Second); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if err := waitChan(t, runErr, time.Second); err != nil {
+		t.Fatalf("RunContext() error = %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// CertificateCommonName 使用客户端证书的 CommonName 作为终端的key, 见 WithCertificateKeyFunc.
+func CertificateCommonName(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// verifyCertificateKey 校验客户端证书和终端的key是否一致.
+// 未设置 CertificateKeyFunc 的情况不校验, 设置了的情况不是TLS的连接(如没有 TLSConfig 的监听地址、UDP)都拒绝.
+func (c *connection) verifyCertificateKey(key string) error {
+	if c.certificateKeyFunc == nil {
+		return nil
+	}
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return errors.Join(ErrCertificateKeyMismatch, fmt.Errorf("key[%s] not tls connection", key))
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.Join(ErrCertificateKeyMismatch, fmt.Errorf("key[%s] no client certificate", key))
+	}
+	if certKey := c.certificateKeyFunc(certs[0]); certKey != key {
+		return errors.Join(ErrCertificateKeyMismatch, fmt.Errorf("key[%s] certificate key[%s]", key, certKey))
+	}
+	return nil
+}
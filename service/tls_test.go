@@ -0,0 +1,164 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func startTLSTestServer(t *testing.T, ca *testCA, opts ...Option) (*GoJT808, string) {
+	t.Helper()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	return startTestServer(t, append([]Option{WithTLSConfig(config)}, opts...)...)
+}
+
+func dialTLSTerminal(t *testing.T, ca *testCA, addr string, commonName string) net.Conn {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, commonName, x509.ExtKeyUsageClientAuth)},
+		RootCAs:      ca.pool,
+	})
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestService_tls(t *testing.T) {
+	ca := newTestCA(t)
+	events := newRecordingTerminalEvent()
+	_, addr := startTLSTestServer(t, ca,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithCertificateKeyFunc(CertificateCommonName),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTLSTerminal(t, ca, addr, "12345678901")
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if result := readGeneralRespondResult(t, conn); result != 0 {
+		t.Fatalf("heartbeat result = %d, want 0", result)
+	}
+	if key := waitChan(t, events.joined, 2*time.Second); key != "12345678901" {
+		t.Fatalf("join key = %s, want 12345678901", key)
+	}
+}
+
+func TestService_tlsCertificateKeyMismatch(t *testing.T) {
+	ca := newTestCA(t)
+	events := newRecordingTerminalEvent()
+	g, addr := startTLSTestServer(t, ca,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithCertificateKeyFunc(CertificateCommonName),
+	)
+
+	conn := dialTLSTerminal(t, ca, addr, "99999999999")
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	waitClosed(t, conn)
+	if _, ok := g.Session("12345678901"); ok {
+		t.Fatal("Session() found terminal with mismatched certificate")
+	}
+}
+
+func TestService_tlsCertificateKeyRejectPlaintext(t *testing.T) {
+	ca := newTestCA(t)
+	events := newRecordingTerminalEvent()
+	plain := freeAddr(t)
+	g, addr := startTLSTestServer(t, ca,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithCertificateKeyFunc(CertificateCommonName),
+		WithListeners(Listener{Addr: plain}),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	// 没有TLS的监听地址 无法校验证书 不能加入
+	conn := dialTerminal(t, plain)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	waitClosed(t, conn)
+	if _, ok := g.Session("12345678901"); ok {
+		t.Fatal("Session() found terminal without tls")
+	}
+
+	conn = dialTLSTerminal(t, ca, addr, "12345678901")
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	if key := waitChan(t, events.joined, 2*time.Second); key != "12345678901" {
+		t.Fatalf("join key = %s, want 12345678901", key)
+	}
+}
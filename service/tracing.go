@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// span 的名称.
+const (
+	// SpanJoin 终端加入.
+	SpanJoin = "jt808.join"
+	// SpanUplink 终端上传的一个报文 从读取到平台回复(或匹配到主动下发的应答).
+	SpanUplink = "jt808.uplink"
+	// SpanActive 平台主动下发 从下发到终端应答、超时或者取消.
+	SpanActive = "jt808.active"
+)
+
+// span 的属性名称.
+const (
+	AttrKey                  = "jt808.key"
+	AttrCommand              = "jt808.command"
+	AttrSerialNumber         = "jt808.serial_number"
+	AttrPlatformSerialNumber = "jt808.platform_serial_number"
+	AttrReplyCommand         = "jt808.reply_command"
+	AttrRemoteAddress        = "jt808.remote_address"
+	AttrOutcome              = "jt808.outcome"
+)
+
+type (
+	// Tracer 链路追踪, 见 WithTracer. 默认不追踪.
+	// 接口和 OpenTelemetry 的 trace.Tracer 类似, 可以很方便的适配:
+	//
+	//	func (o *otelTracer) Start(ctx context.Context, name string, attrs ...service.Attribute) (context.Context, service.Span) {
+	//		ctx, span := o.tracer.Start(ctx, name, trace.WithAttributes(toKeyValues(attrs)...))
+	//		return ctx, &otelSpan{span: span}
+	//	}
+	Tracer interface {
+		// Start 开始一个 span. 主动下发的 ctx 为 SendActiveMessageContext 传入的, 其余的为 context.Background().
+		Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	}
+
+	// Span 一次追踪 在连接的读写协程中调用 实现需要保证并发安全.
+	Span interface {
+		// SetAttributes 设置属性.
+		SetAttributes(attrs ...Attribute)
+		// AddEvent 记录一个事件 如写入、重传.
+		AddEvent(name string, attrs ...Attribute)
+		// End 结束 err 为最终的结果 nil表示成功. End 之后的调用应该被忽略.
+		End(err error)
+	}
+
+	// Attribute span 的属性.
+	Attribute struct {
+		Key   string
+		Value any
+	}
+)
+
+// nopTracer 默认的链路追踪 不做任何处理.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(_ ...Attribute)      {}
+func (nopSpan) AddEvent(_ string, _ ...Attribute) {}
+func (nopSpan) End(_ error)                       {}
+
+func commandAttr(key string, command consts.JT808CommandType) Attribute {
+	return Attribute{Key: key, Value: fmt.Sprintf("0x%04x", uint16(command))}
+}
+
+// messageAttrs 终端报文的属性 key、指令和流水号.
+func messageAttrs(msg *Message) []Attribute {
+	return []Attribute{
+		{Key: AttrKey, Value: msg.Key},
+		commandAttr(AttrCommand, msg.Command),
+		{Key: AttrSerialNumber, Value: int(msg.ExtensionFields.TerminalSeq)},
+	}
+}
+
+// startUplinkSpan 开始终端上传报文的追踪. 在读取协程中执行.
+func (c *connection) startUplinkSpan(msg *Message) {
+	_, msg.span = c.tracer.Start(context.Background(), SpanUplink, messageAttrs(msg)...)
+}
+
+// endUplinkSpan 结束终端上传报文的追踪 outcome 为处理的结果.
+func (c *connection) endUplinkSpan(msg *Message, outcome string, err error) {
+	if msg.span == nil {
+		return
+	}
+	attrs := []Attribute{{Key: AttrKey, Value: msg.Key}, {Key: AttrOutcome, Value: outcome}}
+	if msg.ExtensionFields.PlatformCommand != 0 {
+		attrs = append(attrs,
+			commandAttr(AttrReplyCommand, msg.ExtensionFields.PlatformCommand),
+			Attribute{Key: AttrPlatformSerialNumber, Value: int(msg.ExtensionFields.PlatformSeq)})
+	}
+	msg.span.SetAttributes(attrs...)
+	msg.span.End(err)
+	msg.span = nil
+}
+
+// trace 返回主动下发的追踪 未开启的情况返回 nopSpan.
+func (a *ActiveMessage) trace() Span {
+	if a.span == nil {
+		return nopSpan{}
+	}
+	return a.span
+}
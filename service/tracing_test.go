@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+type recordingSpan struct {
+	mu     sync.Mutex
+	name   string
+	parent context.Context
+	attrs  map[string]any
+	events []string
+	ended  chan error
+}
+
+func (r *recordingSpan) SetAttributes(attrs ...Attribute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, attr := range attrs {
+		r.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (r *recordingSpan) AddEvent(name string, _ ...Attribute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, name)
+}
+
+func (r *recordingSpan) End(err error) {
+	r.ended <- err
+}
+
+func (r *recordingSpan) attr(key string) any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attrs[key]
+}
+
+type recordingTracer struct {
+	spans chan *recordingSpan
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &recordingSpan{name: name, parent: ctx, attrs: map[string]any{}, ended: make(chan error, 1)}
+	span.SetAttributes(attrs...)
+	r.spans <- span
+	return ctx, span
+}
+
+func (r *recordingTracer) next(t *testing.T, name string) *recordingSpan {
+	t.Helper()
+	for {
+		span := waitChan(t, r.spans, 2*time.Second)
+		if span.name == name {
+			return span
+		}
+	}
+}
+
+type traceCtxKey struct{}
+
+func TestService_tracer(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	tracer := &recordingTracer{spans: make(chan *recordingSpan, 32)}
+	g, addr := startTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithTracer(tracer),
+	)
+	drainStringChan(events.left)
+	drainStringChan(events.joined)
+
+	conn := dialTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	// 终端上传的 span 先开始 加入在处理该报文的过程中
+	uplink := tracer.next(t, SpanUplink)
+	join := tracer.next(t, SpanJoin)
+	if err := waitChan(t, join.ended, time.Second); err != nil {
+		t.Fatalf("join span err = %v", err)
+	}
+	if got := join.attr(AttrKey); got != key {
+		t.Fatalf("join span key = %v, want %s", got, key)
+	}
+	_ = waitChan(t, uplink.ended, time.Second)
+	if got := uplink.attr(AttrCommand); got != "0x0002" {
+		t.Fatalf("uplink span command = %v, want 0x0002", got)
+	}
+	if got := uplink.attr(AttrOutcome); got != "reply" {
+		t.Fatalf("uplink span outcome = %v, want reply", got)
+	}
+	if got := uplink.attr(AttrReplyCommand); got != "0x8001" {
+		t.Fatalf("uplink span reply command = %v, want 0x8001", got)
+	}
+
+	go func() {
+		platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P9101RealTimeAudioVideoRequest, 2)
+		if _, err := conn.Write(resp); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}()
+	ctx := context.WithValue(context.Background(), traceCtxKey{}, "api")
+	reply := g.SendActiveMessageContext(ctx, NewActiveMessage(key, consts.P9101RealTimeAudioVideoRequest, nil, time.Second))
+	if reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessageContext() err = %v", reply.ExtensionFields.Err)
+	}
+
+	active := tracer.next(t, SpanActive)
+	if err := waitChan(t, active.ended, time.Second); err != nil {
+		t.Fatalf("active span err = %v", err)
+	}
+	if got := active.parent.Value(traceCtxKey{}); got != "api" {
+		t.Fatalf("active span parent ctx value = %v, want api", got)
+	}
+	if got := active.attr(AttrCommand); got != "0x9101" {
+		t.Fatalf("active span command = %v, want 0x9101", got)
+	}
+	if got := active.attr(AttrReplyCommand); got != "0x0001" {
+		t.Fatalf("active span reply command = %v, want 0x0001", got)
+	}
+	if got := active.attr(AttrPlatformSerialNumber); got != int(reply.ExtensionFields.PlatformSeq) {
+		t.Fatalf("active span platform seq = %v, want %d", got, reply.ExtensionFields.PlatformSeq)
+	}
+	active.mu.Lock()
+	gotEvents := append([]string(nil), active.events...)
+	active.mu.Unlock()
+	if len(gotEvents) != 2 || gotEvents[0] != "write" || gotEvents[1] != "respond" {
+		t.Fatalf("active span events = %v, want [write respond]", gotEvents)
+	}
+
+	respond := tracer.next(t, SpanUplink)
+	_ = waitChan(t, respond.ended, time.Second)
+	if got := respond.attr(AttrOutcome); got != "active respond" {
+		t.Fatalf("respond span outcome = %v, want active respond", got)
+	}
+}
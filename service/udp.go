@@ -0,0 +1,274 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+)
+
+const (
+	// udpMaxDatagramSize UDP单个数据报的最大长度.
+	udpMaxDatagramSize = 64 * 1024
+	// defaultUDPIdleTimeout 没有设置 IdleTimeout 时UDP虚拟连接的空闲超时, 为3个默认的心跳间隔(60秒).
+	// UDP没有断开连接的通知 不超时的话终端离线后虚拟连接一直存在.
+	defaultUDPIdleTimeout = 3 * time.Minute
+	// defaultUDPMaxSessions UDP虚拟连接数量的默认上限, 设置了 MaxConnections 的使用设置的.
+	defaultUDPMaxSessions = 100000
+)
+
+type (
+	// udpServer 将收到的 UDP 数据报按终端 key 分发到对应的虚拟连接.
+	// 同一个终端(key相同)的数据报共用一个虚拟连接, 而不是每个数据报一个连接.
+	udpServer struct {
+		conn *net.UDPConn
+		// keyFunc 用于获取终端唯一标识 和 Options.KeyFunc 一致.
+		keyFunc func(message *Message) (string, bool)
+		// decodeOptions 计算key时的解码选项 和 Options.DecodeOptions 一致.
+		decodeOptions jt808.DecodeOptions
+		// onNewConn 新的虚拟连接建立时的回调.
+		onNewConn func(conn net.Conn)
+		// idleTimeout 没有设置读取超时时的空闲超时.
+		idleTimeout time.Duration
+		// maxSessions 虚拟连接数量的上限 超过后新终端的数据报丢弃.
+		maxSessions int
+		// onPanicEvent keyFunc 发生 panic 的事件 和 Options.OnHandlerPanic 一致.
+		onPanicEvent func(p HandlerPanic)
+
+		mu       sync.Mutex
+		sessions map[string]*udpConn
+	}
+
+	// udpDatagram 收到的一个数据报和它的来源地址.
+	udpDatagram struct {
+		data []byte
+		addr *net.UDPAddr
+	}
+
+	// udpConn 在 UDP 上模拟的一个终端连接, 实现了 net.Conn.
+	//   - Read 读取该终端的数据报
+	//   - Write 回复到该终端最后一次上报的地址
+	//   - SetReadDeadline 用于空闲超时检测 没有设置的情况使用默认的空闲超时
+	udpConn struct {
+		server *udpServer
+		key    string
+		// remoteAddr 终端最后一次上报有效数据的地址 回复到这里.
+		// 收到数据报时不直接更新 解码和鉴权通过后才更新 见 updateRemoteAddr.
+		remoteAddr atomic.Pointer[net.UDPAddr]
+		// datagramChan 该终端上报的数据报.
+		datagramChan chan udpDatagram
+		// pending 上一次Read未读完的数据.
+		pending []byte
+		// pendingAddr 正在读取的数据报的来源地址 只在读取协程中使用.
+		pendingAddr *net.UDPAddr
+		// readDeadline 读取超时时间 零值表示不超时.
+		readDeadline atomic.Pointer[time.Time]
+		closeChan    chan struct{}
+		closeOnce    sync.Once
+	}
+)
+
+func newUDPServer(conn *net.UDPConn, keyFunc func(message *Message) (string, bool),
+	decodeOptions jt808.DecodeOptions, onNewConn func(conn net.Conn)) *udpServer {
+	return &udpServer{
+		conn:          conn,
+		keyFunc:       keyFunc,
+		decodeOptions: decodeOptions,
+		onNewConn:     onNewConn,
+		idleTimeout:   defaultUDPIdleTimeout,
+		maxSessions:   defaultUDPMaxSessions,
+		sessions:      make(map[string]*udpConn),
+	}
+}
+
+func (u *udpServer) run() {
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("udp read fail",
+				slog.Any("err", err))
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		u.dispatch(u.datagramKey(data, addr), addr, data)
+	}
+}
+
+// datagramKey 使用数据报中的第一个完整帧计算终端key, 无法计算时使用终端地址.
+func (u *udpServer) datagramKey(data []byte, addr *net.UDPAddr) string {
+	frames := jt808.NewFrameReader().ReadFrames(data)
+	if len(frames) > 0 {
+		jtMsg := jt808.NewJTMessage()
+		if err := u.decodeOptions.Decode(jtMsg, frames[0]); err == nil {
+			msg := newTerminalMessage(jtMsg, frames[0])
+			var (
+				key string
+				ok  bool
+			)
+			// 在 UDP 读取协程中执行 panic 的情况使用终端地址
+			panicked := safeCall(HandlerPanic{
+				Address:  addr.String(),
+				Callback: "KeyFunc",
+				Message:  msg,
+			}, u.onPanicEvent, func() {
+				key, ok = u.keyFunc(msg)
+			})
+			if !panicked && ok && key != "" {
+				return key
+			}
+		}
+	}
+	return addr.String()
+}
+
+func (u *udpServer) dispatch(key string, addr *net.UDPAddr, data []byte) {
+	u.mu.Lock()
+	conn, ok := u.sessions[key]
+	if !ok {
+		if len(u.sessions) >= u.maxSessions {
+			u.mu.Unlock()
+			slog.Warn("udp sessions full, datagram discard",
+				slog.String("key", key),
+				slog.Int("max sessions", u.maxSessions))
+			return
+		}
+		conn = newUDPConn(u, key)
+		u.sessions[key] = conn
+	}
+	u.mu.Unlock()
+
+	if !ok {
+		// 新的虚拟连接 先使用第一个数据报的地址
+		conn.remoteAddr.Store(addr)
+		u.onNewConn(conn)
+	}
+
+	select {
+	case conn.datagramChan <- udpDatagram{data: data, addr: addr}:
+	case <-conn.closeChan:
+	default:
+		slog.Warn("udp datagram discard",
+			slog.String("key", key),
+			slog.String("data", fmt.Sprintf("%x", data)))
+	}
+}
+
+func (u *udpServer) remove(conn *udpConn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if v, ok := u.sessions[conn.key]; ok && v == conn {
+		delete(u.sessions, conn.key)
+	}
+}
+
+func newUDPConn(server *udpServer, key string) *udpConn {
+	return &udpConn{
+		server:       server,
+		key:          key,
+		datagramChan: make(chan udpDatagram, 32),
+		closeChan:    make(chan struct{}),
+	}
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		return c.readPending(b), nil
+	}
+
+	// 没有设置读取超时的情况 使用默认的空闲超时 避免虚拟连接一直存在
+	wait := c.server.idleTimeout
+	if deadline := c.readDeadline.Load(); deadline != nil && !deadline.IsZero() {
+		wait = time.Until(*deadline)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-c.closeChan:
+		return 0, net.ErrClosed
+	case <-timer.C:
+		return 0, os.ErrDeadlineExceeded
+	case datagram := <-c.datagramChan:
+		c.pending = datagram.data
+		c.pendingAddr = datagram.addr
+		return c.readPending(b), nil
+	}
+}
+
+// updateRemoteAddr 正在读取的数据报解码和鉴权都通过了 之后回复到它的来源地址.
+// 伪造手机号的数据报无法改变回复的地址. 在连接的读取协程中调用.
+func (c *udpConn) updateRemoteAddr() {
+	if c.pendingAddr != nil {
+		c.remoteAddr.Store(c.pendingAddr)
+	}
+}
+
+func (c *udpConn) readPending(b []byte) int {
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closeChan:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.server.conn.WriteToUDP(b, c.remoteAddr.Load())
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.server.remove(c)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.server.conn.LocalAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remoteAddr.Load()
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(&t)
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// remoteAddrUpdater 回复地址跟随终端上报变化的连接(UDP虚拟连接).
+type remoteAddrUpdater interface {
+	updateRemoteAddr()
+}
+
+// onRemoteAddr 报文解码、解密和鉴权(开启 WithAuthenticator 时)都通过后 更新UDP终端的回复地址.
+func (c *connection) onRemoteAddr() {
+	if u, ok := c.conn.(remoteAddrUpdater); ok && (c.authenticator == nil || c.authenticated) {
+		u.updateRemoteAddr()
+	}
+}
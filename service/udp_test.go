@@ -0,0 +1,195 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/protocol/jt808"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func startUDPTestServer(t *testing.T, opts ...Option) (*GoJT808, string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	_ = pc.Close()
+
+	all := append([]Option{WithHostPorts(addr), WithNetwork("udp")}, opts...)
+	g := New(all...)
+	go g.Run()
+	time.Sleep(100 * time.Millisecond)
+	return g, addr
+}
+
+func dialUDPTerminal(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestService_udpHeartbeatAndActiveMessage(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startUDPTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+	)
+
+	conn := dialUDPTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	reply := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+	if consts.JT808CommandType(reply.Header.ID) != consts.P8001GeneralRespond {
+		t.Fatalf("reply command = 0x%04X, want 0x8001", reply.Header.ID)
+	}
+	key := waitChan(t, events.joined, 2*time.Second)
+	if key != "12345678901" {
+		t.Fatalf("join key = %s, want 12345678901", key)
+	}
+
+	// 同一个终端的后续数据报复用虚拟会话 不会再次加入
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	select {
+	case k := <-events.joined:
+		t.Fatalf("unexpected second join: %s", k)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	go func() {
+		platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P8300TextInfoDistribution, 2)
+		if _, err := conn.Write(resp); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}()
+	got := g.SendActiveMessage(NewActiveMessage(key, consts.P8300TextInfoDistribution,
+		[]byte{0x01, 0x31, 0x32, 0x33}, time.Second))
+	if got.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage err = %v", got.ExtensionFields.Err)
+	}
+	if got.Command != consts.T0001GeneralRespond {
+		t.Fatalf("reply command = %s, want %s", got.Command, consts.T0001GeneralRespond)
+	}
+}
+
+func TestService_udpRemoteAddrAfterDecode(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	g, addr := startUDPTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithRSAPrivateKey(generateRSAKey(t)),
+	)
+
+	conn := dialUDPTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+	key := waitChan(t, events.joined, 2*time.Second)
+
+	// 其他地址伪造同一个手机号 解密失败的数据报不改变回复的地址
+	spoof := dialUDPTerminal(t, addr)
+	forged := encodeEncryptedTerminalPacket(t, &generateRSAKey(t).PublicKey, consts.T0200LocationReport, make([]byte, 28))
+	if _, err := spoof.Write(forged); err != nil {
+		t.Fatalf("Write forged error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second) // 解密失败的应答
+
+	go func() {
+		platformMsg := decodeFirstMessage(t, readPacket(t, conn, 2*time.Second))
+		resp := encodeGeneralRespond(t, platformMsg.Header.SerialNumber, consts.P8201QueryLocation, 2)
+		if _, err := conn.Write(resp); err != nil {
+			t.Errorf("Write 0x0001 error = %v", err)
+		}
+	}()
+	if reply := g.SendActiveMessage(NewActiveMessage(key, consts.P8201QueryLocation, nil, time.Second)); reply.ExtensionFields.Err != nil {
+		t.Fatalf("SendActiveMessage err = %v", reply.ExtensionFields.Err)
+	}
+	_ = spoof.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := spoof.Read(make([]byte, 1024)); err == nil {
+		t.Fatalf("spoof address received %d bytes", n)
+	}
+
+	// 解码通过的数据报 回复地址跟随终端变化
+	moved := dialUDPTerminal(t, addr)
+	if _, err := moved.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, moved, 2*time.Second)
+	if info, _ := g.Session(key); info.RemoteAddress != moved.LocalAddr().String() {
+		t.Fatalf("Session().RemoteAddress = %s, want %s", info.RemoteAddress, moved.LocalAddr())
+	}
+}
+
+func TestService_udpIdleTimeout(t *testing.T) {
+	events := newRecordingTerminalEvent()
+	timeoutChan := make(chan TerminalTimeout, 1)
+	_, addr := startUDPTestServer(t,
+		WithCustomTerminalEventer(func() TerminalEventer { return events }),
+		WithTerminalTimeout(200*time.Millisecond, func(timeout TerminalTimeout) {
+			timeoutChan <- timeout
+		}),
+	)
+
+	conn := dialUDPTerminal(t, addr)
+	if _, err := conn.Write(heartbeatPacket); err != nil {
+		t.Fatalf("Write heartbeat error = %v", err)
+	}
+	_ = readPacket(t, conn, 2*time.Second)
+
+	if got := waitChan(t, timeoutChan, 2*time.Second); got.Key != "12345678901" {
+		t.Fatalf("timeout key = %s, want 12345678901", got.Key)
+	}
+	if key := waitChan(t, events.left, 2*time.Second); key != "12345678901" {
+		t.Fatalf("leave key = %s, want 12345678901", key)
+	}
+}
+
+func Test_udpServer_defaultIdleTimeoutAndMaxSessions(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer func() { _ = pc.Close() }()
+
+	conns := make(chan net.Conn, 4)
+	u := newUDPServer(pc, nil, jt808.StrictDecodeOptions(), func(conn net.Conn) {
+		conns <- conn
+	})
+	u.idleTimeout = 100 * time.Millisecond
+	u.maxSessions = 1
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7808}
+
+	u.dispatch("1", addr, heartbeatPacket)
+	conn := waitChan(t, conns, time.Second)
+	// 超过上限的新终端 数据报丢弃
+	u.dispatch("2", addr, heartbeatPacket)
+	select {
+	case <-conns:
+		t.Fatal("new session over max sessions")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	buf := make([]byte, 1024)
+	if n, err := conn.Read(buf); err != nil || n != len(heartbeatPacket) {
+		t.Fatalf("Read() n = %d err = %v", n, err)
+	}
+	// 没有设置读取超时 使用默认的空闲超时
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() err = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	_ = conn.Close()
+	u.dispatch("2", addr, heartbeatPacket)
+	_ = waitChan(t, conns, time.Second)
+}
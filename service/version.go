@@ -0,0 +1,23 @@
+package service
+
+import (
+	"github.com/cuteLittleDevil/go-jt808/protocol/model"
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+// onProtocolVersion 确定终端报文的协议版本 2011和2013版本的固定头相同.
+// 设置了 WithProtocolVersionFunc 的使用配置的版本, 否则根据终端注册(0x0100)的消息体判断,
+// 判断为2011版本后 该连接之后的报文都按照2011版本. 在读取协程中执行.
+func (c *connection) onProtocolVersion(msg *Message) {
+	header := msg.JTMessage.Header
+	switch {
+	case header.ProtocolVersion == consts.JT808Protocol2019:
+	case c.protocolVersionFunc != nil:
+		header.ApplyProtocolVersion(c.protocolVersionFunc)
+	case c.protocolVersion.Load() == uint32(consts.JT808Protocol2011):
+		header.ProtocolVersion = consts.JT808Protocol2011
+	case msg.Command == consts.T0100Register && msg.hasComplete() && header.Property.EncryptMethod == 0:
+		header.ProtocolVersion = model.DetectProtocolVersion(msg.JTMessage)
+	}
+	c.protocolVersion.Store(uint32(header.ProtocolVersion))
+}
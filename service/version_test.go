@@ -0,0 +1,71 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cuteLittleDevil/go-jt808/shared/consts"
+)
+
+func TestService_protocolVersion(t *testing.T) {
+	const (
+		// 2011版本的终端注册 车牌为车辆VIN 消息体超过36个字节
+		register2011 = "7e0100002a0123456789010000001f007363640000007777772e3830382e37363534333231004c53564155323138304e32313833323934907e"
+		// 2013版本的终端注册 终端ID包含非字母数字
+		register2013 = "7e0100002c0123456789010000001f007363640000007777772e3830380000000000000000000000000037362d3534333201b2e241313233349f7e"
+	)
+	tests := []struct {
+		name    string
+		opts    []Option
+		packets [][]byte
+		want    consts.ProtocolVersionType
+	}{
+		{
+			name:    "注册判断为2011版本",
+			packets: [][]byte{mustHex(register2011), heartbeatPacket},
+			want:    consts.JT808Protocol2011,
+		},
+		{
+			name:    "注册判断为2013版本",
+			packets: [][]byte{mustHex(register2013), heartbeatPacket},
+			want:    consts.JT808Protocol2013,
+		},
+		{
+			name: "指定2011版本",
+			opts: []Option{WithProtocolVersionFunc(func(phone string) (consts.ProtocolVersionType, bool) {
+				return consts.JT808Protocol2011, phone == "12345678901"
+			})},
+			packets: [][]byte{heartbeatPacket},
+			want:    consts.JT808Protocol2011,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions := make(chan consts.ProtocolVersionType, 8)
+			opts := append([]Option{
+				WithMiddleware(func(next HandlerFunc) HandlerFunc {
+					return func(msg *Message) error {
+						versions <- msg.JTMessage.Header.ProtocolVersion
+						return next(msg)
+					}
+				}),
+			}, tt.opts...)
+			g, addr := startTestServer(t, opts...)
+			conn := dialTerminal(t, addr)
+			for _, packet := range tt.packets {
+				if _, err := conn.Write(packet); err != nil {
+					t.Fatalf("Write error = %v", err)
+				}
+				_ = readPacket(t, conn, 2*time.Second)
+				// 之后的报文也按照确定的版本
+				if got := waitChan(t, versions, 2*time.Second); got != tt.want {
+					t.Fatalf("ProtocolVersion = %s, want %s", got, tt.want)
+				}
+			}
+			info, ok := g.Session("12345678901")
+			if !ok || info.ProtocolVersion != tt.want {
+				t.Fatalf("Session() = %+v, want %s", info, tt.want)
+			}
+		})
+	}
+}
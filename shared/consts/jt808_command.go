@@ -8,6 +8,8 @@ const (
 	T0001GeneralRespond JT808CommandType = 0x0001
 	// T0002HeartBeat 终端-心跳.
 	T0002HeartBeat JT808CommandType = 0x0002
+	// T0003Logout 终端-注销.
+	T0003Logout JT808CommandType = 0x0003
 	// T0100Register 终端-注册.
 	T0100Register JT808CommandType = 0x0100
 	// T0102RegisterAuth 终端-注册鉴权.
@@ -44,6 +46,8 @@ const (
 	T0805CameraShootImmediately JT808CommandType = 0x0805
 	// T0900DataUpTransparentTransmission 终端-数据上行透传.
 	T0900DataUpTransparentTransmission JT808CommandType = 0x0900
+	// T0A00TerminalRSAPublicKey 终端-RSA公钥.
+	T0A00TerminalRSAPublicKey JT808CommandType = 0x0A00
 
 	// P8001GeneralRespond 平台-通用应答.
 	P8001GeneralRespond JT808CommandType = 0x8001
@@ -115,6 +119,8 @@ const (
 	P8805SingleMultimediaDataRetrieval JT808CommandType = 0x8805
 	// P8900DataDownTransparentTransmission 平台-数据下行透传.
 	P8900DataDownTransparentTransmission JT808CommandType = 0x8900
+	// P8A00PlatformRSAPublicKey 平台-RSA公钥.
+	P8A00PlatformRSAPublicKey JT808CommandType = 0x8A00
 )
 
 func (j JT808CommandType) String() string {
@@ -123,6 +129,8 @@ func (j JT808CommandType) String() string {
 		return "终端-通用应答"
 	case T0002HeartBeat:
 		return "终端-心跳"
+	case T0003Logout:
+		return "终端-注销"
 	case T0100Register:
 		return "终端-注册"
 	case T0102RegisterAuth:
@@ -159,6 +167,8 @@ func (j JT808CommandType) String() string {
 		return "终端-摄像头立即拍照"
 	case T0900DataUpTransparentTransmission:
 		return "终端-数据上行透传"
+	case T0A00TerminalRSAPublicKey:
+		return "终端-RSA公钥"
 	case P8001GeneralRespond:
 		return "平台-通用应答"
 	case P8003ReissueSubcontractingRequest:
@@ -229,6 +239,8 @@ func (j JT808CommandType) String() string {
 		return "平台-单条多媒体数据检索"
 	case P8900DataDownTransparentTransmission:
 		return "平台-数据下行透传"
+	case P8A00PlatformRSAPublicKey:
+		return "平台-RSA公钥"
 	}
 
 	switch j {
@@ -275,5 +287,13 @@ func (j JT808CommandType) String() string {
 		return "终端-升级进度上报"
 	}
 
-	return "平台-暂未实现的命令"
+	return unknownCommandName
+}
+
+// unknownCommandName 没有定义的指令 String 返回的名称.
+const unknownCommandName = "平台-暂未实现的命令"
+
+// Known 是否是已经定义的指令.
+func (j JT808CommandType) Known() bool {
+	return j.String() != unknownCommandName
 }
@@ -0,0 +1,180 @@
+// Package proxyproto 解析负载均衡(HAProxy、LVS等)在连接开头发送的 PROXY protocol 头部.
+// 支持 v1(文本) 和 v2(二进制), service、attachment 和 adapter 共用.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTimeout 读取 PROXY 头部默认的超时时间.
+const defaultTimeout = 5 * time.Second
+
+// ErrHeaderInvalid PROXY protocol 头部错误或者缺失.
+var ErrHeaderInvalid = errors.New("proxy header invalid")
+
+// proxyV2Signature PROXY protocol v2 的固定头部.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Config 解析 PROXY protocol 头部的配置.
+type Config struct {
+	// Timeout 读取头部的超时时间 默认5秒
+	Timeout time.Duration
+	// Required 是否必须有头部 false的情况没有头部的连接按普通连接处理
+	Required bool
+}
+
+func (c Config) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+// proxyConn 解析了 PROXY 头部的连接 RemoteAddr 和 LocalAddr 为头部中的地址.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *proxyConn) RemoteAddr() net.Addr {
+	if p.remoteAddr != nil {
+		return p.remoteAddr
+	}
+	return p.Conn.RemoteAddr()
+}
+
+func (p *proxyConn) LocalAddr() net.Addr {
+	if p.localAddr != nil {
+		return p.localAddr
+	}
+	return p.Conn.LocalAddr()
+}
+
+// ReadHeader 读取连接开头的 PROXY 头部, 返回的连接 RemoteAddr 为头部中的源地址.
+// JT808报文以0x7e开头 TLS以0x16开头 因此通过第一个字节判断是否有头部.
+func ReadHeader(conn net.Conn, config Config) (net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(config.timeout()))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	pc := &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}
+	first, err := pc.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		err = pc.readV1()
+	case proxyV2Signature[0]:
+		err = pc.readV2()
+	default:
+		if config.Required {
+			err = ErrHeaderInvalid
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 解析文本格式 如 PROXY TCP4 192.168.0.1 192.168.0.11 56324 808\r\n.
+func (p *proxyConn) readV1() error {
+	line, err := p.reader.ReadSlice('\n')
+	if err != nil {
+		return errors.Join(ErrHeaderInvalid, err)
+	}
+	// 最长107个字节
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.Join(ErrHeaderInvalid, fmt.Errorf("v1 line [%q]", line))
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errors.Join(ErrHeaderInvalid, fmt.Errorf("v1 line [%q]", line))
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return errors.Join(ErrHeaderInvalid, fmt.Errorf("v1 protocol [%s]", fields[1]))
+	}
+	if len(fields) != 6 {
+		return errors.Join(ErrHeaderInvalid, fmt.Errorf("v1 line [%q]", line))
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	p.remoteAddr, p.localAddr = src, dst
+	return nil
+}
+
+func parseProxyAddr(host string, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	n, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Join(ErrHeaderInvalid, fmt.Errorf("v1 addr [%s:%s]", host, port))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// readV2 解析二进制格式 12字节固定头部 + 版本和命令 + 协议 + 2字节长度 + 地址.
+func (p *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(p.reader, header); err != nil {
+		return errors.Join(ErrHeaderInvalid, err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return errors.Join(ErrHeaderInvalid, fmt.Errorf("v2 header [%x]", header))
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(p.reader, payload); err != nil {
+		return errors.Join(ErrHeaderInvalid, err)
+	}
+	if header[12]&0x0F == 0 { // LOCAL 负载均衡自己的健康检查等 使用原始地址
+		return nil
+	}
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC AF_UNIX 使用原始地址
+		return nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return errors.Join(ErrHeaderInvalid, fmt.Errorf("v2 address len [%d]", len(payload)))
+	}
+	ports := payload[2*ipLen:]
+	p.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(ports[0:2])),
+	}
+	p.localAddr = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(ports[2:4])),
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func v2Header(command byte, family byte, src string, srcPort uint16, dst string, dstPort uint16) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, command, family)
+	srcIP, dstIP := net.ParseIP(src).To4(), net.ParseIP(dst).To4()
+	header = binary.BigEndian.AppendUint16(header, uint16(len(srcIP)+len(dstIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, srcPort)
+	return binary.BigEndian.AppendUint16(header, dstPort)
+}
+
+func TestReadHeader(t *testing.T) {
+	// 头部后面的数据 解析后按普通连接读取
+	payload := []byte{0x7e, 0x00, 0x02, 0x7e}
+	tests := []struct {
+		name     string
+		header   []byte
+		required bool
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:   "v1",
+			header: []byte("PROXY TCP4 203.0.113.7 192.168.0.11 56324 808\r\n"),
+			want:   "203.0.113.7:56324",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 808\r\n"),
+			want:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 unknown 使用原始地址",
+			header: []byte("PROXY UNKNOWN\r\n"),
+			want:   "pipe",
+		},
+		{
+			name:   "v2",
+			header: v2Header(0x21, 0x11, "203.0.113.8", 40000, "192.168.0.11", 808),
+			want:   "203.0.113.8:40000",
+		},
+		{
+			name:   "v2 local 使用原始地址",
+			header: v2Header(0x20, 0x11, "203.0.113.8", 40000, "192.168.0.11", 808),
+			want:   "pipe",
+		},
+		{
+			name: "没有头部",
+			want: "pipe",
+		},
+		{
+			name:     "没有头部 必须有头部",
+			required: true,
+			wantErr:  true,
+		},
+		{
+			name:    "v1 端口错误",
+			header:  []byte("PROXY TCP4 203.0.113.7 192.168.0.11 70000 808\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "v1 没有\\r",
+			header:  []byte("PROXY TCP4 203.0.113.7 192.168.0.11 56324 808\n"),
+			wantErr: true,
+		},
+		{
+			name:    "v2 地址长度不够",
+			header:  append(append(append([]byte(nil), proxyV2Signature...), 0x21, 0x11, 0x00, 0x04), 1, 2, 3, 4),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer func() {
+				_ = server.Close()
+				_ = client.Close()
+			}()
+			go func() {
+				_, _ = client.Write(append(tt.header, payload...))
+			}()
+
+			conn, err := ReadHeader(server, Config{Timeout: time.Second, Required: tt.required})
+			if tt.wantErr {
+				if !errors.Is(err, ErrHeaderInvalid) {
+					t.Fatalf("ReadHeader() error = %v, want %v", err, ErrHeaderInvalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadHeader() error = %v", err)
+			}
+			if got := conn.RemoteAddr().String(); got != tt.want {
+				t.Fatalf("RemoteAddr = %s, want %s", got, tt.want)
+			}
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != string(payload) {
+				t.Fatalf("Read() = %x %v, want %x", got, err, payload)
+			}
+		})
+	}
+}